@@ -0,0 +1,85 @@
+// Package clock is the source of time for polling, delays and retries,
+// it's replaced by a fake one in tests.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the current time and waits for durations to elapse.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// Real is the wall clock.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// Fake is a manually advanced clock, every After call
+// is announced on the Waits channel when it's not nil.
+type Fake struct {
+	// Waits receives durations passed to After, it's set
+	// before the clock is used, so callers can wait for
+	// a goroutine to block on the clock and advance it.
+	Waits chan time.Duration
+
+	mu      sync.Mutex
+	now     time.Time
+	waiters []waiter
+}
+
+type waiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+// NewFake creates a fake clock stopped at an arbitrary fixed time.
+func NewFake() *Fake {
+	return &Fake{now: time.Unix(1500000000, 0)}
+}
+
+// Now returns the current time of the clock.
+func (c *Fake) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// After returns a channel receiving the time once the clock
+// is advanced by d, it fires immediately when d isn't positive.
+func (c *Fake) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+	} else {
+		c.waiters = append(c.waiters, waiter{c.now.Add(d), ch})
+	}
+	c.mu.Unlock()
+	if c.Waits != nil {
+		c.Waits <- d
+	}
+	return ch
+}
+
+// Advance moves the clock forward by d and fires the due waiters.
+func (c *Fake) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			waiters = append(waiters, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = waiters
+}
@@ -0,0 +1,41 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	t.Parallel()
+
+	c := NewFake()
+	start := c.Now()
+	ch := c.After(time.Minute)
+	c.Advance(59 * time.Second)
+	select {
+	case <-ch:
+		t.Fatal("fired before the deadline")
+	default:
+	}
+	c.Advance(time.Second)
+	if now := <-ch; !now.Equal(start.Add(time.Minute)) {
+		t.Errorf("fired at %s, want %s", now, start.Add(time.Minute))
+	}
+
+	select {
+	case <-c.After(0):
+	default:
+		t.Error("After(0) didn't fire immediately")
+	}
+}
+
+func TestFakeWaits(t *testing.T) {
+	t.Parallel()
+
+	c := NewFake()
+	c.Waits = make(chan time.Duration, 1)
+	c.After(time.Hour)
+	if d := <-c.Waits; d != time.Hour {
+		t.Errorf("wait = %s, want %s", d, time.Hour)
+	}
+}
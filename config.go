@@ -0,0 +1,253 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// webhookKey is the config key of the webhook url,
+// that's the only one which is not a flag name.
+const webhookKey = "webhook-url"
+
+// config is a YAML config file checked against flags.
+//
+// The file is a mapping, keys are flag names and webhook-url,
+// repeatable flags take lists, e.g.:
+//
+//	slack-channel: alerts
+//	interval: 30s
+//	include:
+//	  - nginx.service
+//	  - "*.timer"
+//	exclude: [a.service, b.service]
+//	webhook-url: https://hooks.slack.com/services/...
+type config struct {
+	name    string
+	entries []configEntry
+}
+
+// readConfig parses the named config file and checks that all its keys
+// are known and only repeatable flags take lists, flags stay intact.
+func readConfig(name string) (*config, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries, err := parseConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+
+	seen := map[string]bool{}
+	for _, e := range entries {
+		repeatable := false
+		if e.key != webhookKey {
+			f := flag.Lookup(e.key)
+			if f == nil || e.key == "config" {
+				return nil, fmt.Errorf("%s:%d: unknown key %q", name, e.line, e.key)
+			}
+			_, repeatable = f.Value.(*stringsFlag)
+		}
+		if seen[e.key] && !repeatable {
+			return nil, fmt.Errorf("%s:%d: %s takes a single value, not a list", name, e.line, e.key)
+		}
+		seen[e.key] = true
+	}
+	return &config{name: name, entries: entries}, nil
+}
+
+// apply sets flags that are not set on the command line to config values.
+func (c *config) apply() error {
+	for _, e := range c.entries {
+		if e.key == webhookKey || isFlagSet(e.key) {
+			continue
+		}
+		if err := flag.Lookup(e.key).Value.Set(e.value); err != nil {
+			return fmt.Errorf("%s:%d: %s: %s", c.name, e.line, e.key, err)
+		}
+	}
+	return nil
+}
+
+// url returns the webhook url, it's empty when it's not in the config.
+func (c *config) url() string {
+	if v := c.values(webhookKey); len(v) != 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// values returns values of the key in the config order.
+func (c *config) values(key string) []string {
+	var v []string
+	for _, e := range c.entries {
+		if e.key == key {
+			v = append(v, e.value)
+		}
+	}
+	return v
+}
+
+// duration returns the duration value of the key or def when it's missing.
+func (c *config) duration(key string, def time.Duration) (time.Duration, error) {
+	for _, e := range c.entries {
+		if e.key != key {
+			continue
+		}
+		d, err := time.ParseDuration(e.value)
+		if err != nil {
+			return 0, fmt.Errorf("%s:%d: %s: %s", c.name, e.line, e.key, err)
+		}
+		return d, nil
+	}
+	return def, nil
+}
+
+// changed returns keys with different values in c and o, sorted.
+func (c *config) changed(o *config) []string {
+	keys := map[string]bool{}
+	for _, e := range c.entries {
+		keys[e.key] = true
+	}
+	for _, e := range o.entries {
+		keys[e.key] = true
+	}
+	var changed []string
+	for key := range keys {
+		if !reflect.DeepEqual(c.values(key), o.values(key)) {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// configEntry is a config key with its value.
+type configEntry struct {
+	key   string
+	value string
+	line  int
+}
+
+// parseConfig decodes a YAML mapping of keys to scalars or lists
+// of scalars, every list item is a separate entry. Nested mappings,
+// aliases and multiple documents are not supported.
+func parseConfig(r io.Reader) ([]configEntry, error) {
+	dec := yaml.NewDecoder(r)
+	var doc yaml.Node
+	if err := dec.Decode(&doc); err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var extra yaml.Node
+	if err := dec.Decode(&extra); err != io.EOF {
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("line %d: multiple documents are not supported", extra.Line)
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+
+	m := doc.Content[0]
+	if m.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: want a mapping of keys to values", m.Line)
+	}
+	var entries []configEntry
+	seen := map[string]int{}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		k, v := m.Content[i], m.Content[i+1]
+		if k.Kind != yaml.ScalarNode {
+			return nil, fmt.Errorf("line %d: malformed key", k.Line)
+		}
+		if line, ok := seen[k.Value]; ok {
+			return nil, fmt.Errorf("line %d: duplicate key %q, it's already set at line %d", k.Line, k.Value, line)
+		}
+		seen[k.Value] = k.Line
+
+		switch v.Kind {
+		case yaml.ScalarNode:
+			if isNull(v) {
+				return nil, fmt.Errorf("line %d: %s has no value, quote empty values", v.Line, k.Value)
+			}
+			entries = append(entries, configEntry{key: k.Value, value: v.Value, line: k.Line})
+		case yaml.SequenceNode:
+			for _, item := range v.Content {
+				if item.Kind != yaml.ScalarNode || isNull(item) {
+					return nil, fmt.Errorf("line %d: %s list items must be values", item.Line, k.Value)
+				}
+				entries = append(entries, configEntry{key: k.Value, value: item.Value, line: item.Line})
+			}
+		default:
+			return nil, fmt.Errorf("line %d: %s must be a value or a list of values", v.Line, k.Value)
+		}
+	}
+	return entries, nil
+}
+
+// isNull reports whether the scalar node is a null, e.g. an empty value.
+func isNull(n *yaml.Node) bool {
+	return n.Tag == "!!null"
+}
+
+// readURLFile reads the webhook url from the named file, e.g.
+// a mounted secret, surrounding whitespace is trimmed.
+func readURLFile(name string) (string, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	url := strings.TrimSpace(string(b))
+	if url == "" {
+		return "", fmt.Errorf("%s: webhook url is empty", name)
+	}
+	return url, nil
+}
+
+// urlSetter is implemented by notifiers whose url can be replaced at runtime.
+type urlSetter interface {
+	SetURL(url string)
+}
+
+// urlRotation passes the webhook url re-read from its file
+// to notifiers that use it, it's triggered by SIGHUP.
+type urlRotation struct {
+	mu      sync.Mutex
+	setters []urlSetter
+}
+
+// add makes rotate update s.
+func (r *urlRotation) add(s urlSetter) {
+	r.mu.Lock()
+	r.setters = append(r.setters, s)
+	r.mu.Unlock()
+}
+
+// rotate re-reads the named file and updates all added notifiers,
+// they're left intact when the file cannot be read.
+func (r *urlRotation) rotate(name string) error {
+	url, err := readURLFile(name)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.setters {
+		s.SetURL(url)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	t.Parallel()
+
+	entries, err := parseConfig(strings.NewReader(`---
+# watcher config
+slack-channel: alerts # inline comment
+slack-username: "systemd #1"
+interval: 30s
+include:
+  - nginx.service
+  - '*.timer'
+exclude: [a.service, "b.service"]
+unit: []
+webhook-url: https://hooks.slack.com/services/x#y
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []configEntry{
+		{key: "slack-channel", value: "alerts", line: 3},
+		{key: "slack-username", value: "systemd #1", line: 4},
+		{key: "interval", value: "30s", line: 5},
+		{key: "include", value: "nginx.service", line: 7},
+		{key: "include", value: "*.timer", line: 8},
+		{key: "exclude", value: "a.service", line: 9},
+		{key: "exclude", value: "b.service", line: 9},
+		{key: "webhook-url", value: "https://hooks.slack.com/services/x#y", line: 11},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("entries = %v, want %v", entries, want)
+	}
+
+	if entries, err = parseConfig(strings.NewReader("# empty\n")); err != nil || entries != nil {
+		t.Errorf("empty config = %v, %v, want no entries", entries, err)
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	t.Parallel()
+
+	for s, want := range map[string]string{
+		"interval":                 "line 1: want a mapping",
+		"- a\n- b":                 "line 1: want a mapping",
+		"a: 1\na: 2":               "line 2: duplicate key",
+		"a: 1\n  b: 2":             "line 2:",
+		"a:\n  b: 2":               "line 2: a must be a value",
+		"a:\n  - [b]":              "line 2: a list items",
+		"a: [1, 2":                 "line 1:",
+		"a: \"unterminated":        "unexpected end of stream",
+		"a: &x 1\nb: *x":           "line 2: b must be a value",
+		"a: 1\n\n# comment\nb:   ": "line 4: b has no value",
+		"a: 1\n---\nb: 2":          "multiple documents",
+	} {
+		_, err := parseConfig(strings.NewReader(s))
+		if err == nil {
+			t.Errorf("%q: expected an error", s)
+		} else if !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: error = %q, want %q", s, err, want)
+		}
+	}
+}
+
+func TestConfigChanged(t *testing.T) {
+	t.Parallel()
+
+	parse := func(s string) *config {
+		entries, err := parseConfig(strings.NewReader(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &config{name: "test.conf", entries: entries}
+	}
+	a := parse("interval: 10s\ninclude: [a, b]\nslack-channel: x\n")
+	b := parse("include:\n  - a\n  - c\nslack-channel: x\nwebhook-url: y\n")
+
+	if d, err := b.duration("interval", time.Minute); err != nil || d != time.Minute {
+		t.Errorf("missing interval = %s, %v, want the default", d, err)
+	}
+	if d, err := a.duration("interval", time.Minute); err != nil || d != 10*time.Second {
+		t.Errorf("interval = %s, %v, want 10s", d, err)
+	}
+	if _, err := parse("interval: 10").duration("interval", 0); err == nil ||
+		!strings.HasPrefix(err.Error(), "test.conf:1:") {
+		t.Errorf("err = %v, want it with the line number", err)
+	}
+	if got, want := a.changed(b), []string{"include", "interval", "webhook-url"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("changed = %v, want %v", got, want)
+	}
+	if b.url() != "y" || a.url() != "" {
+		t.Errorf("urls = %q, %q, want y and empty", b.url(), a.url())
+	}
+}
+
+func TestReadConfigErrors(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	for s, want := range map[string]string{
+		"webhook-url: a\nwebhook-url: b": "line 2: duplicate key",
+		"webhook-url: [a, b]":            ":1: webhook-url takes a single value",
+		"no-such-flag: 1":                ":1: unknown key",
+	} {
+		name := filepath.Join(dir, "test.conf")
+		if err := os.WriteFile(name, []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readConfig(name); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: err = %v, want %q", s, err, want)
+		}
+	}
+}
+
+// fakeSetter remembers the last url it's been given.
+type fakeSetter struct{ url string }
+
+func (s *fakeSetter) SetURL(url string) { s.url = url }
+
+func TestURLRotation(t *testing.T) {
+	t.Parallel()
+
+	name := filepath.Join(t.TempDir(), "url")
+	if err := os.WriteFile(name, []byte("  https://hooks.slack.com/a\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	url, err := readURLFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != "https://hooks.slack.com/a" {
+		t.Errorf("url = %q, want it without whitespace", url)
+	}
+
+	var r urlRotation
+	s := &fakeSetter{url: url}
+	r.add(s)
+	if err = os.WriteFile(name, []byte("https://hooks.slack.com/b"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.rotate(name); err != nil {
+		t.Fatal(err)
+	}
+	if s.url != "https://hooks.slack.com/b" {
+		t.Errorf("rotated url = %q, want the new one", s.url)
+	}
+
+	// a broken file doesn't replace the url
+	if err = os.WriteFile(name, []byte("\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.rotate(name); err == nil {
+		t.Error("expected an error on an empty url file")
+	}
+	if s.url != "https://hooks.slack.com/b" {
+		t.Errorf("url = %q after a failed rotation, want the previous one", s.url)
+	}
+}
@@ -0,0 +1,67 @@
+// Package httpclient configures http clients of the notifiers.
+package httpclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// Transport returns a copy of c with a copy of its transport,
+// so the transport can be changed without affecting c,
+// a nil transport is a copy of http.DefaultTransport.
+func Transport(c *http.Client) (*http.Client, *http.Transport, error) {
+	var t *http.Transport
+	switch rt := c.Transport.(type) {
+	case nil:
+		t = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		t = rt.Clone()
+	default:
+		return nil, nil, fmt.Errorf("cannot be set on %T transport", rt)
+	}
+	cc := *c
+	cc.Transport = t
+	return &cc, t, nil
+}
+
+// WithTLS returns a copy of c that presents the certificate to servers
+// requesting one and verifies servers with certificate authorities
+// from caFile instead of the system ones, the files are PEM-encoded,
+// empty ones are not used and c is returned as is when all of them are.
+//
+// The rest of c and its transport settings are kept.
+func WithTLS(c *http.Client, certFile, keyFile, caFile string) (*http.Client, error) {
+	if certFile == "" && keyFile == "" && caFile == "" {
+		return c, nil
+	}
+	c, t, err := Transport(c)
+	if err != nil {
+		return nil, fmt.Errorf("tls: %s", err)
+	}
+	cfg := &tls.Config{}
+	if t.TLSClientConfig != nil {
+		cfg = t.TLSClientConfig.Clone()
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("client cert: %s", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		b, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("root cas: %s", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("root cas: no certificates found in %s", caFile)
+		}
+	}
+	t.TLSClientConfig = cfg
+	return c, nil
+}
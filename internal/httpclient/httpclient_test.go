@@ -0,0 +1,151 @@
+package httpclient
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeClientCert writes a self-signed client certificate
+// and its key to the directory and returns their paths.
+func writeClientCert(t *testing.T, dir string) (string, string, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "systemd-slack"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	for name, b := range map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: der},
+		keyFile:  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err = ioutil.WriteFile(name, pem.EncodeToMemory(b), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return certFile, keyFile, cert
+}
+
+func TestWithTLS(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	certFile, keyFile, cert := writeClientCert(t, dir)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cert)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	ts.StartTLS()
+	defer ts.Close()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		certFile string
+		keyFile  string
+		caFile   string
+		ok       bool
+	}{
+		{"no files", "", "", "", false},
+		{"no cert", "", "", caFile, false},
+		{"cert", certFile, keyFile, caFile, true},
+	} {
+		c, err := WithTLS(http.DefaultClient, tc.certFile, tc.keyFile, tc.caFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := c.Get(ts.URL)
+		if err == nil {
+			res.Body.Close()
+		}
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: err = %v, want ok = %t", tc.name, err, tc.ok)
+		}
+	}
+
+	missing := filepath.Join(dir, "missing.pem")
+	for _, files := range [][3]string{
+		{missing, missing, ""},
+		{keyFile, certFile, ""},
+		{"", "", missing},
+		{"", "", keyFile},
+	} {
+		if _, err := WithTLS(http.DefaultClient, files[0], files[1], files[2]); err == nil {
+			t.Errorf("WithTLS(%q, %q, %q) expected an error", files[0], files[1], files[2])
+		}
+	}
+}
+
+func TestWithTLSKeepsClient(t *testing.T) {
+	t.Parallel()
+
+	if c, err := WithTLS(http.DefaultClient, "", "", ""); err != nil || c != http.DefaultClient {
+		t.Errorf("WithTLS without files = %p, %v, want the client as is", c, err)
+	}
+
+	certFile, keyFile, _ := writeClientCert(t, t.TempDir())
+	tr := &http.Transport{MaxIdleConns: 7, TLSClientConfig: &tls.Config{ServerName: "example"}}
+	c := &http.Client{Transport: tr, Timeout: time.Second}
+	cc, err := WithTLS(c, certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cc == c || c.Transport != tr || tr.TLSClientConfig.Certificates != nil {
+		t.Fatal("the original client is changed")
+	}
+	ct := cc.Transport.(*http.Transport)
+	if cc.Timeout != time.Second || ct.MaxIdleConns != 7 || ct.TLSClientConfig.ServerName != "example" {
+		t.Errorf("client settings are lost: timeout = %s, transport = %+v", cc.Timeout, ct)
+	}
+	if len(ct.TLSClientConfig.Certificates) != 1 {
+		t.Errorf("certificates = %d, want 1", len(ct.TLSClientConfig.Certificates))
+	}
+
+	rt := http.RoundTripper(roundTripper(nil))
+	if _, err = WithTLS(&http.Client{Transport: rt}, "", "", certFile); err == nil {
+		t.Error("expected an error on a custom transport")
+	}
+}
+
+type roundTripper func(*http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
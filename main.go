@@ -1,77 +1,1070 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
-	"github.com/amenzhinsky/consul-slack/slack"
+	"github.com/amenzhinsky/systemd-slack/mattermost"
+	"github.com/amenzhinsky/systemd-slack/metrics"
+	"github.com/amenzhinsky/systemd-slack/notifier"
+	"github.com/amenzhinsky/systemd-slack/slack"
 	"github.com/amenzhinsky/systemd-slack/systemd"
+	"github.com/amenzhinsky/systemd-slack/teams"
+	"github.com/amenzhinsky/systemd-slack/webhook"
 )
 
 var (
-	channelFlag  = "systemd-state"
-	usernameFlag = "systemd"
-	iconURLFlag  = "https://emoji.slack-edge.com/T043Q7UHW/garold/269d90c3a5ffe40f.png"
+	channelFlag    = "systemd-state"
+	usernameFlag   = "systemd"
+	iconURLFlag    = "https://emoji.slack-edge.com/T043Q7UHW/garold/269d90c3a5ffe40f.png"
+	maxBatchFlag   = 20
+	globalRateFlag = 0
+	retriesFlag    = 3
+	tokenFlag      = ""
+	editFlag       = false
+	dryRunFlag     = false
+	templateFlag   = ""
+	unitLinkFlag   = ""
+	proxyFlag      = ""
+	tlsCertFlag    = ""
+	tlsKeyFlag     = ""
+	tlsCAFlag      = ""
+	timeoutFlag    = 10 * time.Second
+	queueFlag      = 100
+	deliveryFlag   = false
+	maxPendingFlag = systemd.DefaultOutboxSize
+	pendingAgeFlag = systemd.DefaultOutboxAge
+	depsFlag       = false
 
 	stateFileFlag = systemd.DefaultStateFile
+	stateFmtFlag  = string(systemd.GobFormat)
+	compressFlag  = compressionFlag(systemd.GzipCompression)
+	inMemoryFlag  = false
 	intervalFlag  = systemd.DefaultInterval
+	maxIntFlag    = time.Duration(0)
+	subscribeFlag = false
+	userBusFlag   = false
+	busAddrFlag   = ""
+	retryFlag     = 3
+	includeFlag   stringsFlag
+	unitsFlag     stringsFlag
+	excludeFlag   stringsFlag
+	typesFlag     stringsFlag
+	subStatesFlag stringsFlag
+	failedFlag    = false
+	startupFlag   = false
+	journalFlag   = 0
+	metricsFlag   = ""
+	healthFlag    = ""
+	statusFlag    = ""
+	healthMaxFlag = time.Duration(0)
+	logLevelFlag  = "info"
+	debounceFlag  = time.Duration(0)
+	graceFlag     = time.Duration(0)
+	flapsFlag     = 0
+	flapWinFlag   = 5 * time.Minute
+	rateFlag      = time.Duration(0)
+	dedupFlag     = time.Duration(0)
+	routeFlag     stringsFlag
+	unitRouteFlag stringsFlag
+	configFlag    = ""
+	urlFileFlag   = ""
+	restartsFlag  = false
+	usageFlag     = false
+	jitterFlag    = systemd.DefaultIntervalJitter
+	extendedFlag  = false
+	collapseFlag  = false
+	crossFlag     = false
+	maxUnitsFlag  = 0
+	propsFlag     stringsFlag
+	bootstrapFlag = false
+	testFlag      = false
+	onceFlag      = false
+	listFlag      = false
+	jsonFlag      = false
+	unhealthyFlag = "failed"
+	quietRuleFlag stringsFlag
+	notifierFlag  stringsFlag
+	headersFlag   stringsFlag
+	mmChannelFlag = ""
+	outputFlag    = ""
+	mmUserFlag    = ""
+	quietFlag     = ""
+	quietTZFlag   = ""
+	digestFlag    = time.Duration(0)
 )
 
 func main() {
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "usage: %s SLACK_WEEBHOOK_URL\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "usage: %s [-config FILE] [-slack-token TOKEN] [SLACK_WEEBHOOK_URL]\n\n"+
+			"The webhook url or the token can be also set with SLACK_WEBHOOK_URL or SLACK_TOKEN\n"+
+			"environment variables that take precedence over the config file but not over\n"+
+			"the command line, to keep them out of process listings and shell history.\n"+
+			"With -webhook-url-file the url is read from the file and re-read on SIGHUP.\n\n"+
+			"With other notifiers changes are posted to their webhook url instead.\n\n"+
+			"With -once the exit status is 0 when no tracked units are unhealthy,\n"+
+			"1 when at least one is and 2 on errors, otherwise it's 1 on errors.\n\n", os.Args[0])
 		flag.PrintDefaults()
 	}
 
+	flag.StringVar(&configFlag, "config", configFlag, "YAML config `file`, keys are flag names and webhook-url, repeatable flags take lists, flags take precedence")
+	flag.StringVar(&urlFileFlag, "webhook-url-file", urlFileFlag, "read the webhook url from the `file`, e.g. a mounted secret, instead of the argument, it's re-read on SIGHUP")
+	flag.Var(&notifierFlag, "notifier", "`kind[=url]` where changes are posted: slack (default), mattermost, teams, webhook that is a generic json\n"+
+		"endpoint or stdout that prints json lines, the url defaults to SLACK_WEEBHOOK_URL (repeatable)")
+	flag.StringVar(&outputFlag, "output", outputFlag, "`file` the stdout notifier appends json lines to instead of stdout")
+	flag.StringVar(&mmChannelFlag, "mattermost-channel", mmChannelFlag, "mattermost channel url `name`, the webhook default is used when empty")
+	flag.StringVar(&mmUserFlag, "mattermost-username", mmUserFlag, "mattermost username, overrides have to be enabled on the server")
+	flag.Var(&headersFlag, "webhook-header", "add the `key:value` header to webhook requests (repeatable)")
 	flag.StringVar(&channelFlag, "slack-channel", channelFlag, "slack channel name")
 	flag.StringVar(&usernameFlag, "slack-username", usernameFlag, "slack username")
 	flag.StringVar(&iconURLFlag, "slack-icon-url", iconURLFlag, "slack avatar url")
+	flag.IntVar(&maxBatchFlag, "slack-max-batch", maxBatchFlag, "maximum number of changes in a single message")
+	flag.IntVar(&globalRateFlag, "slack-rate-limit", globalRateFlag, "maximum number of slack requests per minute, excess messages are delayed, 0 disables it")
+	flag.IntVar(&retriesFlag, "slack-retries", retriesFlag, "maximum number of attempts to post a message")
+	flag.StringVar(&tokenFlag, "slack-token", tokenFlag, "slack web api token used instead of the webhook url")
+	flag.BoolVar(&editFlag, "slack-edit-recovery", editFlag, "strike through failure messages when units recover instead of replying, requires -slack-token")
+	flag.Var(&routeFlag, "slack-route", "post changes of the kind to the channel, `kind=channel`, kind is a change kind or failed (repeatable)")
+	flag.Var(&unitRouteFlag, "slack-unit-route", "post changes of units matching the glob to the channel, `pattern=channel`,\n"+
+		"the first matching pattern wins and takes precedence over -slack-route (repeatable)")
+	flag.StringVar(&templateFlag, "template", templateFlag, "message text `template`, it's executed with systemd.Change")
+	flag.StringVar(&unitLinkFlag, "slack-unit-link", unitLinkFlag, "dashboard url `template` linked in messages, it's executed with systemd.Change, query escapes urls")
+	flag.BoolVar(&testFlag, "test", testFlag, "post a connectivity test message and exit")
+	flag.BoolVar(&listFlag, "list-units", listFlag, "print watched units with their states and exit, filters apply")
+	flag.BoolVar(&jsonFlag, "json", jsonFlag, "print -list-units output as json")
+	flag.BoolVar(&onceFlag, "once", onceFlag, "poll once, post changes and exit with 1 when any units are unhealthy")
+	flag.StringVar(&unhealthyFlag, "unhealthy-states", unhealthyFlag, "comma-separated active or sub `states` of unhealthy units in -once mode")
+	flag.StringVar(&proxyFlag, "slack-proxy", proxyFlag, "http proxy url for slack requests, HTTPS_PROXY is used by default")
+	flag.StringVar(&tlsCertFlag, "tls-cert", tlsCertFlag, "PEM client certificate `file` for notifier requests, requires -tls-key")
+	flag.StringVar(&tlsKeyFlag, "tls-key", tlsKeyFlag, "PEM client key `file` of -tls-cert")
+	flag.StringVar(&tlsCAFlag, "tls-ca", tlsCAFlag, "PEM `file` of CAs verifying notifier servers instead of the system ones")
+	flag.DurationVar(&timeoutFlag, "slack-timeout", timeoutFlag, "timeout of every slack request, 0 disables it")
+	flag.IntVar(&queueFlag, "queue-size", queueFlag, "number of change batches waiting to be posted, 0 posts them synchronously")
+	flag.BoolVar(&deliveryFlag, "delivery-tracking", deliveryFlag, "keep unsent changes in STATE_FILE.pending and resend them after a restart")
+	flag.IntVar(&maxPendingFlag, "delivery-max-pending", maxPendingFlag, "keep at most the `number` of unsent changes dropping the oldest ones, 0 is unlimited")
+	flag.DurationVar(&pendingAgeFlag, "delivery-max-age", pendingAgeFlag, "drop unsent changes older than the `duration`, 0 keeps them forever")
+	flag.BoolVar(&dryRunFlag, "dry-run", dryRunFlag, "log slack messages instead of sending them")
 	flag.StringVar(&stateFileFlag, "state-file", stateFileFlag, "path to the state file")
+	flag.StringVar(&stateFmtFlag, "state-format", stateFmtFlag, "state file format, gob or json")
+	flag.Var(&compressFlag, "state-compress", "state file compression: gzip, zstd or none, true is gzip and false is none, defaults to gzip only for the gob format")
+	flag.IntVar(&maxUnitsFlag, "state-max-units", maxUnitsFlag, "keep at most the `number` of units in the state evicting transient and least recently changed ones first, 0 is unlimited")
+	flag.BoolVar(&inMemoryFlag, "in-memory", inMemoryFlag, "keep the state only in memory, the state file is not used")
 	flag.DurationVar(&intervalFlag, "interval", intervalFlag, "status polling interval")
+	flag.DurationVar(&maxIntFlag, "max-interval", maxIntFlag, "double the interval up to the `duration` while nothing changes, 0 disables it")
+	flag.Float64Var(&jitterFlag, "interval-jitter", jitterFlag, "randomize the polling interval by up to the `fraction` of it")
+	flag.IntVar(&retryFlag, "list-retries", retryFlag, "number of retries of transient dbus errors")
+	flag.BoolVar(&userBusFlag, "user", userBusFlag, "watch user units on the session bus instead of the system ones")
+	flag.StringVar(&busAddrFlag, "dbus-address", busAddrFlag, "connect to the dbus `address` instead of the system bus, e.g. a container's one")
+	flag.BoolVar(&subscribeFlag, "subscribe", subscribeFlag, "use dbus signals instead of polling")
+	flag.Var(&unitsFlag, "unit", "watch only the `name`d unit, cheaper than -include for a few units (repeatable)")
+	flag.Var(&includeFlag, "include", "watch only units matching the glob `pattern` (repeatable)")
+	flag.Var(&excludeFlag, "exclude", "ignore units matching the glob `pattern` (repeatable)")
+	flag.Var(&typesFlag, "unit-type", "watch only units of the `type`, e.g. service or timer (repeatable)")
+	flag.BoolVar(&bootstrapFlag, "bootstrap", bootstrapFlag, "force the first poll to be silent or not, by default it is only without a state file")
+	flag.BoolVar(&startupFlag, "startup-report", startupFlag, "report already failed units when started without a state file")
+	flag.IntVar(&journalFlag, "journal-lines", journalFlag, "number of journal lines attached to failure notifications")
+	flag.StringVar(&metricsFlag, "metrics-addr", metricsFlag, "serve prometheus metrics on the `address` at /metrics")
+	flag.StringVar(&statusFlag, "status-addr", statusFlag, "serve a status page of tracked units on the `address` at /status")
+	flag.StringVar(&healthFlag, "health-addr", healthFlag, "serve liveness checks on the `address` at /healthz")
+	flag.DurationVar(&healthMaxFlag, "health-threshold", healthMaxFlag, "maximum age of the last successful poll, defaults to three maximum intervals")
+	flag.StringVar(&logLevelFlag, "log-level", logLevelFlag, "minimal log `level`, debug, info, warn or error")
+	flag.DurationVar(&debounceFlag, "debounce", debounceFlag, "report changes only after units stay in the same state for the `duration`")
+	flag.DurationVar(&graceFlag, "failure-grace", graceFlag, "report failures only after units stay failed for the `duration`")
+	flag.IntVar(&flapsFlag, "flap-threshold", flapsFlag, "report units changing state at least the number of times in the flap window as flapping")
+	flag.DurationVar(&flapWinFlag, "flap-window", flapWinFlag, "sliding window of the flap detection")
+	flag.DurationVar(&rateFlag, "unit-rate-limit", rateFlag, "report at most one change of a unit per the `interval`")
+	flag.DurationVar(&dedupFlag, "dedup", dedupFlag, "drop changes identical to one reported within the `duration`")
+	flag.StringVar(&quietFlag, "quiet-hours", quietFlag, "defer non-critical changes during the `windows`, e.g. 22:00-07:00,12:00-13:00")
+	flag.StringVar(&quietTZFlag, "quiet-tz", quietTZFlag, "time `zone` of quiet hours, defaults to the local one")
+	flag.DurationVar(&digestFlag, "digest", digestFlag, "post a summary of changes suppressed by filters every `interval`")
+	flag.Var(&quietRuleFlag, "quiet-transition", "don't report the expected transition, `pattern:from->to`, e.g. *.service:active/exited->inactive/dead,\n"+
+		"states are active or active/sub ones, defaults to transitions of timers, sockets and oneshots, none disables them (repeatable)")
+	flag.BoolVar(&restartsFlag, "restarts", restartsFlag, "report automatic service restarts, costs an extra dbus call per service")
+	flag.BoolVar(&usageFlag, "resource-usage", usageFlag, "attach memory and cpu usage to changes, costs extra dbus calls per unit")
+	flag.BoolVar(&depsFlag, "dependencies", depsFlag, "mention failed dependencies of failed units, costs extra dbus calls per failure")
+	flag.BoolVar(&extendedFlag, "extended-equality", extendedFlag, "compare all unit fields including jobs and description, not only states")
+	flag.BoolVar(&crossFlag, "cross-check-failed", crossFlag, "cross-check units against the failed units list of systemd to match systemctl --failed")
+	flag.BoolVar(&collapseFlag, "collapse", collapseFlag, "report units listed several times within a poll once with their net change")
+	flag.Var(&propsFlag, "property", "report changes of the unit `property`, e.g. FragmentPath or DropInPaths, costs a dbus call per unit on every poll (repeatable)")
+	flag.BoolVar(&failedFlag, "failed-only", failedFlag, "report only units entering or leaving the failed state")
+	flag.Var(&subStatesFlag, "sub-state", "always report units entering the sub `state`, e.g. auto-restart, regardless of -failed-only and -quiet-transition (repeatable)")
 	flag.Parse()
 
-	if flag.NArg() != 1 {
+	var fileURL, fileToken string
+	if configFlag != "" {
+		var err error
+		if fileConfig, err = readConfig(configFlag); err == nil {
+			err = fileConfig.apply()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			os.Exit(errorCode())
+		}
+		fileURL = fileConfig.url()
+		if !isFlagSet("slack-token") {
+			fileToken = tokenFlag
+		}
+	}
+
+	if listFlag {
+		if err := listUnits(os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// slack credentials are taken from the first source that has any:
+	// the command line or the url file, SLACK_WEBHOOK_URL and SLACK_TOKEN
+	// environment variables and finally the config file
+	webhookURL := flag.Arg(0)
+	if urlFileFlag != "" && webhookURL == "" {
+		var err error
+		if webhookURL, err = readURLFile(urlFileFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			os.Exit(errorCode())
+		}
+	}
+	if !isFlagSet("slack-token") {
+		tokenFlag = ""
+	}
+	if webhookURL == "" && tokenFlag == "" {
+		webhookURL, tokenFlag = os.Getenv("SLACK_WEBHOOK_URL"), os.Getenv("SLACK_TOKEN")
+	}
+	if webhookURL == "" && tokenFlag == "" {
+		webhookURL, tokenFlag = fileURL, fileToken
+	}
+
+	specs, err := parseNotifiers(notifierFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(errorCode())
+	}
+	var needURL bool
+	for _, spec := range specs {
+		if spec.url != "" || spec.kind == "stdout" {
+			continue
+		}
+		if spec.kind != "slack" && tokenFlag != "" {
+			fmt.Fprintf(os.Stderr, "error: the %s notifier doesn't support -slack-token\n", spec.kind)
+			os.Exit(errorCode())
+		}
+		needURL = true
+	}
+	if flag.NArg() > 1 || (tokenFlag != "" && webhookURL != "") ||
+		(urlFileFlag != "" && flag.NArg() != 0) ||
+		(needURL && tokenFlag == "" && webhookURL == "") {
 		flag.Usage()
-		os.Exit(1)
+		os.Exit(errorCode())
+	}
+
+	if testFlag {
+		if len(specs) != 1 || specs[0].kind != "slack" {
+			fmt.Fprintln(os.Stderr, "error: -test supports only a single slack notifier")
+			os.Exit(errorCode())
+		}
+		if err := testSlack(webhookURL); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			os.Exit(errorCode())
+		}
+		return
 	}
 
-	if err := start(); err != nil {
+	if err := start(webhookURL, specs); err != nil {
+		var uerr *unhealthyError
+		if errors.As(err, &uerr) {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 		fmt.Fprintf(os.Stderr, "error: %s\n", err)
-		os.Exit(1)
+		os.Exit(errorCode())
+	}
+}
+
+// errorCode is the exit status on errors, in -once mode
+// 1 means that there're unhealthy units instead.
+func errorCode() int {
+	if onceFlag {
+		return 2
 	}
+	return 1
 }
 
 // start ensures that all defers are executed before the process exits.
-func start() error {
-	s, err := slack.New(flag.Arg(0),
-		slack.WithChannel(channelFlag),
-		slack.WithUsername(usernameFlag),
-		slack.WithIconURL(iconURLFlag),
-	)
-	if err != nil {
+func start(webhookURL string, specs []notifierSpec) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handleSignals(cancel)
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(logLevelFlag)); err != nil {
 		return err
 	}
+	// keep stdout clean for json lines
+	logOut := os.Stdout
+	for _, spec := range specs {
+		if spec.kind == "stdout" && outputFlag == "" {
+			logOut = os.Stderr
+		}
+	}
+	h := slog.NewTextHandler(logOut, &slog.HandlerOptions{Level: level})
 
-	_ = s // TODO: use it
+	// nil metrics are valid and simply discard all values
+	var m *metrics.Metrics
+	if metricsFlag != "" {
+		m = metrics.New()
+	}
 
-	sd, err := systemd.New(
+	opts := []systemd.Option{
+		systemd.WithSlogger(slog.New(h).With("component", "systemd")),
+		systemd.WithMetrics(m),
 		systemd.WithStateFile(stateFileFlag),
+		systemd.WithStateFormat(systemd.StateFormat(stateFmtFlag)),
 		systemd.WithInterval(intervalFlag),
-	)
+		systemd.WithAdaptiveInterval(maxIntFlag),
+		systemd.WithIntervalJitter(jitterFlag),
+		systemd.WithListUnitsRetry(retryFlag),
+		systemd.WithJournalTail(journalFlag),
+		systemd.WithDebounce(debounceFlag),
+		systemd.WithFailureGracePeriod(graceFlag),
+		systemd.WithFlapDetection(flapsFlag, flapWinFlag),
+		systemd.WithPerUnitRateLimit(rateFlag),
+		systemd.WithDedup(dedupFlag),
+		systemd.WithUnits(unitsFlag...),
+		systemd.WithInclude(includeFlag...),
+		systemd.WithExclude(excludeFlag...),
+		systemd.WithUnitTypes(typesFlag...),
+	}
+	// the digest needs notifiers that are created after the watcher,
+	// it's set before the first poll, so the hook never sees nil
+	var digest *notifier.Digest
+	if digestFlag > 0 {
+		opts = append(opts, systemd.WithSuppressionHook(func(c systemd.Change, reason string) {
+			digest.Add(c, reason)
+		}))
+	}
+	rules := systemd.DefaultQuietRules
+	if len(quietRuleFlag) != 0 {
+		rules = nil
+		for _, s := range quietRuleFlag {
+			if s == "none" {
+				continue
+			}
+			r, err := systemd.ParseQuietRule(s)
+			if err != nil {
+				return err
+			}
+			rules = append(rules, r)
+		}
+	}
+	opts = append(opts, systemd.WithQuietRules(rules...))
+	if isFlagSet("state-compress") {
+		opts = append(opts, systemd.WithCompression(systemd.Compression(compressFlag)))
+	}
+	if isFlagSet("bootstrap") {
+		opts = append(opts, systemd.WithBootstrap(bootstrapFlag))
+	}
+	if inMemoryFlag {
+		opts = append(opts, systemd.WithInMemoryState())
+	}
+	if userBusFlag {
+		opts = append(opts, systemd.WithUserBus())
+	}
+	if busAddrFlag != "" {
+		opts = append(opts, systemd.WithDBusAddress(busAddrFlag))
+	}
+	if subscribeFlag {
+		opts = append(opts, systemd.WithSubscription())
+	}
+	if failedFlag {
+		opts = append(opts, systemd.WithFailedOnly())
+	}
+	if len(subStatesFlag) != 0 {
+		opts = append(opts, systemd.WithSubStates(subStatesFlag...))
+	}
+	if startupFlag {
+		opts = append(opts, systemd.WithStartupReport())
+	}
+	if restartsFlag {
+		opts = append(opts, systemd.WithRestarts())
+	}
+	if len(propsFlag) != 0 {
+		opts = append(opts, systemd.WithProperties(propsFlag...))
+	}
+	if extendedFlag {
+		opts = append(opts, systemd.WithExtendedEquality())
+	}
+	if collapseFlag {
+		opts = append(opts, systemd.WithCollapse())
+	}
+	if crossFlag {
+		opts = append(opts, systemd.WithFailedCrossCheck())
+	}
+	if maxUnitsFlag != 0 {
+		opts = append(opts, systemd.WithMaxUnits(maxUnitsFlag))
+	}
+	if usageFlag {
+		opts = append(opts, systemd.WithResourceUsage())
+	}
+	if deliveryFlag {
+		opts = append(opts, systemd.WithDeliveryTracking(),
+			systemd.WithOutboxLimits(maxPendingFlag, pendingAgeFlag))
+	}
+	if depsFlag {
+		opts = append(opts, systemd.WithDependencies())
+	}
+
+	sd, err := systemd.New(ctx, opts...)
 	if err != nil {
 		return err
 	}
-	defer sd.Close()
+	defer func() {
+		if err := sd.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "close error: %s\n", err)
+		}
+	}()
+
+	// SIGHUP is handled by the main loop, so reloads don't race with it
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	// endpoints with the same address share a listener
+	muxes := map[string]*http.ServeMux{}
+	handle := func(addr, pattern string, h http.Handler) {
+		if muxes[addr] == nil {
+			muxes[addr] = http.NewServeMux()
+		}
+		muxes[addr].Handle(pattern, h)
+	}
+	if metricsFlag != "" {
+		handle(metricsFlag, "/metrics", m)
+	}
+	if healthFlag != "" {
+		threshold := healthMaxFlag
+		if threshold == 0 {
+			threshold = 3 * intervalFlag
+			if maxIntFlag > intervalFlag {
+				threshold = 3 * maxIntFlag
+			}
+		}
+		handle(healthFlag, "/healthz", healthz(sd, threshold))
+	}
+	if statusFlag != "" {
+		handle(statusFlag, "/status", status(sd))
+	}
+	for addr, mux := range muxes {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+		go http.Serve(l, mux)
+	}
+
+	newLogger := func(component string) *log.Logger {
+		return slog.NewLogLogger(h.WithAttrs([]slog.Attr{
+			slog.String("component", component),
+		}), slog.LevelInfo)
+	}
+
+	// changes are acknowledged only when all notifiers succeed
+	var n notifier.Notifier
+	if len(specs) == 1 {
+		if n, err = newNotifier(specs[0], webhookURL, sd, sd, m, newLogger(specs[0].kind)); err != nil {
+			return err
+		}
+		rotates(specs[0], n)
+	} else {
+		ns := make([]notifier.Notifier, 0, len(specs))
+		for _, spec := range specs {
+			sub, err := newNotifier(spec, webhookURL, sd, nil, m, newLogger(spec.kind))
+			if err != nil {
+				return err
+			}
+			rotates(spec, sub)
+			ns = append(ns, sub)
+		}
+		n = notifier.NewMulti(sd, ns...)
+	}
+	logger := newLogger("notifier")
+
+	if digestFlag > 0 {
+		ms, ok := n.(notifier.Messenger)
+		if !ok {
+			return errors.New("digest is not supported by the notifier")
+		}
+		digest = notifier.NewDigest(ms, digestFlag, 20, logger)
+		defer digest.Close()
+	}
+
+	if quietFlag != "" {
+		var loc *time.Location
+		if quietTZFlag != "" {
+			if loc, err = time.LoadLocation(quietTZFlag); err != nil {
+				return err
+			}
+		}
+		sched, err := notifier.ParseSchedule(quietFlag, loc)
+		if err != nil {
+			return err
+		}
+		quiet := notifier.NewQuiet(n, sched, logger)
+		defer quiet.Stop()
+		n = quiet
+	}
+
+	if onceFlag {
+		return once(ctx, sd, n)
+	}
+
+	var q *notifier.Queue
+	if queueFlag > 0 {
+		q = notifier.NewQueue(ctx, n, sd, queueFlag, logger)
+		defer q.Close()
+	}
 
 	for {
-		changes, err := sd.Next()
+		changes, err := next(ctx, sd, hup)
 		if err != nil {
+			// the state is flushed right after every poll, so
+			// there's nothing to store when the loop is interrupted
+			if ctx.Err() != nil {
+				return nil
+			}
 			return err
 		}
+		if q != nil {
+			q.Push(changes)
+			continue
+		}
+
+		// notification errors are not fatal, next changes may be delivered
+		if err = n.Notify(ctx, changes); err != nil {
+			fmt.Fprintf(os.Stderr, "notify error: %s\n", err)
+		}
+	}
+}
+
+// unhealthyError is returned by once when some units are unhealthy.
+type unhealthyError struct {
+	units []string
+}
+
+func (e *unhealthyError) Error() string {
+	return fmt.Sprintf("%d units are unhealthy: %s", len(e.units), strings.Join(e.units, ", "))
+}
+
+// unhealthy returns names of units in any of the active or sub states.
+func unhealthy(units []systemd.Unit, states []string) []string {
+	var names []string
+	for _, u := range units {
+		for _, s := range states {
+			if u.ActiveState == s || u.SubState == s {
+				names = append(names, u.Name)
+				break
+			}
+		}
+	}
+	return names
+}
+
+// once polls units a single time and posts the changes synchronously,
+// it fails when the changes cannot be posted or any units are unhealthy.
+func once(ctx context.Context, sd *systemd.Systemd, n notifier.Notifier) error {
+	changes, err := sd.Poll(ctx)
+	if err != nil {
+		return err
+	}
+	if len(changes) != 0 {
+		if err = n.Notify(ctx, changes); err != nil {
+			return err
+		}
+	}
+
+	var states []string
+	for _, s := range strings.Split(unhealthyFlag, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			states = append(states, s)
+		}
+	}
+	if names := unhealthy(sd.Snapshot(), states); len(names) != 0 {
+		return &unhealthyError{units: names}
+	}
+	return nil
+}
+
+// notifierSpec is a parsed -notifier flag value.
+type notifierSpec struct {
+	kind string
+	url  string
+}
 
-		for _, c := range changes {
-			fmt.Printf("--> %#v\n", c)
+// parseNotifiers parses kind[=url] values, slack is the default.
+func parseNotifiers(values []string) ([]notifierSpec, error) {
+	if len(values) == 0 {
+		return []notifierSpec{{kind: "slack"}}, nil
+	}
+	specs := make([]notifierSpec, 0, len(values))
+	for _, v := range values {
+		var spec notifierSpec
+		if i := strings.IndexByte(v, '='); i >= 0 {
+			spec.kind, spec.url = v[:i], v[i+1:]
+		} else {
+			spec.kind = v
 		}
+		switch spec.kind {
+		case "slack", "mattermost", "teams", "webhook", "stdout":
+		default:
+			return nil, fmt.Errorf("unknown notifier %q", spec.kind)
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// newNotifier creates the notifier described by spec, url is used
+// when spec doesn't have one and a is notified about delivered changes.
+func newNotifier(
+	spec notifierSpec,
+	url string,
+	sd *systemd.Systemd,
+	a notifier.Acknowledger,
+	m *metrics.Metrics,
+	l *log.Logger,
+) (notifier.Notifier, error) {
+	if spec.url != "" {
+		url = spec.url
+	}
+	switch spec.kind {
+	case "stdout":
+		if outputFlag == "" {
+			return notifier.NewJSONLines(os.Stdout, a), nil
+		}
+		// the file is kept open for the process lifetime
+		f, err := os.OpenFile(outputFlag, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		return notifier.NewJSONLines(f, a), nil
+	case "mattermost":
+		opts := []mattermost.Option{
+			mattermost.WithLogger(l),
+			mattermost.WithChannel(mmChannelFlag),
+			mattermost.WithUsername(mmUserFlag),
+			mattermost.WithHTTPTimeout(timeoutFlag),
+			mattermost.WithAcknowledger(a),
+		}
+		if tlsCertFlag != "" || tlsKeyFlag != "" {
+			opts = append(opts, mattermost.WithClientCert(tlsCertFlag, tlsKeyFlag))
+		}
+		if tlsCAFlag != "" {
+			opts = append(opts, mattermost.WithRootCAs(tlsCAFlag))
+		}
+		mm, err := mattermost.New(url, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return mm, nil
+	case "teams":
+		opts := []teams.Option{
+			teams.WithLogger(l),
+			teams.WithHTTPTimeout(timeoutFlag),
+			teams.WithAcknowledger(a),
+		}
+		if tlsCertFlag != "" || tlsKeyFlag != "" {
+			opts = append(opts, teams.WithClientCert(tlsCertFlag, tlsKeyFlag))
+		}
+		if tlsCAFlag != "" {
+			opts = append(opts, teams.WithRootCAs(tlsCAFlag))
+		}
+		t, err := teams.New(url, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return t, nil
+	case "webhook":
+		opts := []webhook.Option{
+			webhook.WithLogger(l),
+			webhook.WithHTTPTimeout(timeoutFlag),
+			webhook.WithAcknowledger(a),
+		}
+		for _, h := range headersFlag {
+			i := strings.IndexByte(h, ':')
+			if i <= 0 {
+				return nil, fmt.Errorf("malformed header %q, want key:value", h)
+			}
+			opts = append(opts, webhook.WithHeader(h[:i], strings.TrimSpace(h[i+1:])))
+		}
+		if tlsCertFlag != "" || tlsKeyFlag != "" {
+			opts = append(opts, webhook.WithClientCert(tlsCertFlag, tlsKeyFlag))
+		}
+		if tlsCAFlag != "" {
+			opts = append(opts, webhook.WithRootCAs(tlsCAFlag))
+		}
+		w, err := webhook.New(url, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return w, nil
+	}
+
+	s, err := newSlack(url,
+		slack.WithLogger(l),
+		slack.WithMaxBatch(maxBatchFlag),
+		slack.WithGlobalRateLimit(globalRateFlag),
+		slack.WithAnnotator(sd),
+		slack.WithAcknowledger(a),
+		slack.WithMetrics(m),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// newSlack creates a slack client configured with the command line flags.
+func newSlack(webhookURL string, opts ...slack.Option) (*slack.Slack, error) {
+	opts = append([]slack.Option{
+		slack.WithChannel(channelFlag),
+		slack.WithUsername(usernameFlag),
+		slack.WithIconURL(iconURLFlag),
+		slack.WithRetry(retriesFlag, 500*time.Millisecond),
+		slack.WithHTTPTimeout(timeoutFlag),
+	}, opts...)
+	// unit owners are more specific than change kinds
+	var routers []func(c *systemd.Change) string
+	var channels []string // routed channels resolved with the token
+	if len(unitRouteFlag) != 0 {
+		routes := make([]slack.UnitRoute, 0, len(unitRouteFlag))
+		for _, r := range unitRouteFlag {
+			i := strings.IndexByte(r, '=')
+			if i <= 0 || i == len(r)-1 {
+				return nil, fmt.Errorf("malformed unit route %q, want pattern=channel", r)
+			}
+			if _, err := filepath.Match(r[:i], ""); err != nil {
+				return nil, fmt.Errorf("malformed unit route pattern %q: %s", r[:i], err)
+			}
+			routes = append(routes, slack.UnitRoute{Pattern: r[:i], Channel: r[i+1:]})
+			channels = append(channels, r[i+1:])
+		}
+		routers = append(routers, slack.RouteByUnit(routes))
+	}
+	if len(routeFlag) != 0 {
+		m := make(map[string]string, len(routeFlag))
+		for _, r := range routeFlag {
+			i := strings.IndexByte(r, '=')
+			if i <= 0 || i == len(r)-1 {
+				return nil, fmt.Errorf("malformed route %q, want kind=channel", r)
+			}
+			m[r[:i]] = r[i+1:]
+			channels = append(channels, r[i+1:])
+		}
+		routers = append(routers, slack.RouteByKind(m))
+	}
+	if len(routers) != 0 {
+		opts = append(opts, slack.WithRouter(slack.FirstRoute(routers...)))
+	}
+	if templateFlag != "" {
+		opts = append(opts, slack.WithTemplate(templateFlag))
+	}
+	if unitLinkFlag != "" {
+		opts = append(opts, slack.WithUnitLink(unitLinkFlag))
+	}
+	if dryRunFlag {
+		opts = append(opts, slack.WithDryRun())
+	}
+	if editFlag {
+		opts = append(opts, slack.WithEditOnRecovery())
+	}
+	if tlsCertFlag != "" || tlsKeyFlag != "" {
+		opts = append(opts, slack.WithClientCert(tlsCertFlag, tlsKeyFlag))
+	}
+	if tlsCAFlag != "" {
+		opts = append(opts, slack.WithRootCAs(tlsCAFlag))
+	}
+	if proxyFlag != "" {
+		opts = append(opts, slack.WithProxy(proxyFlag))
+	}
+
+	if tokenFlag != "" {
+		s, err := slack.NewWithToken(tokenFlag, opts...)
+		if err != nil {
+			return nil, err
+		}
+		if err = s.ResolveChannels(context.Background(), channels...); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	return slack.New(webhookURL, opts...)
+}
+
+// listUnits prints units passing the filters as a table or json lines.
+func listUnits(w io.Writer) error {
+	opts := []systemd.Option{
+		systemd.WithUnits(unitsFlag...),
+		systemd.WithInclude(includeFlag...),
+		systemd.WithExclude(excludeFlag...),
+		systemd.WithUnitTypes(typesFlag...),
+	}
+	if userBusFlag {
+		opts = append(opts, systemd.WithUserBus())
+	}
+	if busAddrFlag != "" {
+		opts = append(opts, systemd.WithDBusAddress(busAddrFlag))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	units, err := systemd.ListUnits(ctx, opts...)
+	if err != nil {
+		return err
+	}
+
+	if jsonFlag {
+		type unit struct {
+			Name        string `json:"name"`
+			LoadState   string `json:"load_state"`
+			ActiveState string `json:"active_state"`
+			SubState    string `json:"sub_state"`
+			Description string `json:"description"`
+		}
+		enc := json.NewEncoder(w)
+		for _, u := range units {
+			if err = enc.Encode(unit{u.Name, u.LoadState, u.ActiveState, u.SubState, u.Description}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "UNIT\tLOAD\tACTIVE\tSUB\tDESCRIPTION")
+	for _, u := range units {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", u.Name, u.LoadState, u.ActiveState, u.SubState, u.Description)
+	}
+	return tw.Flush()
+}
+
+// testSlack posts a connectivity test message without touching
+// dbus and the state file.
+func testSlack(webhookURL string) error {
+	s, err := newSlack(webhookURL, slack.WithLogger(nil))
+	if err != nil {
+		return err
+	}
+	if err = s.Test(context.Background()); err != nil {
+		return err
+	}
+	fmt.Printf("connectivity test message is posted to %s\n", channelFlag)
+	return nil
+}
+
+// handleSignals calls cancel on the first SIGINT or SIGTERM
+// and terminates the process immediately on the second one.
+func handleSignals(cancel context.CancelFunc) {
+	sigc := make(chan os.Signal, 2)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigc
+		fmt.Fprintf(os.Stderr, "received %s, shutting down\n", sig)
+		cancel()
+
+		<-sigc
+		fmt.Fprintln(os.Stderr, "forced exit")
+		os.Exit(1)
+	}()
+}
+
+// healthz responds with 200 when the last successful poll
+// happened no longer than threshold ago and with 503 otherwise.
+func healthz(sd *systemd.Systemd, threshold time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		last := sd.LastPoll()
+		switch {
+		case last.IsZero():
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, "no successful polls yet")
+			return
+		case time.Since(last) > threshold:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "last successful poll at %s\n", last.Format(time.RFC3339))
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+// rotation updates notifiers using the url from -webhook-url-file.
+var rotation urlRotation
+
+// rotates adds n to the url rotation when it uses the webhook url file.
+func rotates(spec notifierSpec, n notifier.Notifier) {
+	if urlFileFlag == "" || spec.url != "" {
+		return
+	}
+	if s, ok := n.(urlSetter); ok {
+		rotation.add(s)
+	}
+}
+
+// next waits for changes of sd, on SIGHUP meanwhile it reloads
+// the config file and the webhook url file on the calling goroutine.
+func next(ctx context.Context, sd *systemd.Systemd, hup <-chan os.Signal) ([]systemd.Change, error) {
+	type result struct {
+		changes []systemd.Change
+		err     error
+	}
+	resc := make(chan result, 1)
+	go func() {
+		changes, err := sd.Next(ctx)
+		resc <- result{changes, err}
+	}()
+	for {
+		select {
+		case r := <-resc:
+			return r.changes, r.err
+		case <-hup:
+			if configFlag != "" || urlFileFlag == "" {
+				if err := reload(sd); err != nil {
+					fmt.Fprintf(os.Stderr, "reload error: %s\n", err)
+				}
+			}
+			if urlFileFlag != "" {
+				if err := rotation.rotate(urlFileFlag); err != nil {
+					fmt.Fprintf(os.Stderr, "reload error: %s\n", err)
+				}
+			}
+		}
+	}
+}
+
+// fileConfig is the config file loaded on startup.
+var fileConfig *config
+
+// reloadable are config keys that are applied on reload,
+// changes of other keys take effect only after a restart.
+var reloadable = map[string]bool{
+	"unit":         true,
+	"include":      true,
+	"exclude":      true,
+	"unit-type":    true,
+	"interval":     true,
+	"max-interval": true,
+}
+
+// reload re-reads the config file and applies its reloadable keys to sd,
+// flags set on the command line still take precedence and keys removed
+// from the file are reset to defaults. Flags are left intact.
+func reload(sd *systemd.Systemd) error {
+	if configFlag == "" {
+		return errors.New("no config file to reload")
+	}
+	c, err := readConfig(configFlag)
+	if err != nil {
+		return err
+	}
+
+	strs := func(key string, v []string) []string {
+		if isFlagSet(key) {
+			return v
+		}
+		return c.values(key)
+	}
+	dur := func(key string, v, def time.Duration) (time.Duration, error) {
+		if isFlagSet(key) {
+			return v, nil
+		}
+		return c.duration(key, def)
+	}
+	interval, err := dur("interval", intervalFlag, systemd.DefaultInterval)
+	if err != nil {
+		return err
+	}
+	maxInterval, err := dur("max-interval", maxIntFlag, 0)
+	if err != nil {
+		return err
+	}
+	if err = sd.Reload(
+		systemd.WithStateFile(stateFileFlag),
+		systemd.WithInterval(interval),
+		systemd.WithAdaptiveInterval(maxInterval),
+		systemd.WithUnits(strs("unit", unitsFlag)...),
+		systemd.WithInclude(strs("include", includeFlag)...),
+		systemd.WithExclude(strs("exclude", excludeFlag)...),
+		systemd.WithUnitTypes(strs("unit-type", typesFlag)...),
+	); err != nil {
+		return err
+	}
+
+	for _, key := range fileConfig.changed(c) {
+		if !reloadable[key] && !isFlagSet(key) {
+			fmt.Fprintf(os.Stderr, "reload warning: %s has changed, it's applied only on restart\n", key)
+		}
+	}
+	return nil
+}
+
+// isFlagSet reports whether the named flag is set on the command line.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// stringsFlag is a flag that can be specified multiple times.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// compressionFlag is a state compression algorithm, it's a boolean
+// flag, so -state-compress alone and -state-compress=false still work.
+type compressionFlag systemd.Compression
+
+func (f *compressionFlag) String() string {
+	return string(*f)
+}
+
+func (f *compressionFlag) IsBoolFlag() bool {
+	return true
+}
+
+func (f *compressionFlag) Set(s string) error {
+	switch c := systemd.Compression(s); c {
+	case systemd.NoCompression, systemd.GzipCompression, systemd.ZstdCompression:
+		*f = compressionFlag(c)
+	case "true":
+		*f = compressionFlag(systemd.GzipCompression)
+	case "false":
+		*f = compressionFlag(systemd.NoCompression)
+	default:
+		return fmt.Errorf("unknown compression %q, want gzip, zstd or none", s)
 	}
+	return nil
 }
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/amenzhinsky/systemd-slack/systemd"
+	"github.com/coreos/go-systemd/dbus"
+)
+
+func TestParseNotifiers(t *testing.T) {
+	t.Parallel()
+
+	specs, err := parseNotifiers(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []notifierSpec{{kind: "slack"}}; !reflect.DeepEqual(specs, want) {
+		t.Errorf("default = %v, want %v", specs, want)
+	}
+
+	specs, err = parseNotifiers([]string{"slack", "webhook=https://example.com/hook?a=b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []notifierSpec{{kind: "slack"}, {kind: "webhook", url: "https://example.com/hook?a=b"}}
+	if !reflect.DeepEqual(specs, want) {
+		t.Errorf("specs = %v, want %v", specs, want)
+	}
+
+	if _, err = parseNotifiers([]string{"irc"}); err == nil {
+		t.Error("expected an error on an unknown notifier")
+	}
+}
+
+func TestUnhealthy(t *testing.T) {
+	units := []systemd.Unit{
+		{UnitStatus: dbus.UnitStatus{Name: "a.service", ActiveState: "active", SubState: "running"}},
+		{UnitStatus: dbus.UnitStatus{Name: "b.service", ActiveState: "failed", SubState: "failed"}},
+		{UnitStatus: dbus.UnitStatus{Name: "c.service", ActiveState: "activating", SubState: "auto-restart"}},
+	}
+	for _, tc := range []struct {
+		states []string
+		want   []string
+	}{
+		{[]string{"failed"}, []string{"b.service"}},
+		{[]string{"failed", "auto-restart"}, []string{"b.service", "c.service"}},
+		{nil, nil},
+	} {
+		if got := unhealthy(units, tc.states); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("unhealthy(%q) = %q, want %q", tc.states, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+// Package mattermost posts unit changes to mattermost incoming webhooks.
+//
+// Mattermost accepts slack-style payloads but differs in a few ways
+// the slack client doesn't account for:
+//
+//   - channel is the channel url name, e.g. town-square, without #,
+//     and it's omitted when empty so the webhook default is used;
+//   - username and icon overrides are silently ignored unless they're
+//     enabled in the system console, they're omitted when empty too;
+//   - attachment colors must be hex codes, slack's good, warning
+//     and danger names are not recognized;
+//   - text is always rendered as markdown, so there's no mrkdwn_in;
+//   - webhooks don't return post ids, so there're no thread replies.
+package mattermost
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amenzhinsky/systemd-slack/internal/httpclient"
+	"github.com/amenzhinsky/systemd-slack/notifier"
+	"github.com/amenzhinsky/systemd-slack/systemd"
+)
+
+// Option is a configuration value.
+type Option func(m *Mattermost)
+
+// WithChannel overrides the webhook channel, it's the channel url name.
+func WithChannel(channel string) Option {
+	return func(m *Mattermost) {
+		m.channel = strings.TrimPrefix(channel, "#")
+	}
+}
+
+// WithUsername overrides the webhook username.
+func WithUsername(username string) Option {
+	return func(m *Mattermost) {
+		m.username = username
+	}
+}
+
+// WithIconURL overrides the webhook icon.
+func WithIconURL(url string) Option {
+	return func(m *Mattermost) {
+		m.iconURL = url
+	}
+}
+
+// WithLogger sets logger, nil disables logging.
+func WithLogger(l *log.Logger) Option {
+	return func(m *Mattermost) {
+		m.logger = l
+	}
+}
+
+// WithHTTPTimeout limits duration of every request,
+// zero disables the timeout, the default is 10s.
+func WithHTTPTimeout(d time.Duration) Option {
+	return func(m *Mattermost) {
+		m.timeout = d
+	}
+}
+
+// WithClientCert makes the client present the PEM-encoded certificate
+// and key to instances enforcing mutual TLS, they're loaded by New.
+func WithClientCert(certFile, keyFile string) Option {
+	return func(m *Mattermost) {
+		m.certFile, m.keyFile = certFile, keyFile
+	}
+}
+
+// WithRootCAs makes the client verify self-hosted instances
+// with certificate authorities from the PEM file.
+func WithRootCAs(caFile string) Option {
+	return func(m *Mattermost) {
+		m.caFile = caFile
+	}
+}
+
+// WithAcknowledger makes the client acknowledge changes
+// with a once they are posted, see systemd.WithDeliveryTracking.
+func WithAcknowledger(a notifier.Acknowledger) Option {
+	return func(m *Mattermost) {
+		m.acknowledger = a
+	}
+}
+
+// New creates a client that posts to the incoming webhook url.
+func New(url string, opts ...Option) (*Mattermost, error) {
+	if url == "" {
+		return nil, errors.New("mattermost: url is empty")
+	}
+	m := &Mattermost{
+		url:     url,
+		client:  http.DefaultClient,
+		timeout: 10 * time.Second,
+		logger:  log.New(os.Stdout, "[mattermost] ", log.LstdFlags),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if m.certFile != "" || m.keyFile != "" || m.caFile != "" {
+		if err := m.setTLS(); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// setTLS replaces the client with its copy that uses
+// the client certificate and root CAs.
+func (m *Mattermost) setTLS() error {
+	c, err := httpclient.WithTLS(m.client, m.certFile, m.keyFile, m.caFile)
+	if err != nil {
+		return fmt.Errorf("mattermost: %s", err)
+	}
+	m.client = c
+	return nil
+}
+
+// Mattermost is a mattermost incoming webhook client.
+type Mattermost struct {
+	mu           sync.Mutex // guards url
+	url          string
+	channel      string
+	username     string
+	iconURL      string
+	client       *http.Client
+	timeout      time.Duration
+	logger       *log.Logger
+	acknowledger notifier.Acknowledger
+	certFile     string
+	keyFile      string
+	caFile       string
+}
+
+// payload is data that is sent to the webhook url.
+type payload struct {
+	Channel     string       `json:"channel,omitempty"`
+	Username    string       `json:"username,omitempty"`
+	IconURL     string       `json:"icon_url,omitempty"`
+	Text        string       `json:"text,omitempty"`
+	Attachments []attachment `json:"attachments,omitempty"`
+}
+
+// attachment is a message container.
+type attachment struct {
+	Fallback string  `json:"fallback"`
+	Color    string  `json:"color"`
+	Text     string  `json:"text"`
+	Fields   []field `json:"fields"`
+}
+
+// field is an attachment table cell.
+type field struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+// SetURL replaces the incoming webhook url, e.g. when it's rotated,
+// it's safe to call it concurrently with posting.
+func (m *Mattermost) SetURL(url string) {
+	m.mu.Lock()
+	m.url = url
+	m.mu.Unlock()
+}
+
+// Notify posts the changes in a single message, an attachment per change.
+func (m *Mattermost) Notify(ctx context.Context, changes []systemd.Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	p := payload{Channel: m.channel, Username: m.username, IconURL: m.iconURL}
+	for i := range changes {
+		c := &changes[i]
+		msg := text(c)
+		p.Attachments = append(p.Attachments, attachment{
+			Fallback: msg,
+			Color:    color(c),
+			Text:     msg + journal(c),
+			Fields: []field{
+				{Title: "Active State", Value: c.Unit.ActiveState, Short: true},
+				{Title: "Sub State", Value: c.Unit.SubState, Short: true},
+			},
+		})
+	}
+	if err := m.post(ctx, &p); err != nil {
+		return err
+	}
+	if m.acknowledger != nil {
+		return m.acknowledger.Ack(changes)
+	}
+	return nil
+}
+
+// Message posts the text as a plain message.
+func (m *Mattermost) Message(ctx context.Context, text string) error {
+	return m.post(ctx, &payload{Channel: m.channel, Username: m.username, IconURL: m.iconURL, Text: text})
+}
+
+// text describes the change in markdown.
+func text(c *systemd.Change) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "**%s** is %s (%s)", c.Unit.Name, c.Unit.ActiveState, c.Unit.SubState)
+	if c.Kind == systemd.Modified {
+		fmt.Fprintf(&b, ", was %s (%s)", c.Old.ActiveState, c.Old.SubState)
+	} else {
+		fmt.Fprintf(&b, ", %s", c.Kind)
+	}
+	if c.Exit != nil && c.Exit.String() != "" {
+		fmt.Fprintf(&b, ", %s", c.Exit)
+	}
+	if c.RemovalReason != "" {
+		fmt.Fprintf(&b, ", %s", c.RemovalReason)
+	}
+	if len(c.ChangedProperties) != 0 {
+		fmt.Fprintf(&b, ", changed %s", strings.Join(c.ChangedProperties, ", "))
+	}
+	if len(c.CausedBy) != 0 {
+		fmt.Fprintf(&b, ", likely caused by %s", strings.Join(c.CausedBy, ", "))
+	}
+	for _, k := range c.ExtraKeys() {
+		fmt.Fprintf(&b, ", %s: %s", k, c.Extra[k])
+	}
+	return b.String()
+}
+
+// journal formats the journal tail as a code block.
+func journal(c *systemd.Change) string {
+	if len(c.Journal) == 0 {
+		return ""
+	}
+	return "\n```\n" + strings.Join(c.Journal, "\n") + "\n```"
+}
+
+// color returns the attachment hex color.
+func color(c *systemd.Change) string {
+	switch {
+	case c.EnteredFailed(), c.Kind == systemd.Startup, c.Kind == systemd.Flapping:
+		return "#d00000"
+	case c.Kind == systemd.Recovered:
+		return "#2eb886"
+	default:
+		return "#daa038"
+	}
+}
+
+func (m *Mattermost) post(ctx context.Context, p *payload) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	m.infof("payload: %s", b)
+
+	m.mu.Lock()
+	url := m.url
+	m.mu.Unlock()
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if m.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.timeout)
+		defer cancel()
+	}
+	r, err := m.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	m.infof("response: %s", r.Status)
+
+	if r.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(io.LimitReader(r.Body, 1024))
+		return fmt.Errorf("mattermost: %s: %s", http.StatusText(r.StatusCode), bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// infof prints a debug message.
+func (m *Mattermost) infof(format string, v ...interface{}) {
+	if m.logger != nil {
+		m.logger.Printf(format, v...)
+	}
+}
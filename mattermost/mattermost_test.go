@@ -0,0 +1,55 @@
+package mattermost
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/amenzhinsky/systemd-slack/systemd"
+	"github.com/coreos/go-systemd/dbus"
+)
+
+func TestNotify(t *testing.T) {
+	t.Parallel()
+
+	var raw map[string]interface{}
+	var p payload
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+			t.Error(err)
+		}
+		json.Unmarshal(b, &raw)
+		json.Unmarshal(b, &p)
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	m, err := New(ts.URL, WithLogger(nil), WithChannel("#ops"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Notify(context.Background(), []systemd.Change{{
+		Kind: systemd.Modified,
+		Unit: systemd.Unit{UnitStatus: dbus.UnitStatus{Name: "a.service", ActiveState: "failed", SubState: "failed"}},
+		Old:  systemd.Unit{UnitStatus: dbus.UnitStatus{Name: "a.service", ActiveState: "active", SubState: "running"}},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Channel != "ops" {
+		t.Errorf("channel = %q, want %q", p.Channel, "ops")
+	}
+	if _, ok := raw["username"]; ok {
+		t.Error("empty username is not omitted")
+	}
+	if len(p.Attachments) != 1 || p.Attachments[0].Color != "#d00000" {
+		t.Fatalf("attachments = %+v, want a red one", p.Attachments)
+	}
+	if !strings.Contains(p.Attachments[0].Text, "**a.service** is failed (failed), was active (running)") {
+		t.Errorf("text = %q", p.Attachments[0].Text)
+	}
+}
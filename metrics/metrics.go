@@ -0,0 +1,120 @@
+// Package metrics exposes the watcher health in the prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Metrics is a set of watcher metrics, it's safe for concurrent use,
+// all methods are no-op for a nil receiver so it can be left unset.
+type Metrics struct {
+	mu           sync.Mutex
+	unitsTracked int
+	failedUnits  int
+	changes      map[string]uint64
+	slackPosts   uint64
+	slackErrors  uint64
+}
+
+// New creates a new metrics set.
+func New() *Metrics {
+	return &Metrics{changes: map[string]uint64{}}
+}
+
+// SetUnits sets the number of tracked and failed units.
+func (m *Metrics) SetUnits(tracked, failed int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.unitsTracked, m.failedUnits = tracked, failed
+	m.mu.Unlock()
+}
+
+// IncChanges increments the number of changes of the named kind.
+func (m *Metrics) IncChanges(kind string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.changes[kind]++
+	m.mu.Unlock()
+}
+
+// IncSlackPosts increments the number of messages posted to slack.
+func (m *Metrics) IncSlackPosts() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.slackPosts++
+	m.mu.Unlock()
+}
+
+// IncSlackErrors increments the number of messages slack failed to accept.
+func (m *Metrics) IncSlackErrors() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.slackErrors++
+	m.mu.Unlock()
+}
+
+// WriteTo writes the metrics to w in the prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var n int64
+	printf := func(format string, v ...interface{}) error {
+		k, err := fmt.Fprintf(w, format, v...)
+		n += int64(k)
+		return err
+	}
+
+	kinds := make([]string, 0, len(m.changes))
+	for k := range m.changes {
+		kinds = append(kinds, k)
+	}
+	sort.Strings(kinds)
+
+	if err := printf("# HELP systemd_slack_units_tracked Number of tracked units.\n"+
+		"# TYPE systemd_slack_units_tracked gauge\n"+
+		"systemd_slack_units_tracked %d\n", m.unitsTracked); err != nil {
+		return n, err
+	}
+	if err := printf("# HELP systemd_slack_failed_units Number of failed units.\n"+
+		"# TYPE systemd_slack_failed_units gauge\n"+
+		"systemd_slack_failed_units %d\n", m.failedUnits); err != nil {
+		return n, err
+	}
+	if err := printf("# HELP systemd_slack_changes_total Number of unit changes by kind.\n" +
+		"# TYPE systemd_slack_changes_total counter\n"); err != nil {
+		return n, err
+	}
+	for _, k := range kinds {
+		if err := printf("systemd_slack_changes_total{kind=%q} %d\n", k, m.changes[k]); err != nil {
+			return n, err
+		}
+	}
+	if err := printf("# HELP systemd_slack_slack_posts_total Number of messages posted to slack.\n"+
+		"# TYPE systemd_slack_slack_posts_total counter\n"+
+		"systemd_slack_slack_posts_total %d\n", m.slackPosts); err != nil {
+		return n, err
+	}
+	err := printf("# HELP systemd_slack_slack_errors_total Number of failed slack posts.\n"+
+		"# TYPE systemd_slack_slack_errors_total counter\n"+
+		"systemd_slack_slack_errors_total %d\n", m.slackErrors)
+	return n, err
+}
+
+// ServeHTTP implements http.Handler.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	t.Parallel()
+
+	m := New()
+	m.SetUnits(10, 2)
+	m.IncChanges("modified")
+	m.IncChanges("modified")
+	m.IncChanges("added")
+	m.IncSlackPosts()
+	m.IncSlackErrors()
+
+	var b bytes.Buffer
+	if _, err := m.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"systemd_slack_units_tracked 10\n",
+		"systemd_slack_failed_units 2\n",
+		`systemd_slack_changes_total{kind="added"} 1` + "\n",
+		`systemd_slack_changes_total{kind="modified"} 2` + "\n",
+		"systemd_slack_slack_posts_total 1\n",
+		"systemd_slack_slack_errors_total 1\n",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, b.String())
+		}
+	}
+}
+
+func TestNil(t *testing.T) {
+	t.Parallel()
+
+	var m *Metrics
+	m.SetUnits(1, 1)
+	m.IncChanges("added")
+	m.IncSlackPosts()
+	m.IncSlackErrors()
+}
@@ -0,0 +1,162 @@
+package notifier
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amenzhinsky/systemd-slack/clock"
+	"github.com/amenzhinsky/systemd-slack/systemd"
+)
+
+// Messenger posts free-form text messages,
+// it's implemented by *slack.Slack, *mattermost.Mattermost,
+// *teams.Teams, *webhook.Webhook and *Multi.
+type Messenger interface {
+	Message(ctx context.Context, text string) error
+}
+
+// Digest accumulates suppressed changes and periodically
+// posts a single message summarizing them.
+//
+// Only counts and up to a limited number of unit names are kept,
+// so memory usage doesn't depend on the number of changes.
+type Digest struct {
+	m        Messenger
+	interval time.Duration
+	limit    int
+	logger   *log.Logger
+	clock    clock.Clock
+
+	mu      sync.Mutex
+	since   time.Time
+	total   int
+	reasons map[string]int
+	units   []string
+	other   int // changes of units not in the list
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewDigest starts a goroutine that posts summaries with m every interval
+// until Close is called, limit is the maximum number of listed units.
+// Posting errors are logged to l, nil disables logging.
+func NewDigest(m Messenger, interval time.Duration, limit int, l *log.Logger, opts ...Option) *Digest {
+	c := newOptions(opts).clock
+	d := &Digest{
+		m:        m,
+		interval: interval,
+		limit:    limit,
+		logger:   l,
+		clock:    c,
+		since:    c.Now(),
+		reasons:  map[string]int{},
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go d.run()
+	return d
+}
+
+// Add records the change suppressed for the reason,
+// it matches systemd.WithSuppressionHook.
+func (d *Digest) Add(c systemd.Change, reason string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.total++
+	d.reasons[reason]++
+	switch {
+	case contains(d.units, c.Unit.Name):
+	case len(d.units) < d.limit:
+		d.units = append(d.units, c.Unit.Name)
+	default:
+		d.other++
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Digest) run() {
+	defer close(d.done)
+	for {
+		select {
+		case <-d.clock.After(d.interval):
+			d.flush()
+		case <-d.stop:
+			d.flush()
+			return
+		}
+	}
+}
+
+// flush posts the summary and resets counters, nothing is posted
+// when no changes have been suppressed since the previous one.
+func (d *Digest) flush() {
+	d.mu.Lock()
+	now := d.clock.Now()
+	text := d.text(now)
+	d.since, d.total, d.other, d.units = now, 0, 0, nil
+	d.reasons = map[string]int{}
+	d.mu.Unlock()
+
+	if text == "" {
+		return
+	}
+	if err := d.m.Message(context.Background(), text); err != nil {
+		d.logf("cannot post digest: %s", err)
+	}
+}
+
+// text renders the summary, e.g.:
+//
+//	12 changes suppressed in the last 1h0m0s: 9 filtered, 3 rate limited
+//	(a.service, b.service and 4 more changes)
+func (d *Digest) text(now time.Time) string {
+	if d.total == 0 {
+		return ""
+	}
+	reasons := make([]string, 0, len(d.reasons))
+	for reason := range d.reasons {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for i, reason := range reasons {
+		reasons[i] = fmt.Sprintf("%d %s", d.reasons[reason], reason)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d changes suppressed in the last %s: %s",
+		d.total, now.Sub(d.since).Round(time.Second), strings.Join(reasons, ", "))
+	if len(d.units) != 0 {
+		fmt.Fprintf(&b, " (%s", strings.Join(d.units, ", "))
+		if d.other != 0 {
+			fmt.Fprintf(&b, " and %d more changes", d.other)
+		}
+		b.WriteByte(')')
+	}
+	return b.String()
+}
+
+// Close posts the remaining summary and stops the goroutine.
+func (d *Digest) Close() {
+	close(d.stop)
+	<-d.done
+}
+
+func (d *Digest) logf(format string, v ...interface{}) {
+	if d.logger != nil {
+		d.logger.Printf(format, v...)
+	}
+}
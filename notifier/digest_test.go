@@ -0,0 +1,60 @@
+package notifier
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/systemd-slack/clock"
+	"github.com/amenzhinsky/systemd-slack/systemd"
+	"github.com/coreos/go-systemd/dbus"
+)
+
+// messages collects posted messages.
+type messages []string
+
+func (m *messages) Message(ctx context.Context, text string) error {
+	*m = append(*m, text)
+	return nil
+}
+
+func (m *messages) Notify(ctx context.Context, changes []systemd.Change) error {
+	return nil
+}
+
+func TestDigest(t *testing.T) {
+	t.Parallel()
+
+	var m messages
+	clock := clock.NewFake()
+	d := NewDigest(NewMulti(nil, &m, funcNotifier(nil)), time.Hour, 2, nil, WithClock(clock))
+	for _, name := range []string{"a.service", "b.service", "a.service", "c.service", "d.service"} {
+		d.Add(systemd.Change{Unit: systemd.Unit{UnitStatus: dbus.UnitStatus{Name: name}}}, "filtered")
+	}
+	d.Add(systemd.Change{Unit: systemd.Unit{UnitStatus: dbus.UnitStatus{Name: "b.service"}}}, "duplicate")
+	clock.Advance(time.Minute)
+	d.Close()
+
+	if len(m) != 1 {
+		t.Fatalf("messages = %q, want a single digest", m)
+	}
+	want := "6 changes suppressed in the last 1m0s: 1 duplicate, 5 filtered (a.service, b.service and 2 more changes)"
+	if m[0] != want {
+		t.Errorf("digest = %q, want %q", m[0], want)
+	}
+}
+
+func TestDigestEmpty(t *testing.T) {
+	t.Parallel()
+
+	var m messages
+	clock := clock.NewFake()
+	clock.Waits = make(chan time.Duration, 1)
+	d := NewDigest(&m, time.Hour, 1, nil, WithClock(clock))
+	clock.Advance(<-clock.Waits)
+	<-clock.Waits // the empty digest is done
+	d.Close()
+	if len(m) != 0 {
+		t.Errorf("messages = %q, want none", m)
+	}
+}
@@ -0,0 +1,57 @@
+package notifier
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/amenzhinsky/systemd-slack/systemd"
+)
+
+// Acknowledger is notified about delivered changes,
+// it's implemented by *systemd.Systemd.
+type Acknowledger interface {
+	Ack(changes []systemd.Change) error
+}
+
+// JSONLines writes every change as a json object on a separate line,
+// that's handy for piping changes into log shippers or jq.
+type JSONLines struct {
+	mu sync.Mutex
+	w  io.Writer
+	a  Acknowledger
+}
+
+// NewJSONLines creates a notifier that writes changes to w,
+// a is notified about written changes unless it's nil.
+//
+// Lines are flushed one by one when w has a Flush method,
+// so a buffered writer doesn't hold back events.
+func NewJSONLines(w io.Writer, a Acknowledger) *JSONLines {
+	return &JSONLines{w: w, a: a}
+}
+
+// Notify writes the changes, it's safe for concurrent use.
+func (j *JSONLines) Notify(ctx context.Context, changes []systemd.Change) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for i := range changes {
+		b, err := json.Marshal(&changes[i])
+		if err != nil {
+			return err
+		}
+		if _, err = j.w.Write(append(b, '\n')); err != nil {
+			return err
+		}
+		if f, ok := j.w.(interface{ Flush() error }); ok {
+			if err = f.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if j.a != nil {
+		return j.a.Ack(changes)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package notifier
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/amenzhinsky/systemd-slack/systemd"
+	"github.com/coreos/go-systemd/dbus"
+)
+
+func TestJSONLines(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	bw := bufio.NewWriter(&buf)
+	n := NewJSONLines(bw, nil)
+	if err := n.Notify(context.Background(), []systemd.Change{
+		{Kind: systemd.Added, Unit: systemd.Unit{UnitStatus: dbus.UnitStatus{Name: "a.service"}}},
+		{Kind: systemd.Recovered, Unit: systemd.Unit{UnitStatus: dbus.UnitStatus{Name: "b.service"}}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing must be left in the buffer
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("lines = %q, want 2", lines)
+	}
+	var c systemd.Change
+	if err := json.Unmarshal([]byte(lines[1]), &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Kind != systemd.Recovered || c.Unit.Name != "b.service" {
+		t.Errorf("decoded %v %s, want recovered b.service", c.Kind, c.Unit.Name)
+	}
+	if !strings.Contains(lines[0], `"Kind":"added"`) {
+		t.Errorf("line = %s, want the kind name", lines[0])
+	}
+}
@@ -0,0 +1,71 @@
+package notifier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/amenzhinsky/systemd-slack/systemd"
+)
+
+// Multi forwards changes to multiple notifiers at the same time.
+type Multi struct {
+	ns []Notifier
+	a  Acknowledger
+}
+
+// NewMulti creates a notifier that fans changes out to ns,
+// a is notified only when all of them succeed unless it's nil,
+// so the wrapped notifiers shouldn't acknowledge changes themselves.
+func NewMulti(a Acknowledger, ns ...Notifier) *Multi {
+	return &Multi{ns: ns, a: a}
+}
+
+// Notify calls Notify of every notifier concurrently and waits for them,
+// a failing notifier doesn't prevent the rest from delivering changes.
+// The returned error contains errors of all failed notifiers.
+func (m *Multi) Notify(ctx context.Context, changes []systemd.Change) error {
+	errs := make([]error, len(m.ns))
+	var wg sync.WaitGroup
+	for i, n := range m.ns {
+		wg.Add(1)
+		go func(i int, n Notifier) {
+			defer wg.Done()
+			if err := n.Notify(ctx, changes); err != nil {
+				errs[i] = fmt.Errorf("notifier %d: %w", i+1, err)
+			}
+		}(i, n)
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	if m.a != nil {
+		return m.a.Ack(changes)
+	}
+	return nil
+}
+
+// Message posts the text with every notifier that is a Messenger,
+// the rest are skipped.
+func (m *Multi) Message(ctx context.Context, text string) error {
+	errs := make([]error, len(m.ns))
+	var wg sync.WaitGroup
+	for i, n := range m.ns {
+		ms, ok := n.(Messenger)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, ms Messenger) {
+			defer wg.Done()
+			if err := ms.Message(ctx, text); err != nil {
+				errs[i] = fmt.Errorf("notifier %d: %w", i+1, err)
+			}
+		}(i, ms)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
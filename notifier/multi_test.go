@@ -0,0 +1,62 @@
+package notifier
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/amenzhinsky/systemd-slack/systemd"
+)
+
+// funcNotifier calls the function on every Notify.
+type funcNotifier func(changes []systemd.Change) error
+
+func (f funcNotifier) Notify(ctx context.Context, changes []systemd.Change) error {
+	return f(changes)
+}
+
+// countAcknowledger counts acknowledged changes.
+type countAcknowledger int
+
+func (a *countAcknowledger) Ack(changes []systemd.Change) error {
+	*a += countAcknowledger(len(changes))
+	return nil
+}
+
+func TestMulti(t *testing.T) {
+	t.Parallel()
+
+	// notifiers are called concurrently, ok is passed twice below
+	var delivered int64
+	ok := funcNotifier(func(changes []systemd.Change) error {
+		atomic.AddInt64(&delivered, int64(len(changes)))
+		return nil
+	})
+	failing := funcNotifier(func(changes []systemd.Change) error {
+		return errors.New("unavailable")
+	})
+
+	var a countAcknowledger
+	err := NewMulti(&a, failing, ok).Notify(context.Background(), make([]systemd.Change, 2))
+	if err == nil || !strings.Contains(err.Error(), "notifier 1: unavailable") {
+		t.Fatalf("err = %v, want the first notifier error", err)
+	}
+	if n := atomic.LoadInt64(&delivered); n != 2 {
+		t.Errorf("delivered = %d, want 2 despite the failing notifier", n)
+	}
+	if a != 0 {
+		t.Errorf("acknowledged = %d after a failure, want 0", a)
+	}
+
+	if err = NewMulti(&a, ok, ok).Notify(context.Background(), make([]systemd.Change, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if a != 1 {
+		t.Errorf("acknowledged = %d, want 1", a)
+	}
+	if n := atomic.LoadInt64(&delivered); n != 4 {
+		t.Errorf("delivered = %d, want 4 after posting to both notifiers", n)
+	}
+}
@@ -0,0 +1,39 @@
+// Package notifier decouples delivering unit changes from watching them.
+package notifier
+
+import (
+	"context"
+
+	"github.com/amenzhinsky/systemd-slack/clock"
+	"github.com/amenzhinsky/systemd-slack/systemd"
+)
+
+// Notifier delivers unit changes somewhere,
+// it's implemented by *slack.Slack, *mattermost.Mattermost,
+// *teams.Teams and *webhook.Webhook.
+type Notifier interface {
+	Notify(ctx context.Context, changes []systemd.Change) error
+}
+
+// Option is a configuration value of Digest and Quiet.
+type Option func(o *options)
+
+type options struct {
+	clock clock.Clock
+}
+
+// WithClock replaces the wall clock used for scheduling posts,
+// it's mostly needed in tests.
+func WithClock(c clock.Clock) Option {
+	return func(o *options) {
+		o.clock = c
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{clock: clock.Real}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
@@ -0,0 +1,111 @@
+package notifier
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/amenzhinsky/systemd-slack/systemd"
+)
+
+// Queue delivers changes in a separate goroutine,
+// so a slow notifier doesn't delay polling systemd.
+//
+// When the buffer is full the oldest batch is dropped
+// in favour of the new one and the number of dropped batches is logged.
+type Queue struct {
+	n      Notifier
+	d      Discarder
+	logger *log.Logger
+	ch     chan []systemd.Change
+	wg     sync.WaitGroup
+	once   sync.Once
+
+	// dropped is accessed only by Push
+	dropped int
+}
+
+// Discarder is notified about changes that are not going to be delivered.
+type Discarder interface {
+	Discard(changes []systemd.Change) error
+}
+
+// NewQueue starts a goroutine that delivers batches pushed to the queue
+// with n until ctx is canceled or Close is called,
+// size is the maximum number of batches waiting to be sent.
+// Dropped batches are passed to d unless it's nil, so they're not
+// redelivered after a restart.
+// Dropped batches and delivery errors are logged to l, nil disables logging.
+func NewQueue(ctx context.Context, n Notifier, d Discarder, size int, l *log.Logger) *Queue {
+	if size < 1 {
+		size = 1
+	}
+	q := &Queue{n: n, d: d, logger: l, ch: make(chan []systemd.Change, size)}
+	q.wg.Add(1)
+	go q.run(ctx)
+	return q
+}
+
+// Push adds the changes to the queue, it never blocks but
+// it drops the oldest batch when the queue is full.
+// It must not be called concurrently or after Close.
+func (q *Queue) Push(changes []systemd.Change) {
+	if len(changes) == 0 {
+		return
+	}
+	for {
+		select {
+		case q.ch <- changes:
+			return
+		default:
+		}
+
+		// only Push sends to the channel, so there's room
+		// for the batch unless the sender picks up one first
+		select {
+		case old := <-q.ch:
+			q.dropped++
+			q.logf("queue is full, dropped %d changes (%d batches in total)",
+				len(old), q.dropped)
+			if q.d != nil {
+				if err := q.d.Discard(old); err != nil {
+					q.logf("discard error: %s", err)
+				}
+			}
+		default:
+		}
+	}
+}
+
+// Close stops accepting changes and waits until queued batches are sent
+// or the context passed to NewQueue is canceled.
+func (q *Queue) Close() {
+	q.once.Do(func() {
+		close(q.ch)
+	})
+	q.wg.Wait()
+}
+
+func (q *Queue) run(ctx context.Context) {
+	defer q.wg.Done()
+	for {
+		select {
+		case changes, ok := <-q.ch:
+			if !ok {
+				return
+			}
+			// errors are not fatal, next changes may be delivered
+			if err := q.n.Notify(ctx, changes); err != nil {
+				q.logf("notify error: %s", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (q *Queue) logf(format string, v ...interface{}) {
+	if q.logger != nil {
+		q.logger.Printf(format, v...)
+	}
+}
@@ -0,0 +1,74 @@
+package notifier
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/amenzhinsky/systemd-slack/systemd"
+	"github.com/coreos/go-systemd/dbus"
+)
+
+// blockingNotifier blocks on the first batch until released
+// and records names of the first units in batches.
+type blockingNotifier struct {
+	started chan struct{}
+	release chan struct{}
+	got     []string
+}
+
+func (n *blockingNotifier) Notify(ctx context.Context, changes []systemd.Change) error {
+	select {
+	case n.started <- struct{}{}:
+		<-n.release
+	default:
+	}
+	n.got = append(n.got, changes[0].Unit.Name)
+	return nil
+}
+
+// discardRecorder records names of the first units in discarded batches.
+type discardRecorder []string
+
+func (d *discardRecorder) Discard(changes []systemd.Change) error {
+	*d = append(*d, changes[0].Unit.Name)
+	return nil
+}
+
+func TestQueue(t *testing.T) {
+	t.Parallel()
+
+	n := &blockingNotifier{
+		started: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+	var d discardRecorder
+	q := NewQueue(context.Background(), n, &d, 2, nil)
+
+	batch := func(name string) []systemd.Change {
+		return []systemd.Change{{
+			Kind: systemd.Added,
+			Unit: systemd.Unit{UnitStatus: dbus.UnitStatus{Name: name}},
+		}}
+	}
+
+	// the first batch blocks the sender, the second is dropped
+	q.Push(batch("a.service"))
+	<-n.started
+	for _, name := range []string{"b.service", "c.service", "d.service"} {
+		q.Push(batch(name))
+	}
+	close(n.release)
+	q.Close()
+
+	if q.dropped != 1 {
+		t.Errorf("dropped = %d, want 1", q.dropped)
+	}
+	if !reflect.DeepEqual(d, discardRecorder{"b.service"}) {
+		t.Errorf("discarded = %v, want the dropped batch", d)
+	}
+	want := []string{"a.service", "c.service", "d.service"}
+	if !reflect.DeepEqual(n.got, want) {
+		t.Errorf("delivered = %v, want %v", n.got, want)
+	}
+}
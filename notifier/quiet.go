@@ -0,0 +1,173 @@
+package notifier
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amenzhinsky/systemd-slack/clock"
+	"github.com/amenzhinsky/systemd-slack/systemd"
+)
+
+// Schedule is a set of daily quiet hours windows.
+type Schedule struct {
+	windows []window
+	loc     *time.Location
+}
+
+// window is [start, end) in minutes since midnight,
+// start > end means that it spans midnight.
+type window struct {
+	start, end int
+}
+
+// ParseSchedule parses comma-separated HH:MM-HH:MM windows in the location,
+// e.g. "22:00-07:00,12:00-13:00", nil loc means the local time.
+func ParseSchedule(s string, loc *time.Location) (*Schedule, error) {
+	if loc == nil {
+		loc = time.Local
+	}
+	sc := &Schedule{loc: loc}
+	for _, w := range strings.Split(s, ",") {
+		i := strings.IndexByte(w, '-')
+		if i < 0 {
+			return nil, fmt.Errorf("malformed quiet hours %q, want HH:MM-HH:MM", w)
+		}
+		start, err := parseClock(strings.TrimSpace(w[:i]))
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseClock(strings.TrimSpace(w[i+1:]))
+		if err != nil {
+			return nil, err
+		}
+		if start == end {
+			return nil, fmt.Errorf("quiet hours %q are empty", w)
+		}
+		sc.windows = append(sc.windows, window{start, end})
+	}
+	return sc, nil
+}
+
+// parseClock parses HH:MM into minutes since midnight.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("malformed time %q, want HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// End returns the end of the quiet window t is in,
+// false means that t is outside of quiet hours.
+func (s *Schedule) End(t time.Time) (time.Time, bool) {
+	t = t.In(s.loc)
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, s.loc)
+	now := t.Hour()*60 + t.Minute()
+	for _, w := range s.windows {
+		switch {
+		case w.start < w.end && now >= w.start && now < w.end:
+			return midnight.Add(time.Duration(w.end) * time.Minute), true
+		case w.start > w.end && now >= w.start:
+			return midnight.AddDate(0, 0, 1).Add(time.Duration(w.end) * time.Minute), true
+		case w.start > w.end && now < w.end:
+			return midnight.Add(time.Duration(w.end) * time.Minute), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Quiet posts only failures during quiet hours, other changes
+// are deferred and posted in a single batch when quiet hours end.
+type Quiet struct {
+	n      Notifier
+	s      *Schedule
+	logger *log.Logger
+	clock  clock.Clock
+
+	mu       sync.Mutex
+	deferred []systemd.Change
+	stop     chan struct{} // closed to cancel the pending flush
+}
+
+// NewQuiet wraps n with the quiet hours schedule s,
+// deferrals and errors of deferred posts are logged to l unless it's nil.
+func NewQuiet(n Notifier, s *Schedule, l *log.Logger, opts ...Option) *Quiet {
+	return &Quiet{n: n, s: s, logger: l, clock: newOptions(opts).clock}
+}
+
+// isCritical reports whether the change is posted even during quiet hours.
+func isCritical(c *systemd.Change) bool {
+	return c.EnteredFailed() || c.Kind == systemd.Startup || c.Kind == systemd.Flapping
+}
+
+// Notify passes critical changes through and defers the rest during quiet hours.
+func (q *Quiet) Notify(ctx context.Context, changes []systemd.Change) error {
+	end, quiet := q.s.End(q.clock.Now())
+	if !quiet {
+		return q.n.Notify(ctx, changes)
+	}
+
+	var critical []systemd.Change
+	q.mu.Lock()
+	for _, c := range changes {
+		if isCritical(&c) {
+			critical = append(critical, c)
+		} else {
+			q.deferred = append(q.deferred, c)
+		}
+	}
+	if n := len(changes) - len(critical); n != 0 {
+		q.logf("quiet hours until %s, %d changes deferred", end.Format("15:04"), n)
+		if q.stop == nil {
+			q.stop = make(chan struct{})
+			go q.wait(q.clock.After(end.Sub(q.clock.Now())), q.stop)
+		}
+	}
+	q.mu.Unlock()
+
+	if len(critical) == 0 {
+		return nil
+	}
+	return q.n.Notify(ctx, critical)
+}
+
+// wait flushes the deferred changes once quiet hours end unless stop is closed.
+func (q *Quiet) wait(end <-chan time.Time, stop chan struct{}) {
+	select {
+	case <-end:
+		q.flush()
+	case <-stop:
+	}
+}
+
+// flush posts the deferred changes when quiet hours end.
+func (q *Quiet) flush() {
+	q.mu.Lock()
+	changes := q.deferred
+	q.deferred, q.stop = nil, nil
+	q.mu.Unlock()
+
+	if err := q.n.Notify(context.Background(), changes); err != nil {
+		q.logf("cannot post deferred changes: %s", err)
+	}
+}
+
+// Stop cancels posting of the deferred changes.
+func (q *Quiet) Stop() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.stop != nil {
+		close(q.stop)
+		q.stop = nil
+	}
+}
+
+func (q *Quiet) logf(format string, v ...interface{}) {
+	if q.logger != nil {
+		q.logger.Printf(format, v...)
+	}
+}
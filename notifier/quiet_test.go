@@ -0,0 +1,101 @@
+package notifier
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/systemd-slack/clock"
+	"github.com/amenzhinsky/systemd-slack/systemd"
+	"github.com/coreos/go-systemd/dbus"
+)
+
+func TestScheduleEnd(t *testing.T) {
+	t.Parallel()
+
+	s, err := ParseSchedule("22:00-07:00, 12:00-13:00", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := func(d, h, m int) time.Time {
+		return time.Date(2020, 1, d, h, m, 0, 0, time.UTC)
+	}
+	for _, tc := range []struct {
+		now   time.Time
+		end   time.Time
+		quiet bool
+	}{
+		{day(1, 23, 0), day(2, 7, 0), true},
+		{day(2, 6, 59), day(2, 7, 0), true},
+		{day(2, 7, 0), time.Time{}, false},
+		{day(2, 12, 30), day(2, 13, 0), true},
+		{day(2, 21, 59), time.Time{}, false},
+	} {
+		end, quiet := s.End(tc.now)
+		if quiet != tc.quiet || !end.Equal(tc.end) {
+			t.Errorf("End(%s) = %s, %t, want %s, %t", tc.now, end, quiet, tc.end, tc.quiet)
+		}
+	}
+
+	for _, v := range []string{"22:00", "25:00-07:00", "07:00-07:00"} {
+		if _, err = ParseSchedule(v, nil); err == nil {
+			t.Errorf("ParseSchedule(%q) expected an error", v)
+		}
+	}
+}
+
+// recorder remembers delivered batches.
+type recorder struct {
+	batches chan []systemd.Change
+}
+
+func (r *recorder) Notify(ctx context.Context, changes []systemd.Change) error {
+	r.batches <- changes
+	return nil
+}
+
+func TestQuiet(t *testing.T) {
+	t.Parallel()
+
+	// the fake clock is at 02:40 UTC
+	s, err := ParseSchedule("02:00-03:00", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := clock.NewFake()
+	clock.Waits = make(chan time.Duration, 1)
+	r := &recorder{batches: make(chan []systemd.Change, 2)}
+	q := NewQuiet(r, s, nil, WithClock(clock))
+	defer q.Stop()
+
+	unit := func(active string) systemd.Unit {
+		return systemd.Unit{UnitStatus: dbus.UnitStatus{Name: "a.service", ActiveState: active}}
+	}
+	if err = q.Notify(context.Background(), []systemd.Change{
+		{Kind: systemd.Added, Unit: unit("failed")},
+		{Kind: systemd.Added, Unit: unit("active")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if b := <-r.batches; len(b) != 1 || b[0].Unit.ActiveState != "failed" {
+		t.Fatalf("batch = %v, want only the failure", b)
+	}
+	if d := <-clock.Waits; d != 20*time.Minute {
+		t.Fatalf("deferred for %s, want until the end of quiet hours", d)
+	}
+	select {
+	case b := <-r.batches:
+		t.Fatalf("deferred = %v, posted before the end of quiet hours", b)
+	default:
+	}
+	clock.Advance(20 * time.Minute)
+	select {
+	case b := <-r.batches:
+		if len(b) != 1 || b[0].Unit.ActiveState != "active" {
+			t.Fatalf("deferred = %v, want the active unit", b)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("deferred changes are not posted")
+	}
+}
@@ -0,0 +1,1425 @@
+package slack
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	"github.com/amenzhinsky/systemd-slack/clock"
+	"github.com/amenzhinsky/systemd-slack/internal/httpclient"
+	"github.com/amenzhinsky/systemd-slack/metrics"
+	"github.com/amenzhinsky/systemd-slack/notifier"
+	"github.com/amenzhinsky/systemd-slack/systemd"
+)
+
+// Option is a configuration value.
+type Option func(s *Slack)
+
+// WithChannel sets channel name.
+func WithChannel(channel string) Option {
+	return func(s *Slack) {
+		s.channel = channel
+	}
+}
+
+// WithUsername sets username that messages are sent on behalf of.
+func WithUsername(username string) Option {
+	return func(s *Slack) {
+		s.username = username
+	}
+}
+
+// WithIconURL sets icon url.
+func WithIconURL(url string) Option {
+	return func(s *Slack) {
+		s.iconURL = url
+	}
+}
+
+// WithLogger sets logger.
+func WithLogger(l *log.Logger) Option {
+	return func(s *Slack) {
+		s.logger = l
+	}
+}
+
+// WithMaxBatch sets the maximum number of changes posted in a single
+// message, bigger batches are split into multiple messages.
+func WithMaxBatch(n int) Option {
+	return func(s *Slack) {
+		s.maxBatch = n
+	}
+}
+
+// WithRetry sets the maximum number of attempts to post a message
+// and the base delay between them that's doubled after every attempt.
+//
+// Only 429 and 5xx responses and network errors are retried,
+// Retry-After header takes precedence over the computed delay.
+func WithRetry(max int, base time.Duration) Option {
+	return func(s *Slack) {
+		s.maxAttempts = max
+		s.retryBase = base
+	}
+}
+
+// WithClock replaces the wall clock used for rate limiting
+// and delays between retries, it's mostly needed in tests.
+func WithClock(c clock.Clock) Option {
+	return func(s *Slack) {
+		s.clock = c
+	}
+}
+
+// WithGlobalRateLimit limits the number of requests to slack to perMinute
+// across all units and channels, requests over the limit wait for their
+// turn instead of being dropped, so changes are posted late but not lost.
+// Zero disables the limit.
+func WithGlobalRateLimit(perMinute int) Option {
+	return func(s *Slack) {
+		s.perMinute = perMinute
+	}
+}
+
+// WithEditOnRecovery makes the client edit the failure message of a unit
+// when it recovers striking it through instead of replying in its thread,
+// messages of multiple failures and failures posted before enabling it
+// are still replied to, as well as when editing fails.
+// It has effect only with NewWithToken and WithAnnotator.
+func WithEditOnRecovery() Option {
+	return func(s *Slack) {
+		s.editRecovery = true
+	}
+}
+
+// Annotator stores arbitrary values per unit,
+// it's implemented by *systemd.Systemd.
+type Annotator interface {
+	Annotation(path, key string) string
+	SetAnnotation(path, key, value string) error
+}
+
+// WithAnnotator makes the client remember failure messages timestamps
+// in a, so recoveries are posted as replies in the failure threads.
+// It has effect only with NewWithToken, webhooks don't return timestamps.
+func WithAnnotator(a Annotator) Option {
+	return func(s *Slack) {
+		s.annotator = a
+	}
+}
+
+// WithAcknowledger makes the client acknowledge changes with a
+// once they are posted, see systemd.WithDeliveryTracking.
+func WithAcknowledger(a notifier.Acknowledger) Option {
+	return func(s *Slack) {
+		s.acknowledger = a
+	}
+}
+
+// WithMetrics makes the client count posted messages and errors in m.
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(s *Slack) {
+		s.metrics = m
+	}
+}
+
+// WithRouter sets a function that picks the channel of every
+// change, empty string means the default channel, see RouteByKind.
+// Replies in failure threads go to the channel of the failure message.
+func WithRouter(fn func(c *systemd.Change) string) Option {
+	return func(s *Slack) {
+		s.router = fn
+	}
+}
+
+// WithDryRun makes the client log request payloads
+// instead of sending them, that's useful for tuning filters.
+func WithDryRun() Option {
+	return func(s *Slack) {
+		s.dryRun = true
+	}
+}
+
+// WithTemplate sets text/template that renders message text of every change,
+// it's executed with *systemd.Change, for example:
+//
+//	{{.Unit.Name}} is {{.Unit.ActiveState}} ({{.Old.ActiveState}} before), {{.Kind}} at {{.Time}}
+//
+// Journal lines are still appended to the rendered text.
+func WithTemplate(tmpl string) Option {
+	return func(s *Slack) {
+		s.tmplText = tmpl
+	}
+}
+
+// WithUnitLink adds a "View dashboard" link to messages of every change,
+// tmpl is text/template of the link url executed with *systemd.Change,
+// the query function escapes its argument for url queries, for example:
+//
+//	https://grafana.example.com/d/units?var-unit={{query .Unit.Name}}
+//
+// Changes whose link is rendered empty are posted without it.
+func WithUnitLink(tmpl string) Option {
+	return func(s *Slack) {
+		s.linkText = tmpl
+	}
+}
+
+// WithHTTPClient sets the http client used for posting messages,
+// by default it's a client that respects HTTPS_PROXY and NO_PROXY.
+func WithHTTPClient(c *http.Client) Option {
+	return func(s *Slack) {
+		s.client = c
+	}
+}
+
+// WithHTTPTimeout limits duration of every request to slack including
+// reading the response, timed out requests are retried according to
+// the retry policy. Zero disables the timeout, the default is 10s.
+func WithHTTPTimeout(d time.Duration) Option {
+	return func(s *Slack) {
+		s.timeout = d
+	}
+}
+
+// WithProxy makes the client post messages through the given http proxy,
+// it takes precedence over the proxy environment variables.
+func WithProxy(proxyURL string) Option {
+	return func(s *Slack) {
+		s.proxyURL = proxyURL
+	}
+}
+
+// WithClientCert makes the client present the certificate to servers
+// requesting one, e.g. proxies enforcing mutual TLS, the files are
+// PEM-encoded certificate and key, they're loaded by New.
+func WithClientCert(certFile, keyFile string) Option {
+	return func(s *Slack) {
+		s.certFile, s.keyFile = certFile, keyFile
+	}
+}
+
+// WithRootCAs makes the client verify servers with certificate
+// authorities from the PEM file instead of the system ones.
+func WithRootCAs(caFile string) Option {
+	return func(s *Slack) {
+		s.caFile = caFile
+	}
+}
+
+// New creates new slack client that posts messages to the incoming webhook url.
+func New(url string, opts ...Option) (*Slack, error) {
+	s, err := newSlack(opts)
+	if err != nil {
+		return nil, err
+	}
+	s.webhookURL = url
+	return s, nil
+}
+
+// NewWithToken creates new slack client that uses the web api
+// chat.postMessage method authenticated with the given token,
+// that can post to private channels the bot is a member of.
+//
+// The channel can be either a name or an id, username and icon url
+// require the chat:write.customize scope. Replying in threads
+// and updating previously sent messages work only with tokens.
+func NewWithToken(token string, opts ...Option) (*Slack, error) {
+	if token == "" {
+		return nil, errors.New("slack: token is empty")
+	}
+	s, err := newSlack(opts)
+	if err != nil {
+		return nil, err
+	}
+	s.token = token
+	s.apiURL = "https://slack.com/api/"
+	return s, nil
+}
+
+// newSlack creates a client with default settings and applies opts to it.
+func newSlack(opts []Option) (*Slack, error) {
+	s := &Slack{
+		username:    "webhooker",
+		channel:     "webhooks",
+		maxBatch:    20,
+		maxAttempts: 3,
+		retryBase:   500 * time.Millisecond,
+		logger:      log.New(os.Stdout, "[slack] ", log.LstdFlags),
+		client:      http.DefaultClient,
+		timeout:     10 * time.Second,
+		clock:       clock.Real,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.perMinute < 0 {
+		return nil, errors.New("slack: global rate limit is negative")
+	}
+	if s.perMinute > 0 {
+		s.limiter = newBucket(s.perMinute)
+	}
+	if s.proxyURL != "" {
+		if err := s.setProxy(); err != nil {
+			return nil, err
+		}
+	}
+	if s.certFile != "" || s.keyFile != "" || s.caFile != "" {
+		if err := s.setTLS(); err != nil {
+			return nil, err
+		}
+	}
+	if s.tmplText != "" {
+		var err error
+		if s.tmpl, err = template.New("message").Parse(s.tmplText); err != nil {
+			return nil, fmt.Errorf("slack: template: %s", err)
+		}
+	}
+	if s.linkText != "" {
+		var err error
+		s.link, err = template.New("link").Funcs(template.FuncMap{
+			"query": url.QueryEscape,
+		}).Parse(s.linkText)
+		if err != nil {
+			return nil, fmt.Errorf("slack: unit link: %s", err)
+		}
+	}
+	return s, nil
+}
+
+// setProxy replaces the client with its copy that uses s.proxyURL.
+func (s *Slack) setProxy() error {
+	u, err := url.Parse(s.proxyURL)
+	if err != nil {
+		return fmt.Errorf("slack: proxy: %s", err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("slack: proxy: %q is not an absolute url", s.proxyURL)
+	}
+
+	c, t, err := httpclient.Transport(s.client)
+	if err != nil {
+		return fmt.Errorf("slack: proxy: %s", err)
+	}
+	t.Proxy = http.ProxyURL(u)
+	s.client = c
+	return nil
+}
+
+// setTLS replaces the client with its copy that uses
+// the client certificate and root CAs.
+func (s *Slack) setTLS() error {
+	c, err := httpclient.WithTLS(s.client, s.certFile, s.keyFile, s.caFile)
+	if err != nil {
+		return fmt.Errorf("slack: %s", err)
+	}
+	s.client = c
+	return nil
+}
+
+// Slack is a slack client.
+type Slack struct {
+	mu           sync.Mutex // guards webhookURL
+	webhookURL   string
+	token        string
+	apiURL       string
+	channel      string
+	router       func(c *systemd.Change) string
+	channelIDs   map[string]string // resolved by ResolveChannels
+	username     string
+	iconURL      string
+	maxBatch     int
+	logger       *log.Logger
+	annotator    Annotator
+	acknowledger notifier.Acknowledger
+	dryRun       bool
+	editRecovery bool
+	tmplText     string
+	tmpl         *template.Template
+	linkText     string
+	link         *template.Template
+	metrics      *metrics.Metrics
+	client       *http.Client
+	proxyURL     string
+	certFile     string
+	keyFile      string
+	caFile       string
+	timeout      time.Duration
+
+	// retry policy
+	maxAttempts int
+	retryBase   time.Duration
+
+	perMinute int
+	limiter   *bucket
+	clock     clock.Clock
+}
+
+// bucket is a token bucket of size perMinute that's refilled
+// continuously at perMinute tokens per minute.
+type bucket struct {
+	mu     sync.Mutex
+	size   float64
+	rate   float64 // tokens per second
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(perMinute int) *bucket {
+	return &bucket{
+		size:   float64(perMinute),
+		rate:   float64(perMinute) / 60,
+		tokens: float64(perMinute),
+	}
+}
+
+// reserve takes a token and returns how long to wait before using it,
+// tokens may go negative, so waiting callers are served in order.
+func (b *bucket) reserve(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.size {
+			b.tokens = b.size
+		}
+	}
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// payload is data that is sent to the webhook url.
+type payload struct {
+	Channel     string       `json:"channel"`
+	Username    string       `json:"username"`
+	IconURL     string       `json:"icon_url"`
+	Text        string       `json:"text,omitempty"`
+	Attachments []attachment `json:"attachments,omitempty"`
+	ThreadTS    string       `json:"thread_ts,omitempty"`
+}
+
+// attachment is a message container.
+type attachment struct {
+	Fallback string   `json:"fallback,omitempty"`
+	Color    string   `json:"color"`
+	Text     string   `json:"text"`
+	Fields   []field  `json:"fields,omitempty"`
+	MrkdwnIn []string `json:"mrkdwn_in,omitempty"`
+}
+
+// field is an attachment table cell.
+type field struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+// Danger is equivalent of Send("danger", ...)
+func (s *Slack) Danger(msg string, v ...interface{}) error {
+	return s.Send("danger", msg, v...)
+}
+
+// Good is equivalent of Send("good", ...)
+func (s *Slack) Good(msg string, v ...interface{}) error {
+	return s.Send("good", msg, v...)
+}
+
+// Warning is equivalent of Send("warning", ...)
+func (s *Slack) Warning(msg string, v ...interface{}) error {
+	return s.Send("warning", msg, v...)
+}
+
+// Send sends message to the webhook url.
+func (s *Slack) Send(color, msg string, v ...interface{}) error {
+	_, err := s.post(context.Background(), "chat.postMessage", &payload{
+		Channel:  s.channel,
+		Username: s.username,
+		IconURL:  s.iconURL,
+		Attachments: []attachment{
+			{
+				Color: color,
+				Text:  fmt.Sprintf(msg, v...),
+			},
+		},
+	})
+	return err
+}
+
+// Message posts the text as a plain message to the default channel.
+func (s *Slack) Message(ctx context.Context, text string) error {
+	_, err := s.post(ctx, "chat.postMessage", &payload{
+		Channel:  s.channel,
+		Username: s.username,
+		IconURL:  s.iconURL,
+		Text:     truncate(text, maxText),
+	})
+	return err
+}
+
+// SetURL replaces the incoming webhook url, e.g. when it's rotated,
+// it's safe to call it concurrently with posting. It has no effect
+// on clients created with NewWithToken.
+func (s *Slack) SetURL(url string) {
+	s.mu.Lock()
+	s.webhookURL = url
+	s.mu.Unlock()
+}
+
+// Test posts a connectivity test message to the default channel,
+// errors are annotated with their likely causes.
+func (s *Slack) Test(ctx context.Context) error {
+	_, err := s.post(ctx, "chat.postMessage", &payload{
+		Channel:  s.channel,
+		Username: s.username,
+		IconURL:  s.iconURL,
+		Attachments: []attachment{
+			{Color: "good", Text: "systemd-slack connectivity test, no action is needed"},
+		},
+	})
+	if hint := hint(err); hint != "" {
+		return fmt.Errorf("%w (%s)", err, hint)
+	}
+	return err
+}
+
+// ResolveChannels replaces the default channel and the routed channels
+// in names with their ids looked up once with conversations.list, so
+// messages aren't resolved by slack every time, ids and webhook clients
+// are left as is. It requires the channels:read and groups:read scopes.
+//
+// Only channels that don't exist or the bot isn't a member of are errors,
+// when the list cannot be fetched the channels are posted to by names.
+func (s *Slack) ResolveChannels(ctx context.Context, names ...string) error {
+	want := map[string]bool{}
+	for _, name := range append([]string{s.channel}, names...) {
+		if name = strings.TrimPrefix(name, "#"); !isChannelID(name) {
+			want[name] = true
+		}
+	}
+	if s.token == "" || s.dryRun || len(want) == 0 {
+		return nil
+	}
+
+	params := url.Values{
+		"types":            {"public_channel,private_channel"},
+		"exclude_archived": {"true"},
+		"limit":            {"1000"},
+	}
+	found := map[string]bool{}
+	ids := map[string]string{}
+	for {
+		var res struct {
+			response
+			Channels []struct {
+				ID       string `json:"id"`
+				Name     string `json:"name"`
+				IsMember bool   `json:"is_member"`
+			} `json:"channels"`
+			Metadata struct {
+				NextCursor string `json:"next_cursor"`
+			} `json:"response_metadata"`
+		}
+		if err := s.get(ctx, "conversations.list", params, &res); err != nil {
+			if hint := hint(err); hint != "" {
+				err = fmt.Errorf("%w (%s)", err, hint)
+			}
+			s.infof("cannot resolve channels, posting to them by names: %s", err)
+			return nil
+		}
+		for _, c := range res.Channels {
+			if !want[c.Name] {
+				continue
+			}
+			found[c.Name] = true
+			if c.IsMember {
+				ids[c.Name] = c.ID
+			}
+		}
+		if len(found) == len(want) || res.Metadata.NextCursor == "" {
+			break
+		}
+		params.Set("cursor", res.Metadata.NextCursor)
+	}
+
+	sorted := make([]string, 0, len(want))
+	for name := range want {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		switch {
+		case !found[name]:
+			return fmt.Errorf("slack: channel %q is not found or the bot cannot see it", name)
+		case ids[name] == "":
+			return fmt.Errorf("slack: the bot is not a member of channel %q, invite it with /invite", name)
+		}
+		s.infof("channel %q resolved to %s", name, ids[name])
+	}
+	if id, ok := ids[strings.TrimPrefix(s.channel, "#")]; ok {
+		s.channel = id
+	}
+	s.channelIDs = ids
+	return nil
+}
+
+// isChannelID reports whether s looks like a conversation id,
+// e.g. C0123456789, they're upper case unlike channel names.
+func isChannelID(s string) bool {
+	if len(s) < 9 || strings.IndexByte("CGD", s[0]) < 0 {
+		return false
+	}
+	for _, r := range s {
+		if (r < 'A' || r > 'Z') && (r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// get calls a read-only web api method and decodes its response into v,
+// retrying on temporary errors.
+func (s *Slack) get(ctx context.Context, method string, params url.Values, v interface{}) error {
+	return s.retry(ctx, func() error {
+		return s.getOnce(ctx, method, params, v)
+	})
+}
+
+// getOnce makes a single get call.
+func (s *Slack) getOnce(ctx context.Context, method string, params url.Values, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, s.apiURL+method+"?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.token)
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	r, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode >= 400 {
+		body, _ := ioutil.ReadAll(io.LimitReader(r.Body, 1024))
+		return &ResponseError{r: r, body: body}
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	var res response
+	if err = json.Unmarshal(b, &res); err != nil {
+		return err
+	}
+	if !res.OK {
+		return &APIError{Method: method, Code: res.Error}
+	}
+	return json.Unmarshal(b, v)
+}
+
+// hint returns the likely cause of err if it's known.
+func hint(err error) string {
+	switch err := err.(type) {
+	case *ResponseError:
+		switch err.StatusCode() {
+		case http.StatusNotFound:
+			return "the webhook url is mistyped or revoked"
+		case http.StatusForbidden:
+			return "posting to the channel is forbidden, check its permissions"
+		case http.StatusGone:
+			return "the channel is archived or the webhook is disabled"
+		}
+	case *APIError:
+		switch err.Code {
+		case "invalid_auth", "not_authed", "token_revoked":
+			return "the token is invalid"
+		case "channel_not_found":
+			return "the channel doesn't exist or the bot cannot see it"
+		case "not_in_channel":
+			return "the bot is not a member of the channel"
+		case "missing_scope":
+			if err.Method == "conversations.list" {
+				return "the token lacks the channels:read or groups:read scope"
+			}
+			return "the token lacks the chat:write scope"
+		}
+	}
+	return ""
+}
+
+// Notify posts the changes as attachments colored by their severity:
+// red for failures, green for recoveries and yellow for the rest,
+// each message contains at most max batch attachments and texts
+// are truncated to fit within slack message size limits.
+// Startup changes are combined into a separate summary message,
+// changes routed to different channels are posted separately.
+//
+// When the webhook rejects attachments the changes are posted
+// again as a plain text message.
+func (s *Slack) Notify(ctx context.Context, changes []systemd.Change) error {
+	// follow-ups of known failure messages are replied in their threads
+	var rest, startup routes
+	for i := range changes {
+		if changes[i].Kind == systemd.Startup {
+			startup.add(s.route(&changes[i]), changes[i])
+			continue
+		}
+		if channel, ts := s.thread(&changes[i]); ts != "" {
+			if s.edit(ctx, channel, ts, &changes[i]) {
+				if err := s.ack(changes[i : i+1]); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := s.notify(ctx, channel, changes[i:i+1], ts); err != nil {
+				return err
+			}
+			if err := s.ack(changes[i : i+1]); err != nil {
+				return err
+			}
+			continue
+		}
+		rest.add(s.route(&changes[i]), changes[i])
+	}
+	for _, r := range startup {
+		if err := s.summary(ctx, r.channel, r.changes); err != nil {
+			return err
+		}
+		if err := s.ack(r.changes); err != nil {
+			return err
+		}
+	}
+
+	for _, r := range rest {
+		n := s.maxBatch
+		if n <= 0 || n > maxAttachments {
+			n = maxAttachments
+		}
+		for len(r.changes) > 0 {
+			if n > len(r.changes) {
+				n = len(r.changes)
+			}
+			if err := s.notify(ctx, r.channel, r.changes[:n], ""); err != nil {
+				return err
+			}
+			if err := s.ack(r.changes[:n]); err != nil {
+				return err
+			}
+			r.changes = r.changes[n:]
+		}
+	}
+	return nil
+}
+
+// ack acknowledges the posted changes when an acknowledger is set.
+func (s *Slack) ack(changes []systemd.Change) error {
+	if s.acknowledger == nil {
+		return nil
+	}
+	return s.acknowledger.Ack(changes)
+}
+
+// routes is a list of changes grouped by channel in the order of appearance.
+type routes []route
+
+type route struct {
+	channel string
+	changes []systemd.Change
+}
+
+func (rs *routes) add(channel string, c systemd.Change) {
+	for i := range *rs {
+		if (*rs)[i].channel == channel {
+			(*rs)[i].changes = append((*rs)[i].changes, c)
+			return
+		}
+	}
+	*rs = append(*rs, route{channel: channel, changes: []systemd.Change{c}})
+}
+
+// route returns the channel the change has to be posted to.
+func (s *Slack) route(c *systemd.Change) string {
+	if s.router != nil {
+		if channel := s.router(c); channel != "" {
+			if id, ok := s.channelIDs[strings.TrimPrefix(channel, "#")]; ok {
+				return id
+			}
+			return channel
+		}
+	}
+	return s.channel
+}
+
+// RouteByKind returns a router for WithRouter that looks up channels in m
+// by change kind names, e.g. "modified" or "recovered", the "failed" key
+// matches changes of units entering the failed state and already failed
+// units at startup and takes precedence over kinds.
+func RouteByKind(m map[string]string) func(c *systemd.Change) string {
+	return func(c *systemd.Change) string {
+		if c.EnteredFailed() || c.Kind == systemd.Startup {
+			if channel, ok := m["failed"]; ok {
+				return channel
+			}
+		}
+		return m[c.Kind.String()]
+	}
+}
+
+// UnitRoute sends changes of units whose names
+// match the pattern to the channel, see filepath.Match.
+type UnitRoute struct {
+	Pattern string
+	Channel string
+}
+
+// RouteByUnit returns a router for WithRouter that picks the channel
+// of the first route matching the unit name, so more specific
+// patterns have to go first, e.g. foo-db.service before foo-*.service.
+func RouteByUnit(routes []UnitRoute) func(c *systemd.Change) string {
+	return func(c *systemd.Change) string {
+		for _, r := range routes {
+			if ok, _ := filepath.Match(r.Pattern, c.Unit.Name); ok {
+				return r.Channel
+			}
+		}
+		return ""
+	}
+}
+
+// FirstRoute combines routers for WithRouter, the first one
+// returning a channel wins, e.g. FirstRoute(RouteByUnit(...), RouteByKind(...))
+// routes changes by unit owners and by kinds the rest of them.
+func FirstRoute(routers ...func(c *systemd.Change) string) func(c *systemd.Change) string {
+	return func(c *systemd.Change) string {
+		for _, r := range routers {
+			if channel := r(c); channel != "" {
+				return channel
+			}
+		}
+		return ""
+	}
+}
+
+const (
+	// tsAnnotation is the annotation key of failure messages timestamps.
+	tsAnnotation = "slack_ts"
+
+	// channelAnnotation is the annotation key of failure messages channels.
+	channelAnnotation = "slack_channel"
+
+	// textAnnotation is the annotation key of failure messages texts,
+	// it's set only for messages of a single failure that can be edited.
+	textAnnotation = "slack_text"
+)
+
+// thread returns channel and timestamp of the failure message
+// the change has to be replied to, if there's any.
+func (s *Slack) thread(c *systemd.Change) (string, string) {
+	if s.annotator == nil || s.token == "" {
+		return "", ""
+	}
+	if c.Kind != systemd.Recovered && !c.LeftFailed() {
+		return "", ""
+	}
+	path := string(c.Unit.Path)
+	ts := s.annotator.Annotation(path, tsAnnotation)
+	if ts == "" {
+		return "", ""
+	}
+	channel := s.annotator.Annotation(path, channelAnnotation)
+	if channel == "" {
+		channel = s.route(c)
+	}
+	return channel, ts
+}
+
+// notify posts the changes in a single message,
+// in the thread of threadTS message when it's not empty.
+func (s *Slack) notify(ctx context.Context, channel string, changes []systemd.Change, threadTS string) error {
+	p := &payload{
+		Channel:     channel,
+		Username:    s.username,
+		IconURL:     s.iconURL,
+		ThreadTS:    threadTS,
+		Attachments: make([]attachment, 0, len(changes)),
+	}
+	lines := make([]string, 0, len(changes))
+	limit := maxText / len(changes)
+	for i := range changes {
+		c := &changes[i]
+		msg := s.text(c) + causedBy(c) + inState(c) + suppressed(c)
+		link := s.unitLink(c)
+		text := truncate(msg+journal(c), limit-utf8.RuneCountInString(link)) + link
+		lines = append(lines, text)
+		p.Attachments = append(p.Attachments, attachment{
+			Fallback: truncate(msg, limit),
+			Color:    color(c),
+			Text:     text,
+			MrkdwnIn: []string{"text"},
+			Fields: []field{
+				{Title: "Unit", Value: c.Unit.Name},
+				{Title: "Active State", Value: c.Unit.ActiveState, Short: true},
+				{Title: "Sub State", Value: c.Unit.SubState, Short: true},
+				{Title: "Load State", Value: c.Unit.LoadState, Short: true},
+			},
+		})
+		a := &p.Attachments[len(p.Attachments)-1]
+		if c.Unit.MemoryCurrent != 0 {
+			a.Fields = append(a.Fields, field{Title: "Memory", Value: mib(c.Unit.MemoryCurrent), Short: true})
+		}
+		if c.Unit.CPUUsageNSec != 0 {
+			a.Fields = append(a.Fields, field{Title: "CPU Time", Value: cpuTime(c.Unit.CPUUsageNSec), Short: true})
+		}
+		for _, k := range c.ExtraKeys() {
+			a.Fields = append(a.Fields, field{Title: k, Value: c.Extra[k], Short: true})
+		}
+	}
+
+	res, err := s.post(ctx, "chat.postMessage", p)
+	if isRejected(err) {
+		s.infof("attachments rejected, fall back to plain text")
+		p.Text, p.Attachments = strings.Join(lines, "\n"), nil
+		res, err = s.post(ctx, "chat.postMessage", p)
+	}
+	if err != nil {
+		return err
+	}
+	if err = s.annotate(changes, res); err != nil {
+		return err
+	}
+	if s.editRecovery && s.annotator != nil && res.TS != "" &&
+		len(changes) == 1 && changes[0].EnteredFailed() && p.Attachments != nil {
+		return s.annotator.SetAnnotation(string(changes[0].Unit.Path), textAnnotation, p.Attachments[0].Fallback)
+	}
+	return nil
+}
+
+// update is the chat.update method payload.
+type update struct {
+	Channel     string       `json:"channel"`
+	TS          string       `json:"ts"`
+	Attachments []attachment `json:"attachments"`
+}
+
+// edit replaces the failure message ts in the channel with its struck
+// through text followed by the recovery, false means that the message
+// cannot be edited and the recovery has to be posted as usual.
+func (s *Slack) edit(ctx context.Context, channel, ts string, c *systemd.Change) bool {
+	if !s.editRecovery || c.Kind != systemd.Recovered {
+		return false
+	}
+	path := string(c.Unit.Path)
+	failure := s.annotator.Annotation(path, textAnnotation)
+	if failure == "" {
+		return false
+	}
+
+	msg := s.text(c) + causedBy(c) + inState(c) + suppressed(c)
+	res, err := s.post(ctx, "chat.update", &update{
+		Channel: channel,
+		TS:      ts,
+		Attachments: []attachment{{
+			Fallback: msg,
+			Color:    color(c),
+			Text:     truncate(strike(failure)+"\n"+msg, maxText),
+			MrkdwnIn: []string{"text"},
+		}},
+	})
+	if err != nil {
+		s.infof("cannot edit failure message of %s, reply instead: %s", c.Unit.Name, err)
+		return false
+	}
+	if err = s.annotate([]systemd.Change{*c}, res); err != nil {
+		s.infof("cannot forget failure message of %s: %s", c.Unit.Name, err)
+	}
+	return true
+}
+
+// strike strikes through every line of text,
+// slack doesn't support strikethrough spanning lines.
+func strike(text string) string {
+	lines := strings.Split(text, "\n")
+	for i, l := range lines {
+		if l != "" {
+			lines[i] = "~" + l + "~"
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// summary posts a single message listing units that are failed on startup.
+func (s *Slack) summary(ctx context.Context, channel string, changes []systemd.Change) error {
+	lines := make([]string, 0, len(changes)+1)
+	lines = append(lines, fmt.Sprintf("%d unit(s) failed at startup:", len(changes)))
+	for i := range changes {
+		lines = append(lines, "• "+changes[i].Unit.Name)
+	}
+	msg := truncate(strings.Join(lines, "\n"), maxText)
+
+	p := &payload{
+		Channel:  channel,
+		Username: s.username,
+		IconURL:  s.iconURL,
+		Attachments: []attachment{
+			{Fallback: msg, Color: "danger", Text: msg},
+		},
+	}
+	res, err := s.post(ctx, "chat.postMessage", p)
+	if isRejected(err) {
+		p.Text, p.Attachments = msg, nil
+		res, err = s.post(ctx, "chat.postMessage", p)
+	}
+	if err != nil {
+		return err
+	}
+	return s.annotate(changes, res)
+}
+
+// annotate remembers ts and channel of failure messages
+// and forgets them when units recover.
+func (s *Slack) annotate(changes []systemd.Change, res *response) error {
+	if s.annotator == nil || res.TS == "" {
+		return nil
+	}
+	for i := range changes {
+		c := &changes[i]
+		var ts, channel string
+		switch {
+		case c.EnteredFailed(), c.Kind == systemd.Startup:
+			ts, channel = res.TS, res.Channel
+		case c.Kind == systemd.Recovered:
+		default:
+			continue
+		}
+		path := string(c.Unit.Path)
+		if err := s.annotator.SetAnnotation(path, tsAnnotation, ts); err != nil {
+			return err
+		}
+		if err := s.annotator.SetAnnotation(path, channelAnnotation, channel); err != nil {
+			return err
+		}
+		if s.editRecovery {
+			if err := s.annotator.SetAnnotation(path, textAnnotation, ""); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isRejected reports whether err is caused by a malformed message.
+func isRejected(err error) bool {
+	switch err := err.(type) {
+	case *ResponseError:
+		return err.r.StatusCode == http.StatusBadRequest
+	case *APIError:
+		return err.Code == "invalid_attachments"
+	default:
+		return false
+	}
+}
+
+// text renders the message template with the change,
+// falling back to the default text when it fails.
+func (s *Slack) text(c *systemd.Change) string {
+	if s.tmpl == nil {
+		return text(c)
+	}
+	var b bytes.Buffer
+	if err := s.tmpl.Execute(&b, c); err != nil {
+		s.infof("template error: %s", err)
+		return text(c)
+	}
+	return b.String()
+}
+
+// unitLink renders the unit link template with the change,
+// it's empty when there's no template or it fails.
+func (s *Slack) unitLink(c *systemd.Change) string {
+	if s.link == nil {
+		return ""
+	}
+	var b bytes.Buffer
+	if err := s.link.Execute(&b, c); err != nil {
+		s.infof("unit link template error: %s", err)
+		return ""
+	}
+	u := strings.TrimSpace(b.String())
+	if u == "" {
+		return ""
+	}
+	return "\n<" + u + "|View dashboard>"
+}
+
+// text returns a human-readable description of the change.
+func text(c *systemd.Change) string {
+	switch {
+	case c.EnteredFailed() && c.Exit != nil && c.Exit.String() != "":
+		return fmt.Sprintf("%s failed, %s", c.Unit.Name, c.Exit)
+	case c.EnteredFailed():
+		return fmt.Sprintf("%s failed", c.Unit.Name)
+	case c.Kind == systemd.Startup:
+		return fmt.Sprintf("%s is failed at startup", c.Unit.Name)
+	case c.Kind == systemd.Flapping:
+		return fmt.Sprintf("%s is flapping, %d state changes in %s, now %s (%s)",
+			c.Unit.Name, c.Transitions, c.Window, c.Unit.ActiveState, c.Unit.SubState)
+	case c.Kind == systemd.Recovered:
+		return fmt.Sprintf("%s recovered after %s", c.Unit.Name, c.Downtime.Round(time.Second))
+	case c.Kind == systemd.Added:
+		return fmt.Sprintf("%s added, %s (%s)", c.Unit.Name, c.Unit.ActiveState, c.Unit.SubState)
+	case c.Kind == systemd.Removed && c.RemovalReason != "":
+		return fmt.Sprintf("%s removed, %s", c.Unit.Name, c.RemovalReason)
+	case c.Kind == systemd.Removed:
+		return fmt.Sprintf("%s removed", c.Unit.Name)
+	case c.Kind == systemd.Modified && c.Unit.LoadState == "not-found" && c.Old.LoadState != "not-found":
+		return fmt.Sprintf("%s is not found, it's removed or renamed", c.Unit.Name)
+	case c.Kind == systemd.Modified && len(c.ChangedProperties) != 0 &&
+		c.Unit.ActiveState == c.Old.ActiveState && c.Unit.SubState == c.Old.SubState:
+		return fmt.Sprintf("%s changed %s, %s (%s)", c.Unit.Name,
+			strings.Join(c.ChangedProperties, ", "), c.Unit.ActiveState, c.Unit.SubState)
+	case c.Kind == systemd.Modified && c.Restarted():
+		return fmt.Sprintf("%s restarted %d time(s), %d in total, %s (%s)", c.Unit.Name,
+			c.Unit.Restarts-c.Old.Restarts, c.Unit.Restarts, c.Unit.ActiveState, c.Unit.SubState)
+	default:
+		return fmt.Sprintf("%s is %s (%s)", c.Unit.Name, c.Unit.ActiveState, c.Unit.SubState)
+	}
+}
+
+// inState mentions how long the unit has been in the current state.
+func inState(c *systemd.Change) string {
+	if c.InState == 0 {
+		return ""
+	}
+	switch c.Unit.ActiveState {
+	case "active", "reloading":
+		return fmt.Sprintf(", %s for %s", c.Unit.ActiveState, humanize(c.InState))
+	default:
+		return fmt.Sprintf(", %s %s ago", c.Unit.ActiveState, humanize(c.InState))
+	}
+}
+
+// humanize formats d with at most two units, e.g. 3d4h, 5m12s or 40s.
+func humanize(d time.Duration) string {
+	d = d.Round(time.Second)
+	units := []struct {
+		d    time.Duration
+		name string
+	}{
+		{24 * time.Hour, "d"},
+		{time.Hour, "h"},
+		{time.Minute, "m"},
+		{time.Second, "s"},
+	}
+	for i, u := range units {
+		if d < u.d && i != len(units)-1 {
+			continue
+		}
+		s := fmt.Sprintf("%d%s", d/u.d, u.name)
+		if i != len(units)-1 {
+			if rest := d % u.d / units[i+1].d; rest != 0 {
+				s += fmt.Sprintf("%d%s", rest, units[i+1].name)
+			}
+		}
+		return s
+	}
+	return ""
+}
+
+// suppressed mentions the number of changes dropped by the rate limiter.
+func suppressed(c *systemd.Change) string {
+	if c.Suppressed == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (and %d more changes suppressed)", c.Suppressed)
+}
+
+// causedBy mentions failed dependencies of the unit.
+func causedBy(c *systemd.Change) string {
+	switch len(c.CausedBy) {
+	case 0:
+		return ""
+	case 1:
+		return fmt.Sprintf(", likely caused by %s which is also failed", c.CausedBy[0])
+	default:
+		return fmt.Sprintf(", likely caused by %s which are also failed", strings.Join(c.CausedBy, ", "))
+	}
+}
+
+// mib formats bytes in mebibytes.
+func mib(n uint64) string {
+	return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+}
+
+// cpuTime formats cpu nanoseconds in seconds.
+func cpuTime(ns uint64) string {
+	return fmt.Sprintf("%.2fs", time.Duration(ns).Seconds())
+}
+
+// journal formats the change journal lines as a code block.
+func journal(c *systemd.Change) string {
+	if len(c.Journal) == 0 {
+		return ""
+	}
+	// backticks in lines would terminate the code block
+	s := strings.Replace(strings.Join(c.Journal, "\n"), "```", "'''", -1)
+	return "\n```\n" + s + "\n```"
+}
+
+const (
+	// maxText is the number of characters of message text slack keeps,
+	// texts of all attachments of a message are kept within it too.
+	maxText = 40000
+
+	// maxAttachments is the maximum number of attachments in a message.
+	maxAttachments = 100
+)
+
+// truncatedMarker is appended to truncated texts.
+const truncatedMarker = "…(truncated)"
+
+// truncate cuts s to at most n characters including the marker,
+// an unterminated code block is closed after cutting.
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	// reserve room for the marker and the code block closing
+	keep := n - utf8.RuneCountInString(truncatedMarker) - len("\n```\n")
+	if keep < 0 {
+		keep = 0
+	}
+	i := 0
+	for j := range s {
+		if keep == 0 {
+			i = j
+			break
+		}
+		keep--
+	}
+	s = s[:i]
+	if strings.Count(s, "```")%2 == 1 {
+		return s + "\n```\n" + truncatedMarker
+	}
+	return s + truncatedMarker
+}
+
+// color returns the attachment color of the change.
+func color(c *systemd.Change) string {
+	switch {
+	case c.EnteredFailed(), c.Kind == systemd.Startup, c.Kind == systemd.Flapping:
+		return "danger"
+	case c.Kind == systemd.Recovered:
+		return "good"
+	default:
+		return "warning"
+	}
+}
+
+// post sends the payload to the webhook url or to the named web api
+// method when the token is used, retrying on temporary errors.
+func (s *Slack) post(ctx context.Context, method string, v interface{}) (*response, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	s.infof("payload: %s", b)
+	var res *response
+	if err = s.retry(ctx, func() error {
+		if s.limiter != nil {
+			if d := s.limiter.reserve(s.clock.Now()); d > 0 {
+				s.infof("global rate limit reached, posting in %s", d.Round(time.Millisecond))
+				if err := s.sleep(ctx, d); err != nil {
+					return err
+				}
+			}
+		}
+		var err error
+		if res, err = s.do(ctx, method, b); err != nil {
+			s.metrics.IncSlackErrors()
+			return err
+		}
+		s.metrics.IncSlackPosts()
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// retry calls fn until it succeeds, attempts are exhausted
+// or it fails with an error that's not worth retrying.
+func (s *Slack) retry(ctx context.Context, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if attempt >= s.maxAttempts || ctx.Err() != nil {
+			return err
+		}
+		d, ok := s.backoff(err, attempt)
+		if !ok {
+			return err
+		}
+
+		s.infof("attempt %d failed, retrying in %s: %s", attempt, d, err)
+		if err = s.sleep(ctx, d); err != nil {
+			return err
+		}
+	}
+}
+
+// sleep waits for d or until ctx is done.
+func (s *Slack) sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-s.clock.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// response is a web api response, webhooks respond with plain "ok".
+type response struct {
+	OK      bool   `json:"ok"`
+	Error   string `json:"error"`
+	Channel string `json:"channel"`
+	TS      string `json:"ts"`
+}
+
+// do makes a single request.
+func (s *Slack) do(ctx context.Context, method string, b []byte) (*response, error) {
+	s.mu.Lock()
+	url := s.webhookURL
+	s.mu.Unlock()
+	if s.token != "" {
+		url = s.apiURL + method
+	}
+	if s.dryRun {
+		s.infof("dry run, POST %s: %s", method, b)
+		return &response{OK: true}, nil
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	r, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+	s.infof("response: %s", r.Status)
+
+	if r.StatusCode >= 400 {
+		body, _ := ioutil.ReadAll(io.LimitReader(r.Body, 1024))
+		return nil, &ResponseError{r: r, body: body}
+	}
+	if s.token == "" {
+		return &response{OK: true}, nil
+	}
+
+	var res response
+	if err = json.NewDecoder(r.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	if !res.OK {
+		return nil, &APIError{Method: method, Code: res.Error}
+	}
+	return &res, nil
+}
+
+// backoff returns the delay before the next attempt,
+// false means that err is not worth retrying.
+func (s *Slack) backoff(err error, attempt int) (time.Duration, bool) {
+	switch rerr := err.(type) {
+	case *APIError:
+		return 0, false
+	case *ResponseError:
+		switch code := rerr.r.StatusCode; {
+		case code == http.StatusTooManyRequests:
+			if sec, err := strconv.Atoi(rerr.r.Header.Get("Retry-After")); err == nil && sec >= 0 {
+				return time.Duration(sec) * time.Second, true
+			}
+		case code >= 500:
+		default:
+			return 0, false
+		}
+	}
+
+	// exponential backoff with jitter in the [d/2, d] range
+	d := s.retryBase << uint(attempt-1)
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1)), true
+}
+
+// infof prints a debug message.
+func (s *Slack) infof(format string, v ...interface{}) {
+	if s.logger != nil {
+		s.logger.Printf(format, v...)
+	}
+}
+
+// APIError is returned when web api responds with ok set to false.
+type APIError struct {
+	Method string
+	Code   string
+}
+
+// Error is a string representation.
+func (e *APIError) Error() string {
+	return fmt.Sprintf("slack %s: %s", e.Method, e.Code)
+}
+
+// ResponseError returned when response code is more than 400.
+type ResponseError struct {
+	r    *http.Response
+	body []byte
+}
+
+// StatusCode is the response status code.
+func (r *ResponseError) StatusCode() int {
+	return r.r.StatusCode
+}
+
+// Error is a string representation.
+func (r *ResponseError) Error() string {
+	if len(r.body) == 0 {
+		return fmt.Sprintf("slack responded with %d status code", r.r.StatusCode)
+	}
+	return fmt.Sprintf("slack responded with %d status code: %s", r.r.StatusCode, r.body)
+}
@@ -0,0 +1,889 @@
+package slack
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/amenzhinsky/systemd-slack/clock"
+	"github.com/amenzhinsky/systemd-slack/systemd"
+	"github.com/coreos/go-systemd/dbus"
+	godbus "github.com/godbus/dbus"
+)
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Body.Close()
+
+		for _, s := range []string{"foo", "#bar", "bar"} {
+			if !strings.Contains(string(b), s) {
+				t.Errorf("request expected to include %q", s)
+			}
+		}
+	}))
+	defer ts.Close()
+
+	s, err := New(ts.URL,
+		WithUsername("foo"),
+		WithChannel("#bar"),
+		WithLogger(log.New(ioutil.Discard, "", 0)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Danger("bar"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	t.Parallel()
+
+	var got []payload
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p payload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, p)
+
+		// reject attachments to test the fallback
+		if len(p.Attachments) != 0 {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer ts.Close()
+
+	s, err := New(ts.URL, WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Notify(context.Background(), []systemd.Change{{
+		Kind: systemd.Modified,
+		Unit: systemd.Unit{UnitStatus: dbus.UnitStatus{
+			Name:        "nginx.service",
+			ActiveState: "failed",
+			SubState:    "failed",
+			LoadState:   "loaded",
+		}},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("requests = %d, want 2", len(got))
+	}
+	if a := got[0].Attachments[0]; a.Color != "danger" || len(a.Fields) != 4 {
+		t.Errorf("color = %q, fields = %d, want %q and 4", a.Color, len(a.Fields), "danger")
+	}
+	if want := "nginx.service failed"; got[1].Text != want {
+		t.Errorf("text = %q, want %q", got[1].Text, want)
+	}
+}
+
+func TestNotifyBatch(t *testing.T) {
+	t.Parallel()
+
+	var got []int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p payload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, len(p.Attachments))
+	}))
+	defer ts.Close()
+
+	s, err := New(ts.URL, WithLogger(nil), WithMaxBatch(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Notify(context.Background(), make([]systemd.Change, 5)); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []int{2, 2, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("attachments per message = %v, want %v", got, want)
+	}
+}
+
+func TestNotifyRetry(t *testing.T) {
+	t.Parallel()
+
+	var attempts int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		switch attempts {
+		case 1:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case 2:
+			w.WriteHeader(http.StatusBadGateway)
+		case 3:
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("invalid_token"))
+		}
+	}))
+	defer ts.Close()
+
+	s, err := New(ts.URL, WithLogger(nil), WithRetry(5, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Notify(context.Background(), make([]systemd.Change, 1))
+	if err == nil || !strings.Contains(err.Error(), "invalid_token") {
+		t.Fatalf("err = %v, want it to include the response body", err)
+	}
+	if attempts != 3 {
+		t.Errorf("attempts = %d, want 3", attempts)
+	}
+}
+
+func TestHTTPTimeout(t *testing.T) {
+	t.Parallel()
+
+	var attempts int32
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			<-done
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+	defer close(done)
+
+	s, err := New(ts.URL,
+		WithLogger(nil),
+		WithRetry(2, time.Millisecond),
+		WithHTTPTimeout(50*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Warning("warning"); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&attempts); n != 2 {
+		t.Errorf("attempts = %d, want 2", n)
+	}
+}
+
+func TestNewWithToken(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/chat.postMessage" {
+			t.Errorf("path = %q, want %q", r.URL.Path, "/chat.postMessage")
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Bearer xoxb-token" {
+			t.Errorf("authorization = %q, want %q", auth, "Bearer xoxb-token")
+		}
+		w.Write([]byte(`{"ok":false,"error":"channel_not_found"}`))
+	}))
+	defer ts.Close()
+
+	s, err := NewWithToken("xoxb-token", WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.apiURL = ts.URL + "/"
+
+	err = s.Notify(context.Background(), make([]systemd.Change, 1))
+	if aerr, ok := err.(*APIError); !ok || aerr.Code != "channel_not_found" {
+		t.Fatalf("err = %v, want channel_not_found api error", err)
+	}
+}
+
+func TestResolveChannels(t *testing.T) {
+	t.Parallel()
+
+	var calls int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.URL.Path != "/conversations.list" {
+			t.Errorf("path = %q, want %q", r.URL.Path, "/conversations.list")
+		}
+		if r.URL.Query().Get("cursor") == "" {
+			w.Write([]byte(`{"ok":true,"channels":[{"id":"C0000000001","name":"general","is_member":true}],` +
+				`"response_metadata":{"next_cursor":"next"}}`))
+			return
+		}
+		w.Write([]byte(`{"ok":true,"channels":[{"id":"C0000000002","name":"alerts","is_member":true},` +
+			`{"id":"C0000000003","name":"random","is_member":false}]}`))
+	}))
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		channel, want, err string
+		calls              int
+	}{
+		{"#alerts", "C0000000002", "", 2},
+		{"general", "C0000000001", "", 1},
+		{"C0000000009", "C0000000009", "", 0},
+		{"random", "", "not a member", 2},
+		{"missing", "", "not found", 2},
+	} {
+		calls = 0
+		s, err := NewWithToken("xoxb-token", WithLogger(nil), WithChannel(tc.channel))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.apiURL = ts.URL + "/"
+
+		err = s.ResolveChannels(context.Background())
+		switch {
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%s: err = %v, want %q", tc.channel, err, tc.err)
+		case tc.err == "" && err != nil:
+			t.Errorf("%s: err = %v", tc.channel, err)
+		case tc.err == "" && s.channel != tc.want:
+			t.Errorf("%s: channel = %q, want %q", tc.channel, s.channel, tc.want)
+		}
+		if calls != tc.calls {
+			t.Errorf("%s: calls = %d, want %d", tc.channel, calls, tc.calls)
+		}
+	}
+}
+
+func TestResolveChannelsRoutes(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok":true,"channels":[{"id":"C0000000001","name":"general","is_member":true},` +
+			`{"id":"C0000000002","name":"db","is_member":true},{"id":"C0000000003","name":"random","is_member":false}]}`))
+	}))
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		routes []string
+		err    string
+	}{
+		{[]string{"#db", "C0000000009"}, ""},
+		{[]string{"db", "random"}, "not a member"},
+		{[]string{"missing"}, "not found"},
+	} {
+		s, err := NewWithToken("xoxb-token", WithLogger(nil), WithChannel("general"),
+			WithRouter(RouteByUnit([]UnitRoute{{Pattern: "db.service", Channel: "#db"}})))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.apiURL = ts.URL + "/"
+
+		err = s.ResolveChannels(context.Background(), tc.routes...)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%v: err = %v, want %q", tc.routes, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: err = %v", tc.routes, err)
+		}
+		for name, want := range map[string]string{"db.service": "C0000000002", "a.service": "C0000000001"} {
+			c := &systemd.Change{Unit: systemd.Unit{UnitStatus: dbus.UnitStatus{Name: name}}}
+			if got := s.route(c); got != want {
+				t.Errorf("route(%s) = %q, want %q", name, got, want)
+			}
+		}
+	}
+}
+
+func TestResolveChannelsUnavailable(t *testing.T) {
+	t.Parallel()
+
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer ts.Close()
+
+	s, err := NewWithToken("xoxb-token", WithLogger(nil), WithChannel("#alerts"), WithRetry(3, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.apiURL = ts.URL + "/"
+
+	// startup isn't blocked by slack being unavailable
+	if err = s.ResolveChannels(context.Background(), "db"); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Errorf("calls = %d, want 3 attempts", n)
+	}
+	if s.channel != "#alerts" {
+		t.Errorf("channel = %q, want the name as is", s.channel)
+	}
+}
+
+// annotator is an in-memory Annotator implementation.
+type annotator map[string]string
+
+func (a annotator) Annotation(path, key string) string {
+	return a[path+"/"+key]
+}
+
+func (a annotator) SetAnnotation(path, key, value string) error {
+	a[path+"/"+key] = value
+	return nil
+}
+
+func TestNotifyThread(t *testing.T) {
+	t.Parallel()
+
+	var got []payload
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p payload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, p)
+		w.Write([]byte(`{"ok":true,"ts":"1.000"}`))
+	}))
+	defer ts.Close()
+
+	a := annotator{}
+	s, err := NewWithToken("xoxb-token", WithLogger(nil), WithAnnotator(a))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.apiURL = ts.URL + "/"
+
+	failed := systemd.Unit{UnitStatus: dbus.UnitStatus{Name: "foo.service", Path: "/foo", ActiveState: "failed"}}
+	active := systemd.Unit{UnitStatus: dbus.UnitStatus{Name: "foo.service", Path: "/foo", ActiveState: "active"}}
+	for _, c := range []systemd.Change{
+		{Kind: systemd.Modified, Unit: failed, Old: active},
+		{Kind: systemd.Recovered, Unit: active, Old: failed},
+		{Kind: systemd.Modified, Unit: active, Old: active},
+	} {
+		if err = s.Notify(context.Background(), []systemd.Change{c}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, want := range []string{"", "1.000", ""} {
+		if got[i].ThreadTS != want {
+			t.Errorf("message %d thread_ts = %q, want %q", i, got[i].ThreadTS, want)
+		}
+	}
+}
+
+func TestNotifyEdit(t *testing.T) {
+	t.Parallel()
+
+	type request struct {
+		method string
+		payload
+		TS string `json:"ts"`
+	}
+	var got []request
+	var denyUpdate bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := request{method: strings.TrimPrefix(r.URL.Path, "/")}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, req)
+		if req.method == "chat.update" && denyUpdate {
+			w.Write([]byte(`{"ok":false,"error":"cant_update_message"}`))
+			return
+		}
+		w.Write([]byte(`{"ok":true,"channel":"C1","ts":"1.000"}`))
+	}))
+	defer ts.Close()
+
+	s, err := NewWithToken("xoxb-token", WithLogger(nil), WithAnnotator(annotator{}),
+		WithEditOnRecovery(), WithRetry(1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.apiURL = ts.URL + "/"
+
+	unit := func(name, state string) systemd.Unit {
+		return systemd.Unit{UnitStatus: dbus.UnitStatus{Name: name, Path: godbus.ObjectPath("/" + name), ActiveState: state}}
+	}
+	failed := func(name string) systemd.Change {
+		return systemd.Change{Kind: systemd.Modified, Unit: unit(name, "failed"), Old: unit(name, "active")}
+	}
+	recovered := func(name string) systemd.Change {
+		return systemd.Change{Kind: systemd.Recovered, Unit: unit(name, "active"), Old: unit(name, "failed")}
+	}
+	for _, batch := range [][]systemd.Change{
+		{failed("a.service")},
+		{recovered("a.service")},
+		{failed("a.service"), failed("b.service")}, // a multi-failure message cannot be edited
+		{recovered("a.service")},
+		{failed("c.service")},
+		nil, // deny editing
+		{recovered("c.service")},
+	} {
+		if batch == nil {
+			denyUpdate = true
+			continue
+		}
+		if err = s.Notify(context.Background(), batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []string{
+		"chat.postMessage", "chat.update",
+		"chat.postMessage", "chat.postMessage",
+		"chat.postMessage", "chat.update", "chat.postMessage",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("requests = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i].method != want[i] {
+			t.Errorf("request %d = %s, want %s", i, got[i].method, want[i])
+		}
+	}
+	if u := got[1]; u.Channel != "C1" || u.TS != "1.000" || len(u.Attachments) != 1 ||
+		u.Attachments[0].Color != "good" ||
+		!strings.HasPrefix(u.Attachments[0].Text, "~a.service failed~\n") {
+		t.Errorf("update = %+v, want struck through failure in C1 1.000", u)
+	}
+	if got[3].ThreadTS != "1.000" || got[6].ThreadTS != "1.000" {
+		t.Errorf("thread_ts = %q, %q, want recoveries replied in threads", got[3].ThreadTS, got[6].ThreadTS)
+	}
+}
+
+func TestNotifyStartup(t *testing.T) {
+	t.Parallel()
+
+	var got []payload
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p payload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, p)
+	}))
+	defer ts.Close()
+
+	s, err := New(ts.URL, WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := func(name string) systemd.Unit {
+		return systemd.Unit{UnitStatus: dbus.UnitStatus{Name: name, ActiveState: "failed"}}
+	}
+	if err = s.Notify(context.Background(), []systemd.Change{
+		{Kind: systemd.Startup, Unit: failed("a.service")},
+		{Kind: systemd.Startup, Unit: failed("b.service")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 1 || len(got[0].Attachments) != 1 {
+		t.Fatalf("payloads = %v, want a single summary", got)
+	}
+	for _, name := range []string{"a.service", "b.service"} {
+		if !strings.Contains(got[0].Attachments[0].Text, name) {
+			t.Errorf("summary doesn't mention %s", name)
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("request is sent in dry run mode")
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	s, err := New(ts.URL, WithLogger(log.New(&buf, "", 0)), WithDryRun())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Warning("warning"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `"text":"warning"`) {
+		t.Errorf("log = %q, want it to contain the payload", buf.String())
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	t.Parallel()
+
+	if _, err := New("http://localhost", WithTemplate("{{.Unit.Name")); err == nil {
+		t.Fatal("expected an error on a malformed template")
+	}
+
+	s, err := New("http://localhost",
+		WithTemplate("{{.Kind}}: {{.Unit.Name}} {{.Old.ActiveState}} -> {{.Unit.ActiveState}}"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &systemd.Change{Kind: systemd.Modified}
+	c.Unit.Name = "nginx.service"
+	c.Unit.ActiveState = "failed"
+	c.Old.ActiveState = "active"
+	if got, want := s.text(c), "modified: nginx.service active -> failed"; got != want {
+		t.Errorf("text = %q, want %q", got, want)
+	}
+}
+
+func TestUnitLink(t *testing.T) {
+	t.Parallel()
+
+	if _, err := New("http://localhost", WithUnitLink("{{.Unit.Name")); err == nil {
+		t.Fatal("expected an error on a malformed link template")
+	}
+
+	s, err := New("http://localhost", WithLogger(nil),
+		WithUnitLink(`{{if ne .Unit.Name "skip.service"}}https://grafana/d/units?var-unit={{query .Unit.Name}}{{end}}`),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"nginx@a b.service": "\n<https://grafana/d/units?var-unit=nginx%40a+b.service|View dashboard>",
+		"skip.service":      "",
+	} {
+		c := &systemd.Change{Kind: systemd.Modified}
+		c.Unit.Name = name
+		if got := s.unitLink(c); got != want {
+			t.Errorf("unitLink(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestNotifyRoute(t *testing.T) {
+	t.Parallel()
+
+	var got []payload
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p payload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, p)
+		w.Write([]byte(`{"ok":true,"ts":"1.000","channel":"C1"}`))
+	}))
+	defer ts.Close()
+
+	s, err := NewWithToken("xoxb-token", WithLogger(nil), WithAnnotator(annotator{}),
+		WithRouter(RouteByKind(map[string]string{"failed": "alerts", "modified": "info"})),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.apiURL = ts.URL + "/"
+
+	failed := systemd.Unit{UnitStatus: dbus.UnitStatus{Name: "foo.service", Path: "/foo", ActiveState: "failed"}}
+	active := systemd.Unit{UnitStatus: dbus.UnitStatus{Name: "foo.service", Path: "/foo", ActiveState: "active"}}
+	other := systemd.Unit{UnitStatus: dbus.UnitStatus{Name: "bar.service", Path: "/bar", ActiveState: "active"}}
+	for _, c := range []systemd.Change{
+		{Kind: systemd.Modified, Unit: failed, Old: active},
+		{Kind: systemd.Modified, Unit: other, Old: other},
+		{Kind: systemd.Added, Unit: other},
+		{Kind: systemd.Recovered, Unit: active, Old: failed},
+	} {
+		if err = s.Notify(context.Background(), []systemd.Change{c}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, want := range []string{"alerts", "info", s.channel, "C1"} {
+		if got[i].Channel != want {
+			t.Errorf("message %d channel = %q, want %q", i, got[i].Channel, want)
+		}
+	}
+}
+
+func TestRouteByUnit(t *testing.T) {
+	t.Parallel()
+
+	route := FirstRoute(
+		RouteByUnit([]UnitRoute{{"foo-db.service", "dba"}, {"foo-*.service", "team-foo"}}),
+		RouteByKind(map[string]string{"failed": "alerts"}),
+	)
+	for _, tc := range []struct {
+		name   string
+		active string
+		want   string
+	}{
+		{"foo-db.service", "failed", "dba"},
+		{"foo-web.service", "failed", "team-foo"},
+		{"bar.service", "failed", "alerts"},
+		{"bar.service", "active", ""},
+	} {
+		c := &systemd.Change{
+			Kind: systemd.Modified,
+			Unit: systemd.Unit{UnitStatus: dbus.UnitStatus{Name: tc.name, ActiveState: tc.active}},
+		}
+		if got := route(c); got != tc.want {
+			t.Errorf("route(%s %s) = %q, want %q", tc.name, tc.active, got, tc.want)
+		}
+	}
+}
+
+func TestCausedBy(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		causes []string
+		want   string
+	}{
+		{nil, ""},
+		{[]string{"db.service"}, ", likely caused by db.service which is also failed"},
+		{[]string{"a.mount", "db.service"}, ", likely caused by a.mount, db.service which are also failed"},
+	} {
+		if got := causedBy(&systemd.Change{CausedBy: tc.causes}); got != tc.want {
+			t.Errorf("causedBy(%v) = %q, want %q", tc.causes, got, tc.want)
+		}
+	}
+}
+
+func TestBucket(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1500000000, 0)
+	b := newBucket(2)
+	for i, want := range []time.Duration{0, 0, 30 * time.Second, time.Minute} {
+		if d := b.reserve(now); d != want {
+			t.Errorf("reserve #%d = %s, want %s", i, d, want)
+		}
+	}
+
+	// the bucket is refilled but not over its size
+	now = now.Add(time.Hour)
+	for i, want := range []time.Duration{0, 0, 30 * time.Second} {
+		if d := b.reserve(now); d != want {
+			t.Errorf("reserve #%d after refill = %s, want %s", i, d, want)
+		}
+	}
+}
+
+func TestClock(t *testing.T) {
+	t.Parallel()
+
+	var attempts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 2 {
+			w.Header().Set("Retry-After", "30")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	clock := clock.NewFake()
+	s, err := New(ts.URL, WithLogger(nil), WithClock(clock),
+		WithGlobalRateLimit(1), WithRetry(2, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Warning("first"); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Waits = make(chan time.Duration, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Warning("second")
+	}()
+
+	// the rate limit, Retry-After and the rate limit again
+	var waits []time.Duration
+	for {
+		select {
+		case d := <-clock.Waits:
+			waits = append(waits, d)
+			clock.Advance(d)
+			continue
+		case err = <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Warning is blocked")
+		}
+		break
+	}
+	if want := []time.Duration{time.Minute, 30 * time.Second, 30 * time.Second}; !reflect.DeepEqual(waits, want) {
+		t.Errorf("waits = %v, want %v", waits, want)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	t.Parallel()
+
+	long := strings.Repeat("ж", 100)
+	for _, tc := range []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"short", 40, "short"},
+		{long, 100, long},
+		{long, 25, strings.Repeat("ж", 8) + truncatedMarker},
+		{"failed\n```\n" + long + "\n```", 30, "failed\n```\n" + strings.Repeat("ж", 2) + "\n```\n" + truncatedMarker},
+	} {
+		got := truncate(tc.s, tc.n)
+		if got != tc.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", tc.s, tc.n, got, tc.want)
+		}
+		if n := utf8.RuneCountInString(got); n > tc.n {
+			t.Errorf("truncate(%q, %d) is %d characters long", tc.s, tc.n, n)
+		}
+	}
+}
+
+func TestHumanize(t *testing.T) {
+	t.Parallel()
+
+	for d, want := range map[time.Duration]string{
+		400 * time.Millisecond:           "0s",
+		40 * time.Second:                 "40s",
+		5*time.Minute + 12*time.Second:   "5m12s",
+		2 * time.Hour:                    "2h",
+		3*24*time.Hour + 4*time.Hour + 1: "3d4h",
+	} {
+		if got := humanize(d); got != want {
+			t.Errorf("humanize(%s) = %q, want %q", d, got, want)
+		}
+	}
+}
+
+func TestTest(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no_service", http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	s, err := New(ts.URL, WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Test(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "mistyped or revoked") {
+		t.Fatalf("err = %v, want a bad webhook error", err)
+	}
+	var rerr *ResponseError
+	if !errors.As(err, &rerr) || rerr.StatusCode() != http.StatusNotFound {
+		t.Errorf("err = %v, want a 404 response error", err)
+	}
+}
+
+func TestMessage(t *testing.T) {
+	t.Parallel()
+
+	var p payload
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Error(err)
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	s, err := New(ts.URL, WithLogger(nil), WithChannel("ops"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Message(context.Background(), "2 changes suppressed"); err != nil {
+		t.Fatal(err)
+	}
+	if p.Text != "2 changes suppressed" || p.Channel != "ops" || len(p.Attachments) != 0 {
+		t.Errorf("payload = %+v, want a plain message", p)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	t.Parallel()
+
+	var host string
+	ps := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+		w.Write([]byte("ok"))
+	}))
+	defer ps.Close()
+
+	s, err := New("http://hooks.slack.invalid/services/x",
+		WithLogger(nil), WithProxy(ps.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Warning("warning"); err != nil {
+		t.Fatal(err)
+	}
+	if host != "hooks.slack.invalid" {
+		t.Errorf("proxied host = %q, want %q", host, "hooks.slack.invalid")
+	}
+
+	for _, u := range []string{"localhost:3128", "http://%zz"} {
+		if _, err = New("http://localhost", WithProxy(u)); err == nil {
+			t.Errorf("New(WithProxy(%q)) expected an error", u)
+		}
+	}
+}
+
+// acknowledger records acknowledged unit names.
+type acknowledger []string
+
+func (a *acknowledger) Ack(changes []systemd.Change) error {
+	for _, c := range changes {
+		*a = append(*a, c.Unit.Name)
+	}
+	return nil
+}
+
+func TestNotifyAck(t *testing.T) {
+	t.Parallel()
+
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests++; requests > 1 {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer ts.Close()
+
+	var a acknowledger
+	s, err := New(ts.URL, WithLogger(nil), WithMaxBatch(1), WithAcknowledger(&a))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes := make([]systemd.Change, 2)
+	changes[0].Unit.Name = "a.service"
+	changes[1].Unit.Name = "b.service"
+	if err = s.Notify(context.Background(), changes); err == nil {
+		t.Fatal("expected an error")
+	}
+	if want := (acknowledger{"a.service"}); !reflect.DeepEqual(a, want) {
+		t.Errorf("acknowledged = %v, want %v", a, want)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/amenzhinsky/systemd-slack/systemd"
+)
+
+// snapshotter is implemented by *systemd.Systemd.
+type snapshotter interface {
+	Snapshot() []systemd.Unit
+	LastPoll() time.Time
+	LastChange() time.Time
+}
+
+// unitStatus is a status page row.
+type unitStatus struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	LoadState   string    `json:"load_state"`
+	ActiveState string    `json:"active_state"`
+	SubState    string    `json:"sub_state"`
+	ChangedAt   time.Time `json:"changed_at"`
+	FailedAt    time.Time `json:"failed_at"`
+}
+
+// stateGroup is a list of units in the same active state.
+type stateGroup struct {
+	State string       `json:"state"`
+	Units []unitStatus `json:"units"`
+}
+
+// statusPage is the data rendered by the status handler.
+type statusPage struct {
+	LastPoll   time.Time    `json:"last_poll"`
+	LastChange time.Time    `json:"last_change"`
+	Groups     []stateGroup `json:"groups"`
+}
+
+// newStatusPage groups units by their active states,
+// failed units go first and the rest of groups are sorted by name.
+func newStatusPage(units []systemd.Unit, lastPoll, lastChange time.Time) *statusPage {
+	m := map[string][]unitStatus{}
+	for _, u := range units {
+		m[u.ActiveState] = append(m[u.ActiveState], unitStatus{
+			Name:        u.Name,
+			Description: u.Description,
+			LoadState:   u.LoadState,
+			ActiveState: u.ActiveState,
+			SubState:    u.SubState,
+			ChangedAt:   u.ChangedAt,
+			FailedAt:    u.FailedAt,
+		})
+	}
+
+	p := &statusPage{LastPoll: lastPoll, LastChange: lastChange, Groups: make([]stateGroup, 0, len(m))}
+	for state, units := range m {
+		p.Groups = append(p.Groups, stateGroup{State: state, Units: units})
+	}
+	sort.Slice(p.Groups, func(i, j int) bool {
+		a, b := p.Groups[i].State, p.Groups[j].State
+		if (a == "failed") != (b == "failed") {
+			return a == "failed"
+		}
+		return a < b
+	})
+	return p
+}
+
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"since": func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format(time.RFC3339)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>systemd units</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { padding: 2px 8px; text-align: left; }
+h2.failed { color: #d00000; }
+</style>
+</head>
+<body>
+<p>Last poll: {{since .LastPoll}}, last change: {{since .LastChange}}</p>
+{{range .Groups}}
+<h2 class="{{.State}}">{{.State}} ({{len .Units}})</h2>
+<table>
+<tr><th>Unit</th><th>Sub state</th><th>Load state</th><th>Last changed</th><th>Failed at</th><th>Description</th></tr>
+{{range .Units}}<tr><td>{{.Name}}</td><td>{{.SubState}}</td><td>{{.LoadState}}</td><td>{{since .ChangedAt}}</td><td>{{since .FailedAt}}</td><td>{{.Description}}</td></tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
+
+// status renders the current state as an html page,
+// or as json when it's requested with ?format=json or the Accept header.
+func status(sd snapshotter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := newStatusPage(sd.Snapshot(), sd.LastPoll(), sd.LastChange())
+		if r.URL.Query().Get("format") == "json" ||
+			strings.Contains(r.Header.Get("Accept"), "application/json") {
+			w.Header().Set("Content-Type", "application/json")
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			enc.Encode(p)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		statusTemplate.Execute(w, p)
+	})
+}
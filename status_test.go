@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/systemd-slack/systemd"
+	"github.com/coreos/go-systemd/dbus"
+)
+
+// fakeSnapshotter returns the same units every time.
+type fakeSnapshotter []systemd.Unit
+
+func (s fakeSnapshotter) Snapshot() []systemd.Unit { return s }
+func (s fakeSnapshotter) LastPoll() time.Time      { return time.Unix(1500000000, 0) }
+func (s fakeSnapshotter) LastChange() time.Time    { return time.Unix(1400000000, 0) }
+
+func unit(name, active, sub string) systemd.Unit {
+	return systemd.Unit{UnitStatus: dbus.UnitStatus{
+		Name: name, LoadState: "loaded", ActiveState: active, SubState: sub,
+	}}
+}
+
+func TestStatus(t *testing.T) {
+	t.Parallel()
+
+	sd := fakeSnapshotter{
+		unit("a.service", "active", "running"),
+		unit("b.service", "inactive", "dead"),
+		unit("c.service", "failed", "failed"),
+		unit("d.service", "active", "exited"),
+	}
+	sd[2].ChangedAt = time.Unix(1450000000, 0)
+
+	w := httptest.NewRecorder()
+	status(sd).ServeHTTP(w, httptest.NewRequest("GET", "/status?format=json", nil))
+	var p statusPage
+	if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, g := range p.Groups {
+		got = append(got, g.State)
+	}
+	if strings.Join(got, ",") != "failed,active,inactive" {
+		t.Errorf("groups = %v, want failed,active,inactive", got)
+	}
+	if !p.LastChange.Equal(time.Unix(1400000000, 0)) {
+		t.Errorf("last change = %s, want the watcher's one", p.LastChange)
+	}
+	if u := p.Groups[0].Units[0]; !u.ChangedAt.Equal(time.Unix(1450000000, 0)) {
+		t.Errorf("c.service changed at %s, want the time the watcher has seen it", u.ChangedAt)
+	}
+	if len(p.Groups[1].Units) != 2 {
+		t.Errorf("active units = %v, want 2 units", p.Groups[1].Units)
+	}
+
+	w = httptest.NewRecorder()
+	status(sd).ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+	body := w.Body.String()
+	if i, j := strings.Index(body, "c.service"), strings.Index(body, "a.service"); i < 0 || j < 0 || i > j {
+		t.Errorf("html = %q, want failed c.service before a.service", body)
+	}
+}
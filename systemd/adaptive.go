@@ -0,0 +1,26 @@
+package systemd
+
+import "time"
+
+// adaptiveInterval doubles interval for every consecutive poll without
+// changes up to max, it's interval when adaptive polling is disabled.
+// The watchdog timeout caps it too, so keep-alive pings aren't missed.
+func (sd *Systemd) adaptiveInterval(interval, max time.Duration) time.Duration {
+	if max <= interval {
+		return interval
+	}
+	if sd.watchdog != 0 && max > sd.watchdog/2 {
+		max = sd.watchdog / 2
+	}
+	d := interval
+	for i := 0; i < sd.idlePolls && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if d < interval {
+		d = interval
+	}
+	return d
+}
@@ -0,0 +1,83 @@
+package systemd
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/systemd-slack/clock"
+	"github.com/coreos/go-systemd/dbus"
+)
+
+func TestAdaptiveInterval(t *testing.T) {
+	t.Parallel()
+
+	sd := &Systemd{}
+	for _, tc := range []struct {
+		idle     int
+		max      time.Duration
+		watchdog time.Duration
+		want     time.Duration
+	}{
+		{0, 5 * time.Second, 0, time.Second},
+		{1, 5 * time.Second, 0, 2 * time.Second},
+		{2, 5 * time.Second, 0, 4 * time.Second},
+		{3, 5 * time.Second, 0, 5 * time.Second},
+		{1000, 5 * time.Second, 0, 5 * time.Second},
+		{3, 0, 0, time.Second},
+		{3, 5 * time.Second, 6 * time.Second, 3 * time.Second},
+		{3, 5 * time.Second, time.Second, time.Second},
+	} {
+		sd.idlePolls, sd.watchdog = tc.idle, tc.watchdog
+		if d := sd.adaptiveInterval(time.Second, tc.max); d != tc.want {
+			t.Errorf("adaptiveInterval(idle=%d, max=%s, watchdog=%s) = %s, want %s",
+				tc.idle, tc.max, tc.watchdog, d, tc.want)
+		}
+	}
+}
+
+func TestNextAdaptiveInterval(t *testing.T) {
+	clock := clock.NewFake()
+	clock.Waits = make(chan time.Duration, 1)
+	running := []dbus.UnitStatus{status("a.service", "active", "running")}
+	sd := newFake(t, [][]dbus.UnitStatus{
+		running, running, running, running, running,
+		{status("a.service", "failed", "failed")},
+	}, WithAdaptiveInterval(5*time.Second), WithClock(clock))
+	sd.interval = time.Second
+	sd.jitter = 0
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := sd.Next(context.Background())
+		done <- err
+	}()
+
+	var waits []time.Duration
+	for {
+		select {
+		case d := <-clock.Waits:
+			waits = append(waits, d)
+			clock.Advance(d)
+			continue
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Next is blocked")
+		}
+		break
+	}
+
+	// the interval doubles on every idle poll including
+	// the initial one up to the maximum
+	want := []time.Duration{2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second, 5 * time.Second}
+	if !reflect.DeepEqual(waits, want) {
+		t.Errorf("waits = %v, want %v", waits, want)
+	}
+	if sd.idlePolls != 0 {
+		t.Errorf("idle polls = %d after a change, want 0", sd.idlePolls)
+	}
+}
@@ -0,0 +1,26 @@
+package systemd
+
+import (
+	"context"
+	"time"
+)
+
+// now returns the current time of the clock.
+func (sd *Systemd) now() time.Time {
+	return sd.clock.Now()
+}
+
+// after returns a channel receiving the time once d has elapsed.
+func (sd *Systemd) after(d time.Duration) <-chan time.Time {
+	return sd.clock.After(d)
+}
+
+// sleep pauses the current goroutine for d or until ctx is done.
+func (sd *Systemd) sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-sd.after(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
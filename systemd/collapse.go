@@ -0,0 +1,21 @@
+package systemd
+
+import "github.com/coreos/go-systemd/dbus"
+
+// collapse keeps only the last observation of every unit path in place
+// of its first one, so a unit listed several times is diffed once,
+// between the stored state and the final one. units is modified in place.
+func collapse(units []dbus.UnitStatus) []dbus.UnitStatus {
+	index := make(map[string]int, len(units))
+	n := 0
+	for _, s := range units {
+		if i, ok := index[string(s.Path)]; ok {
+			units[i] = s
+			continue
+		}
+		index[string(s.Path)] = n
+		units[n] = s
+		n++
+	}
+	return units[:n]
+}
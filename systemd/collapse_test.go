@@ -0,0 +1,33 @@
+package systemd
+
+import (
+	"testing"
+
+	"github.com/coreos/go-systemd/dbus"
+)
+
+func TestCollapse(t *testing.T) {
+	t.Parallel()
+
+	units := collapse([]dbus.UnitStatus{
+		status("a.service", "active", "running"),
+		status("b.service", "active", "running"),
+		status("a.service", "failed", "failed"),
+		status("c.service", "active", "running"),
+		status("a.service", "activating", "start"),
+	})
+	var got []string
+	for _, s := range units {
+		got = append(got, s.Name+" "+s.ActiveState)
+	}
+	want := []string{"a.service activating", "b.service active", "c.service active"}
+	if len(got) != len(want) {
+		t.Fatalf("units = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("units = %v, want %v", got, want)
+			break
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package systemd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/coreos/go-systemd/dbus"
+	godbus "github.com/godbus/dbus"
+)
+
+// conn is needed to mock systemd connection in tests
+type conn interface {
+	ListUnits() ([]dbus.UnitStatus, error)
+	Close()
+}
+
+// nameLister is implemented by connections that can list units by names.
+type nameLister interface {
+	ListUnitsByNames(units []string) ([]dbus.UnitStatus, error)
+}
+
+// subscriber is implemented by connections that can push unit changes.
+type subscriber interface {
+	Subscribe() error
+	SetSubStateSubscriber(updateCh chan<- *dbus.SubStateUpdate, errCh chan<- error)
+}
+
+// propertyGetter is implemented by connections that can read unit properties.
+type propertyGetter interface {
+	GetUnitTypeProperty(unit, unitType, name string) (*dbus.Property, error)
+}
+
+// fetchRestarts returns NRestarts of service units by their paths,
+// units whose property cannot be read are skipped.
+func (sd *Systemd) fetchRestarts(units []dbus.UnitStatus) map[string]uint32 {
+	pg, ok := sd.conn.(propertyGetter)
+	if !ok {
+		return nil
+	}
+	// the map is reused between polls, it's consumed by poll only
+	if sd.restartsBuf == nil {
+		sd.restartsBuf = make(map[string]uint32, len(units))
+	}
+	m := sd.restartsBuf
+	clear(m)
+	for _, u := range units {
+		if !strings.HasSuffix(u.Name, ".service") {
+			continue
+		}
+		p, err := pg.GetUnitTypeProperty(u.Name, "Service", "NRestarts")
+		if err != nil {
+			sd.warn("cannot read NRestarts", "unit", u.Name, "error", err)
+			continue
+		}
+		if n, ok := p.Value.Value().(uint32); ok {
+			m[string(u.Path)] = n
+		}
+	}
+	return m
+}
+
+// subscribeUpdates subscribes to unit signals, on success
+// sd.updates receives a message every time a unit changes.
+func (sd *Systemd) subscribeUpdates() error {
+	sub, ok := sd.conn.(subscriber)
+	if !ok {
+		return errors.New("connection doesn't support subscriptions")
+	}
+	if err := sub.Subscribe(); err != nil {
+		return err
+	}
+
+	sd.updates = make(chan *dbus.SubStateUpdate, 1024)
+	sd.errs = make(chan error, 1)
+	sub.SetSubStateSubscriber(sd.updates, sd.errs)
+	return nil
+}
+
+// dial calls fn in a separate goroutine because dbus doesn't support
+// contexts, when ctx is done before the connection is established
+// it's closed in background as soon as it's ready.
+func dial(ctx context.Context, fn func() (*dbus.Conn, error)) (*dbus.Conn, error) {
+	type result struct {
+		conn *dbus.Conn
+		err  error
+	}
+
+	ch := make(chan result, 1)
+	go func() {
+		c, err := fn()
+		ch <- result{c, err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-ch; r.err == nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// validateBusAddress checks that addr is a list of transport:key=value,...
+// addresses separated by semicolons of transports supported by godbus.
+func validateBusAddress(addr string) error {
+	for _, a := range strings.Split(addr, ";") {
+		i := strings.IndexByte(a, ':')
+		if i < 0 {
+			return fmt.Errorf("malformed dbus address %q, want transport:key=value,...", a)
+		}
+		if t := a[:i]; t != "unix" && t != "tcp" {
+			return fmt.Errorf("unsupported dbus transport %q in %q", t, a)
+		}
+		if a[i+1:] == "" {
+			return fmt.Errorf("dbus address %q has no parameters", a)
+		}
+		for _, kv := range strings.Split(a[i+1:], ",") {
+			if j := strings.IndexByte(kv, '='); j <= 0 {
+				return fmt.Errorf("malformed dbus address parameter %q in %q", kv, a)
+			}
+		}
+	}
+	return nil
+}
+
+// addressConnection returns a function connecting to the bus at addr,
+// Hello is skipped for the systemd private socket where there's no bus daemon.
+func addressConnection(addr string) func() (*dbus.Conn, error) {
+	direct := strings.Contains(addr, "/run/systemd/private")
+	return func() (*dbus.Conn, error) {
+		return dbus.NewConnection(func() (*godbus.Conn, error) {
+			c, err := godbus.Dial(addr)
+			if err != nil {
+				return nil, err
+			}
+			// hardcode the uid like go-systemd, that avoids a username lookup
+			if err = c.Auth([]godbus.Auth{godbus.AuthExternal(strconv.Itoa(os.Getuid()))}); err != nil {
+				c.Close()
+				return nil, err
+			}
+			if !direct {
+				if err = c.Hello(); err != nil {
+					c.Close()
+					return nil, err
+				}
+			}
+			return c, nil
+		})
+	}
+}
+
+// maxRetryDelay is the upper bound of the delay between retries and reconnection attempts.
+const maxRetryDelay = 30 * time.Second
+
+// listUnits returns all units, when the connection is lost
+// it's re-established preserving the accumulated state.
+//
+// Transient errors are retried up to list retries times,
+// others are returned immediately.
+func (sd *Systemd) listUnits(ctx context.Context) ([]dbus.UnitStatus, error) {
+	delay := sd.retryDelay
+	for retries := 0; ; {
+		units, err := sd.callListUnits(ctx)
+		switch {
+		case err == nil:
+			return units, nil
+		case isConnError(err) && sd.dial != nil:
+			sd.warn("dbus connection lost", "error", err)
+			if err = sd.reconnect(ctx); err != nil {
+				return nil, err
+			}
+		case isTransient(err) && retries < sd.listRetries:
+			retries++
+			sd.warn("ListUnits failed", "retry", retries, "delay", delay, "error", err)
+			if err = sd.sleep(ctx, delay); err != nil {
+				return nil, err
+			}
+			if delay *= 2; delay > maxRetryDelay {
+				delay = maxRetryDelay
+			}
+		default:
+			return nil, err
+		}
+	}
+}
+
+// callListUnits calls ListUnits in a separate goroutine
+// to be able to abandon it when ctx is done.
+//
+// ListUnitsByNames is called instead when the units are
+// given by names, unless the connection doesn't support it.
+func (sd *Systemd) callListUnits(ctx context.Context) ([]dbus.UnitStatus, error) {
+	type result struct {
+		units []dbus.UnitStatus
+		err   error
+	}
+
+	sd.mu.RLock()
+	names := sd.names
+	sd.mu.RUnlock()
+	list := sd.conn.ListUnits
+	if nl, ok := sd.conn.(nameLister); ok && len(names) != 0 {
+		list = func() ([]dbus.UnitStatus, error) {
+			return nl.ListUnitsByNames(names)
+		}
+	}
+
+	ch := make(chan result, 1)
+	go func() {
+		units, err := list()
+		ch <- result{units, err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.units, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// reconnect replaces the current connection with a new one,
+// retrying with an exponential backoff until it succeeds or ctx is done.
+func (sd *Systemd) reconnect(ctx context.Context) error {
+	sd.conn.Close()
+
+	delay := sd.retryDelay
+	for attempt := 1; ; attempt++ {
+		sd.info("reconnecting to dbus", "attempt", attempt)
+		c, err := sd.dial(ctx)
+		if err == nil {
+			sd.conn = c
+			break
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		sd.warn("reconnect failed", "delay", delay, "error", err)
+		if err = sd.sleep(ctx, delay); err != nil {
+			return err
+		}
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+
+	if sd.subscribe {
+		sd.updates, sd.errs = nil, nil
+		if err := sd.subscribeUpdates(); err != nil {
+			sd.warn("subscription failed, fall back to polling", "error", err)
+		}
+	}
+	sd.info("reconnected to dbus")
+	return nil
+}
+
+// isConnError reports whether err is caused by a broken connection
+// rather than by the call itself.
+func isConnError(err error) bool {
+	if err == godbus.ErrClosed || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if derr, ok := err.(godbus.Error); ok {
+		return derr.Name == "org.freedesktop.DBus.Error.Disconnected"
+	}
+	if _, ok := err.(*net.OpError); ok {
+		return true
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return errno == syscall.EPIPE || errno == syscall.ECONNRESET
+	}
+	return false
+}
+
+// isTransient reports whether err is worth retrying,
+// that are timeouts and broken connections.
+func isTransient(err error) bool {
+	if isConnError(err) {
+		return true
+	}
+	if derr, ok := err.(godbus.Error); ok {
+		switch derr.Name {
+		case "org.freedesktop.DBus.Error.NoReply",
+			"org.freedesktop.DBus.Error.Timeout",
+			"org.freedesktop.DBus.Error.TimedOut":
+			return true
+		}
+		return false
+	}
+	var nerr net.Error
+	return errors.As(err, &nerr) && nerr.Timeout()
+}
@@ -0,0 +1,260 @@
+package systemd
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-systemd/dbus"
+	godbus "github.com/godbus/dbus"
+)
+
+func TestReconnect(t *testing.T) {
+	sd := newFake(t, [][]dbus.UnitStatus{
+		{status("a.service", "active", "running")},
+	})
+	sd.retryDelay = time.Millisecond
+
+	// the connection breaks right after the bootstrap poll
+	if _, err := sd.poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	sd.conn = &fakeConn{err: godbus.ErrClosed}
+
+	dials := 0
+	sd.dial = func(ctx context.Context) (conn, error) {
+		dials++
+		if dials == 1 {
+			return nil, errors.New("connection refused")
+		}
+		return &fakeConn{script: [][]dbus.UnitStatus{
+			{status("a.service", "failed", "failed")},
+		}}, nil
+	}
+
+	changes, err := sd.Next(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dials != 2 {
+		t.Errorf("dials = %d, want 2", dials)
+	}
+
+	// the state survives, so there's no added flood
+	if len(changes) != 1 || changes[0].Kind != Modified {
+		t.Errorf("changes = %v, want a single modification", changes)
+	}
+}
+
+func TestValidateBusAddress(t *testing.T) {
+	t.Parallel()
+
+	for addr, ok := range map[string]bool{
+		"unix:path=/run/dbus/system_bus_socket":          true,
+		"unix:abstract=/tmp/dbus-x;tcp:host=h,port=1234": true,
+		"/run/dbus/system_bus_socket":                    false,
+		"nonce-tcp:host=h":                               false,
+		"unix:":                                          false,
+		"unix:path":                                      false,
+	} {
+		if err := validateBusAddress(addr); (err == nil) != ok {
+			t.Errorf("validateBusAddress(%q) = %v, want ok = %t", addr, err, ok)
+		}
+	}
+}
+
+func TestDBusAddress(t *testing.T) {
+	t.Parallel()
+
+	if _, err := configure([]Option{WithDBusAddress("unix:path=/x"), WithUserBus()}); err == nil {
+		t.Error("expected an error with the user bus")
+	}
+	_, err := New(context.Background(), WithDBusAddress("unix:path=/nonexistent/bus"),
+		WithInMemoryState(), WithLogger(nil))
+	if err == nil || !strings.Contains(err.Error(), "cannot connect to dbus at unix:path=/nonexistent/bus") {
+		t.Errorf("err = %v, want a connection error with the address", err)
+	}
+}
+
+func TestIsConnError(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		want bool
+	}{
+		{godbus.ErrClosed, true},
+		{godbus.Error{Name: "org.freedesktop.DBus.Error.Disconnected"}, true},
+		{godbus.Error{Name: "org.freedesktop.DBus.Error.AccessDenied"}, false},
+		{errors.New("dbus.Store: type mismatch"), false},
+	} {
+		if got := isConnError(c.err); got != c.want {
+			t.Errorf("isConnError(%v) = %t, want %t", c.err, got, c.want)
+		}
+	}
+}
+
+// flakyConn fails ListUnits with errs one per call before delegating to conn.
+type flakyConn struct {
+	conn
+	errs []error
+}
+
+func (c *flakyConn) ListUnits() ([]dbus.UnitStatus, error) {
+	if len(c.errs) != 0 {
+		err := c.errs[0]
+		c.errs = c.errs[1:]
+		return nil, err
+	}
+	return c.conn.ListUnits()
+}
+
+func TestListUnitsRetry(t *testing.T) {
+	timeout := godbus.Error{Name: "org.freedesktop.DBus.Error.NoReply"}
+	denied := godbus.Error{Name: "org.freedesktop.DBus.Error.AccessDenied"}
+
+	for _, c := range []struct {
+		name    string
+		errs    []error
+		wantErr bool
+	}{
+		{"transient", []error{timeout, timeout}, false},
+		{"exhausted", []error{timeout, timeout, timeout}, true},
+		{"fatal", []error{denied}, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			sd := newFake(t, [][]dbus.UnitStatus{
+				{status("a.service", "active", "running")},
+			}, WithListUnitsRetry(2))
+			sd.retryDelay = time.Millisecond
+			sd.conn = &flakyConn{conn: sd.conn, errs: c.errs}
+
+			_, err := sd.listUnits(context.Background())
+			if (err != nil) != c.wantErr {
+				t.Errorf("err = %v, want error = %t", err, c.wantErr)
+			}
+		})
+	}
+}
+
+// restartsConn is a fakeConn that reports NRestarts of units.
+type restartsConn struct {
+	*fakeConn
+	restarts []map[string]uint32
+}
+
+func (c *restartsConn) GetUnitTypeProperty(unit, unitType, name string) (*dbus.Property, error) {
+	i := c.calls - 1
+	if i >= len(c.restarts) {
+		i = len(c.restarts) - 1
+	}
+	n, ok := c.restarts[i][unit]
+	if !ok {
+		return nil, godbus.Error{Name: "org.freedesktop.DBus.Error.UnknownProperty"}
+	}
+	return &dbus.Property{Name: name, Value: godbus.MakeVariant(n)}, nil
+}
+
+func TestNextRestarts(t *testing.T) {
+	a := []dbus.UnitStatus{status("a.service", "active", "running")}
+	c := &restartsConn{
+		fakeConn: &fakeConn{script: [][]dbus.UnitStatus{a}},
+		restarts: []map[string]uint32{
+			{"a.service": 1},
+			{"a.service": 1},
+			{"a.service": 0},
+			{"a.service": 2},
+		},
+	}
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sd, err := newWithConn(c, WithStateFile(filepath.Join(dir, "state")),
+		WithLogger(nil), WithRestarts(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sd.Close()
+	sd.interval = time.Millisecond
+
+	changes, err := sd.Next(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || !changes[0].Restarted() || changes[0].Old.Restarts != 0 {
+		t.Fatalf("changes = %v, want a single restart after the reset", changes)
+	}
+	if c.calls != 4 {
+		t.Errorf("calls = %d, want 4", c.calls)
+	}
+}
+
+// namesConn is a fakeConn that lists units by names,
+// unknown units are reported as not found.
+type namesConn struct {
+	*fakeConn
+	names []string
+}
+
+func (c *namesConn) ListUnitsByNames(names []string) ([]dbus.UnitStatus, error) {
+	c.names = names
+	all, err := c.ListUnits()
+	if err != nil {
+		return nil, err
+	}
+	units := make([]dbus.UnitStatus, 0, len(names))
+	for _, name := range names {
+		u := status(name, "inactive", "dead")
+		u.LoadState = "not-found"
+		for _, s := range all {
+			if s.Name == name {
+				u = s
+			}
+		}
+		units = append(units, u)
+	}
+	return units, nil
+}
+
+func TestNextUnits(t *testing.T) {
+	c := &namesConn{fakeConn: &fakeConn{script: [][]dbus.UnitStatus{
+		{status("a.service", "active", "running"), status("b.service", "active", "running")},
+		{status("b.service", "active", "running")},
+	}}}
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sd, err := newWithConn(c, WithStateFile(filepath.Join(dir, "state")),
+		WithLogger(nil), WithUnits("a.service"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sd.Close()
+	sd.interval = time.Millisecond
+
+	changes, err := sd.Next(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c.names, []string{"a.service"}) {
+		t.Errorf("listed names = %v, want [a.service]", c.names)
+	}
+	if len(changes) != 1 || changes[0].Kind != Modified || changes[0].Unit.LoadState != "not-found" {
+		t.Fatalf("changes = %v, want a.service to be not found", changes)
+	}
+	if len(sd.state) != 1 {
+		t.Errorf("state = %v, want only a.service", sd.state)
+	}
+}
@@ -0,0 +1,71 @@
+package systemd
+
+import "time"
+
+// hold postpones the change until the unit settles down,
+// merging it with the change that's already pending for the unit.
+func (sd *Systemd) hold(c Change) {
+	path := string(c.Unit.Path)
+	p, ok := sd.pending[path]
+	if !ok {
+		sd.pending[path] = c
+		return
+	}
+	sd.pending[path] = merge(p, c)
+}
+
+// merge collapses the pending change p and its follow-up c into a single
+// change between the state before p and the state after c.
+func merge(p, c Change) Change {
+	m := c
+	m.Old = p.Old
+	switch {
+	case p.Kind == Added:
+		m.Kind, m.Old, m.Downtime = Added, Unit{}, 0
+	case c.Kind == Recovered:
+	case p.Kind == Recovered && c.Unit.ActiveState == "active":
+		// the unit has recovered and restarted once again
+		m.Kind, m.Downtime = Recovered, p.Downtime
+	default:
+		m.Kind, m.Downtime = Modified, 0
+	}
+	return m
+}
+
+// settled returns pending changes of units that haven't changed
+// at least for the debounce window, changes that have ended up
+// being in the same state they've started from are dropped.
+func (sd *Systemd) settled(now time.Time) []Change {
+	var changes []Change
+	for path, c := range sd.pending {
+		if now.Sub(c.Time) < sd.debounce {
+			continue
+		}
+		delete(sd.pending, path)
+		if c.Kind != Added &&
+			c.Old.ActiveState == c.Unit.ActiveState &&
+			c.Old.SubState == c.Unit.SubState &&
+			c.Old.LoadState == c.Unit.LoadState {
+			sd.info("unit settled in the initial state", "unit", c.Unit.Name)
+			continue
+		}
+		changes = append(changes, c)
+	}
+	return changes
+}
+
+// nextSettle returns how long it is until the first pending change
+// settles down, false means that there are no pending changes.
+func (sd *Systemd) nextSettle(now time.Time) (time.Duration, bool) {
+	var d time.Duration
+	ok := false
+	for _, c := range sd.pending {
+		if left := c.Time.Add(sd.debounce).Sub(now); !ok || left < d {
+			d, ok = left, true
+		}
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d, ok
+}
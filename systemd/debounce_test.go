@@ -0,0 +1,74 @@
+package systemd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-systemd/dbus"
+)
+
+func TestNextDebounce(t *testing.T) {
+	sd := newFake(t, [][]dbus.UnitStatus{
+		{status("a.service", "active", "running")},
+		{status("a.service", "failed", "failed")},
+		{status("a.service", "activating", "auto-restart")},
+		{status("a.service", "failed", "failed")},
+	}, WithDebounce(20*time.Millisecond))
+
+	changes, err := sd.Next(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || !changes[0].EnteredFailed() {
+		t.Fatalf("changes = %v, want a single failure", changes)
+	}
+	if changes[0].Old.ActiveState != "active" {
+		t.Errorf("old state = %q, want %q", changes[0].Old.ActiveState, "active")
+	}
+}
+
+func TestSettledDropsFlaps(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	sd := &Systemd{debounce: time.Second, pending: map[string]Change{}}
+	old := Unit{UnitStatus: status("a.service", "active", "running")}
+	c1 := newChange(&old, status("a.service", "failed", "failed"), now.Add(-3*time.Second))
+	c2 := newChange(&c1.Unit, status("a.service", "active", "running"), now.Add(-2*time.Second))
+	sd.hold(c1)
+	sd.hold(c2)
+
+	if d, ok := sd.nextSettle(now); !ok || d != 0 {
+		t.Fatalf("nextSettle = %s, %t, want 0, true", d, ok)
+	}
+	if changes := sd.settled(now); len(changes) != 0 {
+		t.Fatalf("changes = %v, want none", changes)
+	}
+	if len(sd.pending) != 0 {
+		t.Fatalf("pending = %v, want empty", sd.pending)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name string
+		p, c Change
+		want Kind
+	}{
+		{"added", Change{Kind: Added}, Change{Kind: Modified}, Added},
+		{"recovered", Change{Kind: Modified}, Change{Kind: Recovered}, Recovered},
+		{"restarted", Change{Kind: Recovered}, Change{Kind: Modified, Unit: Unit{
+			UnitStatus: dbus.UnitStatus{ActiveState: "active"},
+		}}, Recovered},
+		{"failed again", Change{Kind: Recovered}, Change{Kind: Modified, Unit: Unit{
+			UnitStatus: dbus.UnitStatus{ActiveState: "failed"},
+		}}, Modified},
+	} {
+		if got := merge(tc.p, tc.c).Kind; got != tc.want {
+			t.Errorf("%s: kind = %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package systemd
+
+import "time"
+
+// dedupKey identifies changes that look the same to a reader.
+type dedupKey struct {
+	path   string
+	kind   Kind
+	active string
+	sub    string
+}
+
+// isDuplicate reports whether an identical change has been
+// reported within the dedup window, otherwise it remembers c.
+func (sd *Systemd) isDuplicate(c *Change) bool {
+	if sd.dedup <= 0 {
+		return false
+	}
+	k := dedupKey{
+		path:   string(c.Unit.Path),
+		kind:   c.Kind,
+		active: c.Unit.ActiveState,
+		sub:    c.Unit.SubState,
+	}
+	if last, ok := sd.seen[k]; ok && c.Time.Sub(last) < sd.dedup {
+		sd.debug("duplicate change suppressed", "unit", c.Unit.Name, "change_kind", c.Kind)
+		return true
+	}
+	sd.seen[k] = c.Time
+	return false
+}
+
+// forgetSeen drops remembered changes older than the dedup window.
+func (sd *Systemd) forgetSeen(now time.Time) {
+	for k, last := range sd.seen {
+		if now.Sub(last) >= sd.dedup {
+			delete(sd.seen, k)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package systemd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIsDuplicate(t *testing.T) {
+	t.Parallel()
+
+	sd := &Systemd{dedup: time.Minute, seen: map[dedupKey]time.Time{}}
+	now := time.Now()
+	change := func(active string, d time.Duration) *Change {
+		return &Change{
+			Kind: Modified,
+			Unit: Unit{UnitStatus: status("a.service", active, active)},
+			Time: now.Add(d),
+		}
+	}
+
+	for i, tc := range []struct {
+		c    *Change
+		want bool
+	}{
+		{change("failed", 0), false},
+		{change("failed", time.Second), true},
+		{change("active", 2*time.Second), false},
+		{change("failed", 2*time.Minute), false},
+	} {
+		if got := sd.isDuplicate(tc.c); got != tc.want {
+			t.Errorf("%d: isDuplicate = %t, want %t", i, got, tc.want)
+		}
+	}
+
+	sd.forgetSeen(now.Add(10 * time.Minute))
+	if len(sd.seen) != 0 {
+		t.Errorf("seen = %v, want it to be empty", sd.seen)
+	}
+}
@@ -0,0 +1,45 @@
+package systemd
+
+import "sort"
+
+// dependencyProps are unit properties listing units
+// whose failure may have caused the unit to fail.
+var dependencyProps = []string{"Requires", "Requisite", "BindsTo", "After", "TriggeredBy"}
+
+// fetchCauses returns sorted names of the named unit dependencies
+// that are failed too, units whose properties cannot be read are skipped.
+func (sd *Systemd) fetchCauses(name string, failed map[string]bool) []string {
+	pg, ok := sd.conn.(propertyGetter)
+	if !ok {
+		return nil
+	}
+
+	seen := map[string]bool{}
+	var causes []string
+	for _, prop := range dependencyProps {
+		p, err := pg.GetUnitTypeProperty(name, "Unit", prop)
+		if err != nil {
+			sd.warn("cannot read dependencies", "unit", name, "property", prop, "error", err)
+			return nil
+		}
+		deps, _ := p.Value.Value().([]string)
+		for _, dep := range deps {
+			if dep != name && failed[dep] && !seen[dep] {
+				seen[dep] = true
+				causes = append(causes, dep)
+			}
+		}
+	}
+	sort.Strings(causes)
+	return causes
+}
+
+// attachCauses sets CausedBy of failures in changes to their
+// dependencies that are failed, failed are names of failed units.
+func (sd *Systemd) attachCauses(changes []Change, failed map[string]bool) {
+	for i := range changes {
+		if changes[i].EnteredFailed() {
+			changes[i].CausedBy = sd.fetchCauses(changes[i].Unit.Name, failed)
+		}
+	}
+}
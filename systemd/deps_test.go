@@ -0,0 +1,44 @@
+package systemd
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/coreos/go-systemd/dbus"
+	godbus "github.com/godbus/dbus"
+)
+
+// depsConn is a fakeConn that reports unit dependencies.
+type depsConn struct {
+	*fakeConn
+	deps map[string]map[string][]string
+}
+
+func (c *depsConn) GetUnitTypeProperty(unit, unitType, name string) (*dbus.Property, error) {
+	return &dbus.Property{Name: name, Value: godbus.MakeVariant(append([]string{}, c.deps[unit][name]...))}, nil
+}
+
+func TestAttachCauses(t *testing.T) {
+	t.Parallel()
+
+	sd := &Systemd{
+		conn: &depsConn{deps: map[string]map[string][]string{
+			"app.service": {
+				"Requires": {"db.service", "cache.service"},
+				"After":    {"db.service", "network.target", "basic.target"},
+			},
+		}},
+	}
+	changes := []Change{
+		{Kind: Added, Unit: Unit{UnitStatus: status("app.service", "failed", "failed")}},
+		{Kind: Added, Unit: Unit{UnitStatus: status("web.service", "active", "running")}},
+	}
+	sd.attachCauses(changes, map[string]bool{"db.service": true, "basic.target": true})
+
+	if want := []string{"basic.target", "db.service"}; !reflect.DeepEqual(changes[0].CausedBy, want) {
+		t.Errorf("CausedBy = %v, want %v", changes[0].CausedBy, want)
+	}
+	if changes[1].CausedBy != nil {
+		t.Errorf("CausedBy = %v of an active unit, want nil", changes[1].CausedBy)
+	}
+}
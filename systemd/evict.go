@@ -0,0 +1,108 @@
+package systemd
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/coreos/go-systemd/dbus"
+)
+
+// transientTypes are unit types that come and go on busy multi-user
+// hosts, they're evicted before any other units.
+var transientTypes = []string{".scope", ".mount", ".automount", ".swap"}
+
+// isTransientUnit reports whether the unit is a scope, a mount or a login session.
+func isTransientUnit(name string) bool {
+	return hasAnySuffix(name, transientTypes) || strings.HasPrefix(name, "session-")
+}
+
+// isEvictable reports whether the unit may be dropped from a full state,
+// failed units and active ones with a recorded failure, restart
+// or annotation history are always kept.
+func (u *Unit) isEvictable() bool {
+	switch {
+	case u.ActiveState == "failed":
+		return false
+	case u.ActiveState == "active":
+		return u.FailedAt.IsZero() && u.FailureNotifiedAt.IsZero() &&
+			u.Restarts == 0 && len(u.Annotations) == 0
+	default:
+		return true
+	}
+}
+
+// readmit reports whether diff has to skip s because it's been evicted
+// and whether it's adopted silently now that the state has room for it,
+// otherwise evicted units would be reported as added on every poll.
+// Evicted units that have failed in the meantime are always let
+// through, so their failures are reported as added failed units.
+func (sd *Systemd) readmit(s dbus.UnitStatus) (bool, bool) {
+	path := string(s.Path)
+	if _, ok := sd.evicted[path]; !ok {
+		return false, false
+	}
+	if s.ActiveState == "failed" {
+		delete(sd.evicted, path)
+		sd.info("evicted unit has failed", "unit", s.Name)
+		return false, false
+	}
+	if len(sd.state) >= sd.maxUnits {
+		return true, false
+	}
+	delete(sd.evicted, path)
+	sd.state[path] = Unit{UnitStatus: s}
+	sd.info("evicted unit is tracked again", "unit", s.Name)
+	return true, true
+}
+
+// evict drops units until the state fits into the max units, transient
+// ones go first, then the ones that have changed least recently.
+// It reports whether anything has been evicted. Evicted units are
+// remembered while they're listed, so they're not reported as added.
+func (sd *Systemd) evict() bool {
+	for path := range sd.evicted {
+		if _, ok := sd.listed[path]; !ok {
+			delete(sd.evicted, path)
+		}
+	}
+	n := len(sd.state) - sd.maxUnits
+	if n <= 0 {
+		return false
+	}
+
+	paths := make([]string, 0, len(sd.state))
+	for path, u := range sd.state {
+		if u.isEvictable() {
+			paths = append(paths, path)
+		}
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		a, b := sd.state[paths[i]], sd.state[paths[j]]
+		if ta, tb := isTransientUnit(a.Name), isTransientUnit(b.Name); ta != tb {
+			return ta
+		}
+		if !a.ChangedAt.Equal(b.ChangedAt) {
+			return a.ChangedAt.Before(b.ChangedAt)
+		}
+		return paths[i] < paths[j]
+	})
+	if len(paths) < n {
+		sd.warn("state is full, remaining units cannot be evicted",
+			"max_units", sd.maxUnits, "units", len(sd.state))
+		n = len(paths)
+	}
+	for _, path := range paths[:n] {
+		u := sd.state[path]
+		sd.warn("state is full, unit evicted", "unit", u.Name,
+			"max_units", sd.maxUnits, "last_changed", u.ChangedAt)
+		delete(sd.state, path)
+		delete(sd.pending, path)
+		delete(sd.failing, path)
+		delete(sd.recovering, path)
+		delete(sd.flaps, path)
+		if _, ok := sd.listed[path]; ok {
+			sd.evicted[path] = struct{}{}
+		}
+	}
+	return n != 0
+}
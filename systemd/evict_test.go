@@ -0,0 +1,137 @@
+package systemd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/systemd-slack/clock"
+	"github.com/coreos/go-systemd/dbus"
+)
+
+func TestMaxUnits(t *testing.T) {
+	var (
+		a = status("a.service", "active", "running")
+		b = status("b.service", "active", "running")
+		c = status("c.service", "active", "running")
+	)
+	clock := clock.NewFake()
+	sd := newFake(t, [][]dbus.UnitStatus{
+		{a, b},
+		{a, status("b.service", "active", "exited"), c},
+		{a, status("b.service", "active", "exited"), c},
+		{a, status("b.service", "active", "exited"), status("c.service", "failed", "failed")},
+		{status("b.service", "active", "exited"), status("c.service", "failed", "failed")},
+	}, WithMaxUnits(2), WithClock(clock))
+
+	want := [][]string{
+		nil,
+		{"b.service modified", "c.service added"},
+		nil,
+		{"c.service modified"},
+		nil,
+	}
+	for i := range want {
+		clock.Advance(time.Second)
+		changes, err := sd.Poll(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, c := range changes {
+			got = append(got, c.Unit.Name+" "+c.Kind.String())
+		}
+		if len(got) != len(want[i]) {
+			t.Fatalf("poll %d: changes = %q, want %q", i, got, want[i])
+		}
+		for j := range got {
+			if got[j] != want[i][j] {
+				t.Fatalf("poll %d: changes = %q, want %q", i, got, want[i])
+			}
+		}
+		if len(sd.state) > 2 {
+			t.Fatalf("poll %d: state has %d units, want at most 2", i, len(sd.state))
+		}
+	}
+
+	// a.service is evicted as the least recently changed one and
+	// it's not reported as removed when it disappears
+	if _, ok := sd.state["/a.service"]; ok {
+		t.Errorf("a.service is in the state, want it evicted")
+	}
+	if len(sd.evicted) != 0 {
+		t.Errorf("evicted = %v, want none after a.service is gone", sd.evicted)
+	}
+}
+
+func TestMaxUnitsPolicy(t *testing.T) {
+	var (
+		a = status("a.service", "active", "running")
+		s = status("session-1.scope", "active", "running")
+		f = status("f.service", "failed", "failed")
+		n = status("n.service", "active", "running")
+	)
+	clock := clock.NewFake()
+	sd := newFake(t, [][]dbus.UnitStatus{
+		{a, s, f},
+		{a, s, f, n},
+		{status("a.service", "failed", "failed"), s, f, n},
+	}, WithMaxUnits(2), WithClock(clock))
+
+	poll := func() []Change {
+		t.Helper()
+		clock.Advance(time.Second)
+		changes, err := sd.Poll(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return changes
+	}
+	poll() // bootstrap
+
+	// the scope goes first, then a.service that has changed before n.service,
+	// the failed unit is kept
+	if changes := poll(); len(changes) != 1 || changes[0].Unit.Name != "n.service" {
+		t.Fatalf("changes = %v, want n.service added", changes)
+	}
+	for _, name := range []string{"f.service", "n.service"} {
+		if _, ok := sd.state["/"+name]; !ok {
+			t.Errorf("%s is evicted, want it kept", name)
+		}
+	}
+
+	// the evicted a.service failure is reported
+	changes := poll()
+	if len(changes) != 1 || changes[0].Unit.Name != "a.service" || !changes[0].EnteredFailed() {
+		t.Fatalf("changes = %v, want a.service added failed", changes)
+	}
+	if _, ok := sd.evicted["/session-1.scope"]; !ok {
+		t.Errorf("evicted = %v, want the scope still evicted", sd.evicted)
+	}
+	if u := sd.state["/a.service"]; !u.ChangedAt.Equal(clock.Now()) {
+		t.Errorf("a.service changed at %s, want %s", u.ChangedAt, clock.Now())
+	}
+}
+
+func TestIsEvictable(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	for _, tc := range []struct {
+		name string
+		unit Unit
+		want bool
+	}{
+		{"stable", Unit{UnitStatus: status("a.service", "active", "running")}, true},
+		{"inactive", Unit{UnitStatus: status("a.service", "inactive", "dead")}, true},
+		{"failed", Unit{UnitStatus: status("a.service", "failed", "failed")}, false},
+		{"restarted", Unit{UnitStatus: status("a.service", "active", "running"), Restarts: 1}, false},
+		{"notified", Unit{UnitStatus: status("a.service", "active", "running"), FailureNotifiedAt: now}, false},
+		{"annotated", Unit{UnitStatus: status("a.service", "active", "running"),
+			Annotations: map[string]string{"slack_ts": "1.000"}}, false},
+	} {
+		if got := tc.unit.isEvictable(); got != tc.want {
+			t.Errorf("%s: evictable = %t, want %t", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package systemd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Exit describes how the main process of a failed service has terminated.
+type Exit struct {
+	// Code is ExecMainCode, that's one of CLD_* values, see sigaction(2).
+	Code int32
+
+	// Status is ExecMainStatus, it's the exit status for CLD_EXITED
+	// and the signal number for CLD_KILLED and CLD_DUMPED.
+	Status int32
+
+	// Result is the service result, e.g. exit-code, signal or oom-kill.
+	Result string
+}
+
+// ExecMainCode values.
+const (
+	cldExited = 1
+	cldKilled = 2
+	cldDumped = 3
+)
+
+// String returns a human-readable description,
+// e.g. "exited with status 137 (SIGKILL)".
+func (e *Exit) String() string {
+	var s string
+	switch e.Code {
+	case cldExited:
+		s = fmt.Sprintf("exited with status %d", e.Status)
+
+		// shells exit with 128+n when a child is killed by signal n
+		if name := signalName(e.Status - 128); e.Status > 128 && name != "" {
+			s += " (" + name + ")"
+		}
+	case cldKilled:
+		s = fmt.Sprintf("killed by signal %d", e.Status)
+		if name := signalName(e.Status); name != "" {
+			s += " (" + name + ")"
+		}
+	case cldDumped:
+		s = fmt.Sprintf("dumped core on signal %d", e.Status)
+		if name := signalName(e.Status); name != "" {
+			s += " (" + name + ")"
+		}
+	}
+	if e.Result != "" && e.Result != "success" {
+		if s == "" {
+			return e.Result
+		}
+		s += ", result " + e.Result
+	}
+	return s
+}
+
+// signals are names of signals that usually terminate services.
+var signals = map[int32]string{
+	1: "SIGHUP", 2: "SIGINT", 3: "SIGQUIT", 4: "SIGILL", 5: "SIGTRAP", 6: "SIGABRT",
+	7: "SIGBUS", 8: "SIGFPE", 9: "SIGKILL", 10: "SIGUSR1", 11: "SIGSEGV",
+	12: "SIGUSR2", 13: "SIGPIPE", 14: "SIGALRM", 15: "SIGTERM", 24: "SIGXCPU", 25: "SIGXFSZ",
+}
+
+// signalName returns the signal name or an empty string if it's unknown.
+func signalName(n int32) string {
+	return signals[n]
+}
+
+// fetchExit reads the main process exit status of the named service,
+// it returns nil for other unit types or when the status cannot be read.
+func (sd *Systemd) fetchExit(name string) *Exit {
+	pg, ok := sd.conn.(propertyGetter)
+	if !ok || !strings.HasSuffix(name, ".service") {
+		return nil
+	}
+
+	var e Exit
+	for _, p := range []struct {
+		name string
+		v    interface{}
+	}{
+		{"ExecMainCode", &e.Code},
+		{"ExecMainStatus", &e.Status},
+		{"Result", &e.Result},
+	} {
+		prop, err := pg.GetUnitTypeProperty(name, "Service", p.name)
+		if err != nil {
+			sd.warn("cannot read exit status", "unit", name, "property", p.name, "error", err)
+			return nil
+		}
+		switch v := p.v.(type) {
+		case *int32:
+			*v, ok = prop.Value.Value().(int32)
+		case *string:
+			*v, ok = prop.Value.Value().(string)
+		}
+		if !ok {
+			sd.warn("unexpected property type", "unit", name, "property", p.name,
+				"signature", prop.Value.Signature().String())
+			return nil
+		}
+	}
+	return &e
+}
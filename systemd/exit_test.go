@@ -0,0 +1,23 @@
+package systemd
+
+import "testing"
+
+func TestExitString(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		exit Exit
+		want string
+	}{
+		{Exit{Code: cldExited, Status: 1, Result: "exit-code"}, "exited with status 1, result exit-code"},
+		{Exit{Code: cldExited, Status: 137, Result: "exit-code"}, "exited with status 137 (SIGKILL), result exit-code"},
+		{Exit{Code: cldKilled, Status: 9, Result: "oom-kill"}, "killed by signal 9 (SIGKILL), result oom-kill"},
+		{Exit{Code: cldDumped, Status: 11, Result: "core-dump"}, "dumped core on signal 11 (SIGSEGV), result core-dump"},
+		{Exit{Result: "timeout"}, "timeout"},
+		{Exit{}, ""},
+	} {
+		if got := tc.exit.String(); got != tc.want {
+			t.Errorf("%+v: String() = %q, want %q", tc.exit, got, tc.want)
+		}
+	}
+}
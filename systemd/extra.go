@@ -0,0 +1,67 @@
+package systemd
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// DefaultFetcherTimeout bounds WithUnitPropertyFetcher callbacks
+// when no timeout is given.
+const DefaultFetcherTimeout = 5 * time.Second
+
+// attachExtra calls the unit property fetcher for every change, diff
+// has already released the state lock, so a slow fetcher delays only
+// the current Next, not Ack, Snapshot and annotations.
+func (sd *Systemd) attachExtra(ctx context.Context, changes []Change) {
+	if sd.fetcher == nil {
+		return
+	}
+	for i := range changes {
+		changes[i].Extra = sd.fetchExtra(ctx, changes[i].Unit.Name)
+	}
+}
+
+// fetchExtra calls the unit property fetcher in a separate goroutine
+// to abandon it after the timeout even when it ignores the context,
+// nil is returned when it fails or takes too long.
+func (sd *Systemd) fetchExtra(ctx context.Context, name string) map[string]string {
+	type result struct {
+		m   map[string]string
+		err error
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, sd.fetcherTimeout)
+	defer cancel()
+	ch := make(chan result, 1)
+	go func() {
+		m, err := sd.fetcher(ctx, name)
+		ch <- result{m, err}
+	}()
+
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			sd.warn("unit property fetcher failed", "unit", name, "error", r.err)
+			return nil
+		}
+		if len(r.m) == 0 {
+			return nil
+		}
+		return r.m
+	case <-ctx.Done():
+		sd.warn("unit property fetcher failed", "unit", name, "error", ctx.Err())
+		return nil
+	}
+}
+
+// ExtraKeys returns keys of the fetched unit properties in sorted order,
+// so notifiers render them the same way every time.
+func (c *Change) ExtraKeys() []string {
+	keys := make([]string, 0, len(c.Extra))
+	for k := range c.Extra {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,65 @@
+package systemd
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-systemd/dbus"
+)
+
+func TestUnitPropertyFetcher(t *testing.T) {
+	t.Parallel()
+
+	var sd *Systemd
+	block := make(chan struct{})
+	defer close(block)
+	fetcher := func(ctx context.Context, unit string) (map[string]string, error) {
+		switch unit {
+		case "a.service":
+			// the state lock must be released by now
+			if len(sd.Snapshot()) != 3 {
+				return nil, errors.New("unexpected snapshot")
+			}
+			return map[string]string{"version": "1.2.3", "env": "prod"}, nil
+		case "b.service":
+			return nil, errors.New("no environment")
+		default:
+			<-block // ignores the context
+			return map[string]string{"version": "late"}, nil
+		}
+	}
+	sd = newFake(t, [][]dbus.UnitStatus{
+		{status("a.service", "active", "running"), status("b.service", "active", "running"), status("c.service", "active", "running")},
+		{status("a.service", "failed", "failed"), status("b.service", "failed", "failed"), status("c.service", "failed", "failed")},
+	}, WithUnitPropertyFetcher(fetcher, 10*time.Millisecond))
+
+	if _, err := sd.Poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	changes, err := sd.Poll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]map[string]string{}
+	for _, c := range changes {
+		got[c.Unit.Name] = c.Extra
+	}
+	want := map[string]map[string]string{
+		"a.service": {"version": "1.2.3", "env": "prod"},
+		"b.service": nil,
+		"c.service": nil,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("extra = %v, want %v", got, want)
+	}
+	for _, c := range changes {
+		if c.Unit.Name == "a.service" {
+			if keys := c.ExtraKeys(); !reflect.DeepEqual(keys, []string{"env", "version"}) {
+				t.Errorf("keys = %v, want sorted ones", keys)
+			}
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package systemd
+
+import "github.com/coreos/go-systemd/dbus"
+
+// failedLister is implemented by connections that can list units by states.
+type failedLister interface {
+	ListUnitsFiltered(states []string) ([]dbus.UnitStatus, error)
+}
+
+// reconcileFailed cross-checks units against the units systemd considers
+// failed, the ones systemctl --failed prints. It's called right after
+// ListUnits, so failed units that are listed in another state or are
+// missing are taken from the failed list, that is the most recent one.
+// Units listed as failed but missing from the failed list are only logged,
+// they're caught up with on the next poll.
+func (sd *Systemd) reconcileFailed(units []dbus.UnitStatus) []dbus.UnitStatus {
+	fl, ok := sd.conn.(failedLister)
+	if !ok {
+		return units
+	}
+	failed, err := fl.ListUnitsFiltered([]string{"failed"})
+	if err != nil {
+		sd.warn("cannot list failed units", "error", err)
+		return units
+	}
+
+	index := make(map[string]int, len(units))
+	for i, s := range units {
+		index[string(s.Path)] = i
+	}
+	isFailed := make(map[string]struct{}, len(failed))
+	for _, f := range failed {
+		isFailed[string(f.Path)] = struct{}{}
+		i, ok := index[string(f.Path)]
+		switch {
+		case !ok:
+			// ListUnitsByNames lists only the watched units
+			if len(sd.names) != 0 && !contains(sd.names, f.Name) {
+				continue
+			}
+			sd.warn("failed unit is not listed", "unit", f.Name)
+			units = append(units, f)
+		case units[i].ActiveState != "failed":
+			sd.warn("failed unit is listed in another state", "unit", f.Name,
+				"active_state", units[i].ActiveState, "sub_state", units[i].SubState)
+			units[i] = f
+		}
+	}
+	for _, s := range units {
+		if _, ok := isFailed[string(s.Path)]; !ok && s.ActiveState == "failed" {
+			sd.info("failed unit is missing from the failed list", "unit", s.Name)
+		}
+	}
+	return units
+}
@@ -0,0 +1,67 @@
+package systemd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/coreos/go-systemd/dbus"
+)
+
+// failedConn is a fakeConn that lists the failed units separately.
+type failedConn struct {
+	*fakeConn
+	failed []dbus.UnitStatus
+}
+
+func (c *failedConn) ListUnitsFiltered(states []string) ([]dbus.UnitStatus, error) {
+	if len(states) != 1 || states[0] != "failed" {
+		return nil, nil
+	}
+	return c.failed, nil
+}
+
+func TestFailedCrossCheck(t *testing.T) {
+	c := &failedConn{
+		fakeConn: &fakeConn{script: [][]dbus.UnitStatus{
+			{status("a.service", "active", "running"), status("b.service", "active", "running")},
+		}},
+	}
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sd, err := newWithConn(c, WithStateFile(filepath.Join(dir, "state")), WithLogger(nil),
+		WithFailedCrossCheck(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sd.Close()
+
+	if _, err = sd.Poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// ListUnits lags behind and doesn't list the failed c.service
+	c.failed = []dbus.UnitStatus{
+		status("a.service", "failed", "failed"),
+		status("c.service", "failed", "failed"),
+	}
+	changes, err := sd.Poll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 ||
+		changes[0].Unit.Name != "a.service" || !changes[0].EnteredFailed() ||
+		changes[1].Unit.Name != "c.service" || changes[1].Kind != Added {
+		t.Fatalf("changes = %v, want a.service failed and c.service added", changes)
+	}
+	if u := sd.state["/c.service"]; u.ActiveState != "failed" {
+		t.Errorf("c.service = %q, want failed", u.ActiveState)
+	}
+}
@@ -0,0 +1,106 @@
+package systemd
+
+import "time"
+
+// flap tracks recent transitions of a unit.
+type flap struct {
+	times    []time.Time
+	flapping bool
+
+	// old is the unit state before it has started flapping
+	old Unit
+}
+
+// prune forgets transitions that are out of the window ending at now.
+func (f *flap) prune(now time.Time, window time.Duration) {
+	n := 0
+	for _, t := range f.times {
+		if now.Sub(t) < window {
+			f.times[n] = t
+			n++
+		}
+	}
+	f.times = f.times[:n]
+}
+
+// detectFlap records the change transition and returns a Flapping change
+// instead of it when the unit crosses the threshold, false means that
+// the change has to be suppressed because the unit is already flapping.
+func (sd *Systemd) detectFlap(c Change) (Change, bool) {
+	path := string(c.Unit.Path)
+	f, ok := sd.flaps[path]
+	if !ok {
+		f = &flap{}
+		sd.flaps[path] = f
+	}
+	f.prune(c.Time, sd.flapWindow)
+	f.times = append(f.times, c.Time)
+	if f.flapping {
+		return c, false
+	}
+	if len(f.times) < sd.flapThreshold {
+		return c, true
+	}
+
+	f.flapping, f.old = true, c.Old
+	delete(sd.pending, path)
+	return Change{
+		Kind:        Flapping,
+		Unit:        c.Unit,
+		Old:         c.Old,
+		Time:        c.Time,
+		Transitions: len(f.times),
+		Window:      sd.flapWindow,
+	}, true
+}
+
+// nextUnflap returns the time left until the first flapping unit
+// stops flapping, that is when enough of its transitions leave the window.
+func (sd *Systemd) nextUnflap(now time.Time) (time.Duration, bool) {
+	var d time.Duration
+	ok := false
+	for _, f := range sd.flaps {
+		if !f.flapping {
+			continue
+		}
+		var left time.Duration
+		if i := len(f.times) - sd.flapThreshold; i >= 0 {
+			left = f.times[i].Add(sd.flapWindow).Sub(now)
+		}
+		if !ok || left < d {
+			d, ok = left, true
+		}
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d, ok
+}
+
+// unflapped returns changes of units that have stopped flapping at now,
+// from the state before flapping to the current one unless they're equal.
+func (sd *Systemd) unflapped(now time.Time) []Change {
+	var changes []Change
+	for path, f := range sd.flaps {
+		f.prune(now, sd.flapWindow)
+		if f.flapping && len(f.times) >= sd.flapThreshold {
+			continue
+		}
+		if len(f.times) == 0 {
+			delete(sd.flaps, path)
+		}
+		if !f.flapping {
+			continue
+		}
+		f.flapping = false
+
+		u, ok := sd.state[path]
+		if !ok || (u.ActiveState == f.old.ActiveState &&
+			u.SubState == f.old.SubState && u.LoadState == f.old.LoadState) {
+			continue
+		}
+		sd.info("unit stopped flapping", "unit", u.Name)
+		changes = append(changes, Change{Kind: Modified, Unit: u, Old: f.old, Time: now})
+	}
+	return changes
+}
@@ -0,0 +1,127 @@
+package systemd
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/systemd-slack/clock"
+	"github.com/coreos/go-systemd/dbus"
+)
+
+func TestNextFlapping(t *testing.T) {
+	sd := newFake(t, [][]dbus.UnitStatus{
+		{status("a.service", "active", "running")},
+		{status("a.service", "failed", "failed")},
+		{status("a.service", "active", "running")},
+		{status("a.service", "failed", "failed")},
+		{status("a.service", "active", "running")},
+		{status("a.service", "failed", "failed")},
+	}, WithFlapDetection(3, time.Hour))
+
+	var got []Change
+	for i := 0; i < 3; i++ {
+		changes, err := sd.Next(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, changes...)
+	}
+	if len(got) != 3 {
+		t.Fatalf("changes = %v, want failure, recovery and flapping", got)
+	}
+	if c := got[2]; c.Kind != Flapping || c.Transitions != 3 || c.Window != time.Hour {
+		t.Fatalf("change = %v, want flapping with 3 transitions in 1h", c)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if changes, err := sd.Next(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Next = %v, %v, want flapping changes to be suppressed", changes, err)
+	}
+}
+
+func TestNextUnflapWakeUp(t *testing.T) {
+	clock := clock.NewFake()
+	clock.Waits = make(chan time.Duration, 1)
+	sd := newFake(t, [][]dbus.UnitStatus{
+		{status("a.service", "active", "running")},
+		{status("a.service", "failed", "failed")},
+		{status("a.service", "active", "running")},
+		{status("a.service", "failed", "failed")},
+	}, WithFlapDetection(3, time.Minute), WithClock(clock))
+	sd.interval = time.Second
+	sd.jitter = 0
+
+	// next calls Next advancing the clock by every wait
+	next := func() ([]Change, []time.Duration) {
+		t.Helper()
+		type result struct {
+			changes []Change
+			err     error
+		}
+		done := make(chan result, 1)
+		go func() {
+			changes, err := sd.Next(context.Background())
+			done <- result{changes, err}
+		}()
+		var waits []time.Duration
+		for {
+			select {
+			case d := <-clock.Waits:
+				waits = append(waits, d)
+				clock.Advance(d)
+			case r := <-done:
+				if r.err != nil {
+					t.Fatal(r.err)
+				}
+				return r.changes, waits
+			case <-time.After(5 * time.Second):
+				t.Fatal("Next is blocked")
+			}
+		}
+	}
+	next() // failure
+	next() // recovery
+	if changes, _ := next(); len(changes) != 1 || changes[0].Kind != Flapping {
+		t.Fatalf("changes = %v, want flapping", changes)
+	}
+
+	// the unit stays failed and stops flapping when the first
+	// transition leaves the window, long before the next poll
+	sd.interval = time.Hour
+	changes, waits := next()
+	if len(changes) != 1 || !changes[0].EnteredFailed() {
+		t.Fatalf("changes = %v, want the failure after flapping", changes)
+	}
+	if want := []time.Duration{time.Minute - 2*time.Second}; !reflect.DeepEqual(waits, want) {
+		t.Errorf("waits = %v, want %v", waits, want)
+	}
+}
+
+func TestUnflapped(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	old := Unit{UnitStatus: status("a.service", "active", "running")}
+	cur := Unit{UnitStatus: status("a.service", "failed", "failed")}
+	sd := &Systemd{
+		flapThreshold: 2,
+		flapWindow:    time.Minute,
+		state:         map[string]Unit{"/a.service": cur},
+		flaps: map[string]*flap{"/a.service": {
+			times:    []time.Time{now.Add(-2 * time.Minute), now.Add(-time.Second)},
+			flapping: true,
+			old:      old,
+		}},
+	}
+
+	changes := sd.unflapped(now)
+	if len(changes) != 1 || changes[0].Old.ActiveState != "active" || !changes[0].EnteredFailed() {
+		t.Fatalf("changes = %v, want a single failure", changes)
+	}
+	if sd.flaps["/a.service"].flapping {
+		t.Error("unit is still flapping")
+	}
+}
@@ -0,0 +1,98 @@
+package systemd
+
+import "time"
+
+// delayFailure holds failures of units for the grace period, false means
+// that c is consumed: it's either held or it's a follow-up of a held
+// failure that's merged into it or that cancels it when the unit has left
+// the failed state. A cancelled failure also swallows the restart that
+// follows until the unit settles, so a unit that heals itself within
+// the grace period isn't reported at all. It returns c when the unit
+// has no held or cancelled failures.
+func (sd *Systemd) delayFailure(c Change) (Change, bool) {
+	path := string(c.Unit.Path)
+	if r, ok := sd.recovering[path]; ok {
+		switch {
+		case c.EnteredFailed():
+			// it's another failure that's held on its own
+			delete(sd.recovering, path)
+		case isTransitional(c.Unit.ActiveState):
+			return Change{}, false
+		default:
+			delete(sd.recovering, path)
+			if c.Kind != Modified && c.Kind != Recovered {
+				return c, true
+			}
+			if c.Unit.ActiveState == r.ActiveState && c.Unit.SubState == r.SubState {
+				sd.info("unit recovered within the grace period", "unit", c.Unit.Name)
+				return Change{}, false
+			}
+			// report the net change since the failure
+			c.Old = r
+			return c, true
+		}
+	}
+
+	p, ok := sd.failing[path]
+	switch {
+	case !ok && !c.EnteredFailed():
+		return c, true
+	case !ok:
+		sd.failing[path] = c
+		return Change{}, false
+	case c.Unit.ActiveState != "failed":
+		delete(sd.failing, path)
+		sd.info("unit left the failed state within the grace period", "unit", c.Unit.Name,
+			"active_state", c.Unit.ActiveState, "sub_state", c.Unit.SubState)
+		if isTransitional(c.Unit.ActiveState) {
+			sd.recovering[path] = p.Old
+		}
+		return Change{}, false
+	default:
+		m := merge(p, c)
+		m.Time = p.Time
+		sd.failing[path] = m
+		return Change{}, false
+	}
+}
+
+// isTransitional reports whether the active state is a transition
+// between the stable ones, e.g. a restart in progress.
+func isTransitional(activeState string) bool {
+	switch activeState {
+	case "activating", "deactivating", "reloading", "refreshing":
+		return true
+	default:
+		return false
+	}
+}
+
+// graced returns held failures of units that
+// have been failed at least for the grace period.
+func (sd *Systemd) graced(now time.Time) []Change {
+	var changes []Change
+	for path, c := range sd.failing {
+		if now.Sub(c.Time) < sd.grace {
+			continue
+		}
+		delete(sd.failing, path)
+		changes = append(changes, c)
+	}
+	return changes
+}
+
+// nextGrace returns how long it is until the first held failure
+// is due, false means that there are no held failures.
+func (sd *Systemd) nextGrace(now time.Time) (time.Duration, bool) {
+	var d time.Duration
+	ok := false
+	for _, c := range sd.failing {
+		if left := c.Time.Add(sd.grace).Sub(now); !ok || left < d {
+			d, ok = left, true
+		}
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d, ok
+}
@@ -0,0 +1,110 @@
+package systemd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/systemd-slack/clock"
+	"github.com/coreos/go-systemd/dbus"
+)
+
+func TestNextFailureGracePeriod(t *testing.T) {
+	clock := clock.NewFake()
+	clock.Waits = make(chan time.Duration, 1)
+	sd := newFake(t, [][]dbus.UnitStatus{
+		{status("a.service", "active", "running")},
+		{status("a.service", "failed", "failed")},
+	}, WithFailureGracePeriod(5*time.Minute), WithClock(clock))
+	sd.interval = time.Minute
+	sd.jitter = 0
+
+	type result struct {
+		changes []Change
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		changes, err := sd.Next(context.Background())
+		done <- result{changes, err}
+	}()
+
+	start := clock.Now()
+	for {
+		select {
+		case d := <-clock.Waits:
+			clock.Advance(d)
+			continue
+		case r := <-done:
+			if r.err != nil {
+				t.Fatal(r.err)
+			}
+			if len(r.changes) != 1 || !r.changes[0].EnteredFailed() {
+				t.Fatalf("changes = %v, want a single failure", r.changes)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Next is blocked")
+		}
+		break
+	}
+	if d := clock.Now().Sub(start); d < 5*time.Minute {
+		t.Errorf("failure is reported in %s, want after the grace period", d)
+	}
+}
+
+func TestFailureGracePeriodRecovered(t *testing.T) {
+	sd := newFake(t, [][]dbus.UnitStatus{
+		{status("a.service", "active", "running"), status("b.service", "active", "running"), status("c.service", "active", "running")},
+		{status("a.service", "failed", "failed"), status("b.service", "active", "running"), status("c.service", "failed", "failed")},
+		{status("a.service", "failed", "failed"), status("b.service", "active", "exited"), status("c.service", "failed", "failed")},
+		{status("a.service", "activating", "start"), status("b.service", "active", "exited"), status("c.service", "activating", "start")},
+		{status("a.service", "activating", "start"), status("b.service", "active", "exited"), status("c.service", "activating", "start")},
+		{status("a.service", "active", "running"), status("b.service", "active", "exited"), status("c.service", "inactive", "dead")},
+		{status("a.service", "active", "exited"), status("b.service", "active", "exited"), status("c.service", "inactive", "dead")},
+	}, WithFailureGracePeriod(time.Hour))
+
+	var got []Change
+	for i := 0; i < 7; i++ {
+		changes, err := sd.Poll(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, changes...)
+	}
+	// a.service restarting back to running isn't reported, c.service
+	// is reported once it settles in a state other than before failing,
+	// next changes are reported as usual
+	if len(got) != 3 || got[0].Unit.Name != "b.service" ||
+		got[1].Unit.Name != "c.service" || got[1].Kind != Modified ||
+		got[1].Old.SubState != "running" || got[1].Unit.SubState != "dead" ||
+		got[2].Unit.Name != "a.service" || got[2].Old.SubState != "running" || got[2].Unit.SubState != "exited" {
+		t.Fatalf("changes = %v, want b.service, c.service running to dead and a.service running to exited", got)
+	}
+	if len(sd.failing) != 0 || len(sd.recovering) != 0 {
+		t.Errorf("held failures = %v, recovering units = %v, want none", sd.failing, sd.recovering)
+	}
+}
+
+func TestDelayFailureMerges(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	sd := &Systemd{grace: time.Second, failing: map[string]Change{}}
+	old := Unit{UnitStatus: status("a.service", "active", "running")}
+	c1 := newChange(&old, status("a.service", "failed", "failed"), now.Add(-2*time.Second))
+	c2 := newChange(&c1.Unit, status("a.service", "failed", "exit-code"), now)
+	for _, c := range []Change{c1, c2} {
+		if _, ok := sd.delayFailure(c); ok {
+			t.Fatalf("change %v is not held", c)
+		}
+	}
+
+	if d, ok := sd.nextGrace(now); !ok || d != 0 {
+		t.Fatalf("nextGrace = %s, %t, want 0, true", d, ok)
+	}
+	changes := sd.graced(now)
+	if len(changes) != 1 || !changes[0].EnteredFailed() || changes[0].Unit.SubState != "exit-code" ||
+		!changes[0].Time.Equal(c1.Time) {
+		t.Fatalf("changes = %v, want the merged failure at the time of the first one", changes)
+	}
+}
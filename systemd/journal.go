@@ -0,0 +1,58 @@
+package systemd
+
+import (
+	"context"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// maxJournalLine is the maximum length of a journal line in bytes,
+	// longer lines are truncated.
+	maxJournalLine = 512
+
+	// journalTimeout is the maximum time journalctl can run.
+	journalTimeout = 5 * time.Second
+)
+
+// journalTail returns the last n journal lines of the named unit,
+// user makes it query the user journal.
+func journalTail(ctx context.Context, unit string, n int, user bool) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, journalTimeout)
+	defer cancel()
+
+	args := []string{"--unit", unit, "--lines", strconv.Itoa(n), "--no-pager", "--quiet", "--output", "short-iso"}
+	if user {
+		args = append(args, "--user")
+	}
+	b, err := exec.CommandContext(ctx, "journalctl", args...).Output()
+	if err != nil {
+		return nil, err
+	}
+
+	s := strings.TrimRight(string(b), "\n")
+	if s == "" {
+		return nil, nil
+	}
+	lines := strings.Split(s, "\n")
+	for i := range lines {
+		lines[i] = truncate(lines[i], maxJournalLine)
+	}
+	return lines, nil
+}
+
+// truncate cuts s to at most n bytes without breaking
+// utf-8 sequences, appending an ellipsis when it's cut.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	// step back to the beginning of a cut character
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n] + "…"
+}
@@ -0,0 +1,73 @@
+package systemd
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"strings"
+)
+
+// debug logs a message that's useful only for troubleshooting.
+func (sd *Systemd) debug(msg string, args ...interface{}) {
+	sd.log(slog.LevelDebug, msg, args...)
+}
+
+// info logs an informational message with key-value pairs.
+func (sd *Systemd) info(msg string, args ...interface{}) {
+	sd.log(slog.LevelInfo, msg, args...)
+}
+
+// warn logs a recoverable problem.
+func (sd *Systemd) warn(msg string, args ...interface{}) {
+	sd.log(slog.LevelWarn, msg, args...)
+}
+
+// error logs a problem that results in data loss.
+func (sd *Systemd) error(msg string, args ...interface{}) {
+	sd.log(slog.LevelError, msg, args...)
+}
+
+func (sd *Systemd) log(level slog.Level, msg string, args ...interface{}) {
+	if sd.logger != nil {
+		sd.logger.Log(context.Background(), level, msg, args...)
+	}
+}
+
+// transition describes how unit states changed, e.g.
+// "active: activating→failed (sub: start→failed)",
+// nil from or to leaves its side empty for added and removed units.
+func transition(from, to *Unit) string {
+	var fromActive, fromSub, toActive, toSub string
+	if from != nil {
+		fromActive, fromSub = from.ActiveState, from.SubState
+	}
+	if to != nil {
+		toActive, toSub = to.ActiveState, to.SubState
+	}
+	return "active: " + fromActive + "→" + toActive + " (sub: " + fromSub + "→" + toSub + ")"
+}
+
+// newLogHandler creates a text handler that writes records to l,
+// so l's prefix and flags are still in effect and the time is not duplicated.
+func newLogHandler(l *log.Logger) slog.Handler {
+	return slog.NewTextHandler(logWriter{l}, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+}
+
+// logWriter writes each line as a separate log entry.
+type logWriter struct {
+	l *log.Logger
+}
+
+func (w logWriter) Write(b []byte) (int, error) {
+	if err := w.l.Output(2, strings.TrimSuffix(string(b), "\n")); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
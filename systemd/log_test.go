@@ -0,0 +1,42 @@
+package systemd
+
+import (
+	"bytes"
+	"log"
+	"testing"
+
+	"github.com/coreos/go-systemd/dbus"
+)
+
+func TestWithLogger(t *testing.T) {
+	t.Parallel()
+
+	var b bytes.Buffer
+	sd := &Systemd{}
+	WithLogger(log.New(&b, "[systemd] ", 0))(sd)
+	sd.info("unit changed", "unit", "a.service", "change_kind", Modified)
+
+	want := "[systemd] level=INFO msg=\"unit changed\" unit=a.service change_kind=modified\n"
+	if b.String() != want {
+		t.Errorf("log = %q, want %q", b.String(), want)
+	}
+}
+
+func TestTransition(t *testing.T) {
+	t.Parallel()
+
+	old := &Unit{UnitStatus: dbus.UnitStatus{ActiveState: "activating", SubState: "start"}}
+	new := &Unit{UnitStatus: dbus.UnitStatus{ActiveState: "failed", SubState: "failed"}}
+	for _, tc := range []struct {
+		old, new *Unit
+		want     string
+	}{
+		{old, new, "active: activating→failed (sub: start→failed)"},
+		{nil, new, "active: →failed (sub: →failed)"},
+		{old, nil, "active: activating→ (sub: start→)"},
+	} {
+		if s := transition(tc.old, tc.new); s != tc.want {
+			t.Errorf("transition = %q, want %q", s, tc.want)
+		}
+	}
+}
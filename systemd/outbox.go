@@ -0,0 +1,169 @@
+package systemd
+
+import (
+	"os"
+	"time"
+)
+
+// outboxPath is the file where undelivered changes are kept.
+func (sd *Systemd) outboxPath() string {
+	return sd.statePath + ".pending"
+}
+
+// loadOutbox reads changes that were not acknowledged by the previous run,
+// they are returned by the first Next call.
+func (sd *Systemd) loadOutbox() error {
+	f, err := os.Open(sd.outboxPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	if err = decodeState(f, &sd.outbox); err != nil {
+		sd.error("cannot decode pending changes, they are lost", "path", f.Name(), "error", err)
+		sd.outbox = nil
+		return nil
+	}
+	sd.pruneOutbox(sd.now())
+	if len(sd.outbox) != 0 {
+		sd.redeliver = true
+		sd.info("found undelivered changes", "path", f.Name(), "count", len(sd.outbox))
+	}
+	return nil
+}
+
+// storeOutbox flushes the undelivered changes, the file is removed
+// when there are none, so a clean shutdown leaves nothing behind.
+func (sd *Systemd) storeOutbox() error {
+	if len(sd.outbox) == 0 {
+		if err := os.Remove(sd.outboxPath()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return sd.writeFile(sd.outboxPath(), sd.outbox)
+}
+
+// pruneOutbox drops undelivered changes older than the outbox age
+// and the oldest ones above the outbox size.
+func (sd *Systemd) pruneOutbox(now time.Time) {
+	n := len(sd.outbox)
+	if sd.outboxAge > 0 {
+		i := 0
+		for _, c := range sd.outbox {
+			if now.Sub(c.Time) < sd.outboxAge {
+				sd.outbox[i] = c
+				i++
+			}
+		}
+		sd.outbox = sd.outbox[:i]
+	}
+	if sd.outboxSize > 0 && len(sd.outbox) > sd.outboxSize {
+		sd.outbox = append(sd.outbox[:0], sd.outbox[len(sd.outbox)-sd.outboxSize:]...)
+	}
+	if dropped := n - len(sd.outbox); dropped != 0 {
+		sd.warn("too many undelivered changes, oldest ones dropped", "count", dropped,
+			"max_size", sd.outboxSize, "max_age", sd.outboxAge)
+	}
+}
+
+// Ack marks the changes returned by Next as delivered, reported
+// failures become acknowledged, see Unit.FailureAcked, and with
+// WithDeliveryTracking the changes are not returned again after a restart.
+//
+// It's safe to call it concurrently with Next.
+func (sd *Systemd) Ack(changes []Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	if sd.ackFailures(changes) {
+		if err := sd.store(); err != nil {
+			return err
+		}
+	}
+	return sd.unqueue(changes)
+}
+
+// Discard drops the changes returned by Next from the ones kept by
+// WithDeliveryTracking without acknowledging them, it's meant for
+// changes that are given up on, e.g. dropped by a full queue,
+// so they're not delivered again after a restart.
+//
+// It's safe to call it concurrently with Next.
+func (sd *Systemd) Discard(changes []Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	return sd.unqueue(changes)
+}
+
+// unqueue removes the changes from the outbox.
+func (sd *Systemd) unqueue(changes []Change) error {
+	if !sd.delivery {
+		return nil
+	}
+	done := make(map[outboxKey]bool, len(changes))
+	for i := range changes {
+		done[keyOf(&changes[i])] = true
+	}
+	n := 0
+	for _, c := range sd.outbox {
+		if !done[keyOf(&c)] {
+			sd.outbox[n] = c
+			n++
+		}
+	}
+	if n == len(sd.outbox) {
+		return nil
+	}
+	sd.outbox = sd.outbox[:n]
+	return sd.storeOutbox()
+}
+
+// ackFailures marks failures of the changes acknowledged unless
+// they're reported again since then, it reports whether any are.
+func (sd *Systemd) ackFailures(changes []Change) bool {
+	acked := false
+	for i := range changes {
+		c := &changes[i]
+		if !c.EnteredFailed() && c.Kind != Startup {
+			continue
+		}
+		u, ok := sd.state[string(c.Unit.Path)]
+		if !ok || u.FailureAcked || !u.FailureNotifiedAt.Equal(c.Time) {
+			continue
+		}
+		u.FailureAcked = true
+		sd.state[string(c.Unit.Path)] = u
+		acked = true
+	}
+	return acked
+}
+
+// outboxKey identifies a change, Time is not compared directly
+// because decoded values lose the monotonic clock reading.
+type outboxKey struct {
+	path string
+	kind Kind
+	time int64
+}
+
+func keyOf(c *Change) outboxKey {
+	return outboxKey{path: string(c.Unit.Path), kind: c.Kind, time: c.Time.UnixNano()}
+}
+
+// undelivered returns a copy of the changes left from the previous run.
+func (sd *Systemd) undelivered() []Change {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	sd.redeliver = false
+	return append([]Change(nil), sd.outbox...)
+}
@@ -0,0 +1,116 @@
+package systemd
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/systemd-slack/clock"
+	"github.com/coreos/go-systemd/dbus"
+)
+
+func TestDeliveryTracking(t *testing.T) {
+	sd := newFake(t, [][]dbus.UnitStatus{
+		{status("a.service", "active", "running")},
+		{status("a.service", "failed", "failed")},
+	}, WithDeliveryTracking())
+
+	changes, err := sd.Next(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Kind != Modified {
+		t.Fatalf("changes = %v, want a single modification", changes)
+	}
+	if _, err = os.Stat(sd.outboxPath()); err != nil {
+		t.Fatalf("pending changes are not stored: %s", err)
+	}
+
+	// simulate a crash before the change is delivered
+	sd.Close()
+	restart := func() *Systemd {
+		t.Helper()
+		n, err := newWithConn(&fakeConn{script: [][]dbus.UnitStatus{
+			{status("a.service", "failed", "failed")},
+		}}, WithStateFile(sd.statePath), WithLogger(nil), WithDeliveryTracking())
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.interval = time.Millisecond
+		t.Cleanup(func() { n.Close() })
+		return n
+	}
+	sd = restart()
+
+	got, err := sd.Next(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Unit.Name != "a.service" || !got[0].Time.Equal(changes[0].Time) {
+		t.Fatalf("redelivered = %v, want %v", got, changes)
+	}
+	if err = sd.Ack(got); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(sd.outboxPath()); !os.IsNotExist(err) {
+		t.Fatalf("pending changes file is not removed after ack: %v", err)
+	}
+
+	sd.Close()
+	sd = restart()
+	if sd.redeliver {
+		t.Fatal("acknowledged changes are redelivered")
+	}
+}
+
+func TestDeliveryTrackingInMemory(t *testing.T) {
+	if _, err := configure([]Option{WithInMemoryState(), WithDeliveryTracking()}); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestOutboxLimits(t *testing.T) {
+	clock := clock.NewFake()
+	sd := newFake(t, [][]dbus.UnitStatus{
+		{status("a.service", "active", "running"), status("b.service", "active", "running")},
+		{status("a.service", "failed", "failed"), status("b.service", "active", "running")},
+		{status("a.service", "active", "running"), status("b.service", "active", "running")},
+		{status("a.service", "active", "running"), status("b.service", "failed", "failed")},
+		{status("a.service", "failed", "failed"), status("b.service", "failed", "failed")},
+	}, WithDeliveryTracking(), WithOutboxLimits(2, time.Hour), WithClock(clock))
+
+	var all []Change
+	for i := 0; i < 5; i++ {
+		changes, err := sd.Poll(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, changes...)
+		clock.Advance(time.Minute)
+	}
+	if len(all) != 4 {
+		t.Fatalf("changes = %v, want 4", all)
+	}
+	if len(sd.outbox) != 2 || keyOf(&sd.outbox[0]) != keyOf(&all[2]) || keyOf(&sd.outbox[1]) != keyOf(&all[3]) {
+		t.Fatalf("outbox = %v, want the two newest changes", sd.outbox)
+	}
+
+	// discarded changes are not acknowledged
+	if err := sd.Discard(all[3:]); err != nil {
+		t.Fatal(err)
+	}
+	if len(sd.outbox) != 1 || keyOf(&sd.outbox[0]) != keyOf(&all[2]) {
+		t.Fatalf("outbox = %v, want the b.service failure", sd.outbox)
+	}
+	if sd.state["/a.service"].FailureAcked {
+		t.Error("discarded failure is acknowledged")
+	}
+
+	// changes expire after an hour
+	clock.Advance(time.Hour)
+	sd.pruneOutbox(clock.Now())
+	if len(sd.outbox) != 0 {
+		t.Errorf("outbox = %v, want it empty", sd.outbox)
+	}
+}
@@ -0,0 +1,75 @@
+package systemd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/coreos/go-systemd/dbus"
+)
+
+// fetchProperties returns the watched properties of loaded units by their
+// paths formatted as strings, properties that cannot be read are skipped,
+// that's logged once per property not to flood the log on every poll.
+func (sd *Systemd) fetchProperties(units []dbus.UnitStatus) map[string]map[string]string {
+	pg, ok := sd.conn.(propertyGetter)
+	if !ok {
+		return nil
+	}
+	m := make(map[string]map[string]string, len(units))
+	for _, u := range units {
+		if u.LoadState != "loaded" {
+			continue
+		}
+		props := make(map[string]string, len(sd.properties))
+		for _, name := range sd.properties {
+			p, err := pg.GetUnitTypeProperty(u.Name, "Unit", name)
+			if err != nil {
+				if !sd.unreadable[name] {
+					sd.unreadable[name] = true
+					sd.warn("cannot read property, next failures to read it are not logged",
+						"unit", u.Name, "property", name, "error", err)
+				}
+				continue
+			}
+			props[name] = formatProperty(p.Value.Value())
+		}
+		m[string(u.Path)] = props
+	}
+	return m
+}
+
+// formatProperty formats a property value, lists are space-separated.
+func formatProperty(v interface{}) string {
+	if ss, ok := v.([]string); ok {
+		return strings.Join(ss, " ")
+	}
+	return fmt.Sprint(v)
+}
+
+// changedProperties returns names of the watched properties that have
+// different values in old and new, ones missing in either are skipped,
+// so starting watching a property doesn't make all units changed.
+func (sd *Systemd) changedProperties(old, new map[string]string) []string {
+	var changed []string
+	for _, name := range sd.properties {
+		o, ok1 := old[name]
+		n, ok2 := new[name]
+		if ok1 && ok2 && o != n {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// equalProperties reports whether a and b have the same values.
+func equalProperties(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
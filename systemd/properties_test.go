@@ -0,0 +1,110 @@
+package systemd
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/coreos/go-systemd/dbus"
+	godbus "github.com/godbus/dbus"
+)
+
+// propsConn is a fakeConn that reports unit properties from the map,
+// missing ones cannot be read.
+type propsConn struct {
+	*fakeConn
+	props map[string]interface{}
+}
+
+func (c *propsConn) GetUnitTypeProperty(unit, unitType, name string) (*dbus.Property, error) {
+	v, ok := c.props[unit+"/"+name]
+	if !ok || unitType != "Unit" {
+		return nil, godbus.Error{Name: "org.freedesktop.DBus.Error.UnknownProperty"}
+	}
+	return &dbus.Property{Name: name, Value: godbus.MakeVariant(v)}, nil
+}
+
+func TestProperties(t *testing.T) {
+	c := &propsConn{
+		fakeConn: &fakeConn{script: [][]dbus.UnitStatus{
+			{status("a.service", "active", "running")},
+		}},
+		props: map[string]interface{}{
+			"a.service/FragmentPath": "/lib/systemd/system/a.service",
+		},
+	}
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sd, err := newWithConn(c, WithStateFile(filepath.Join(dir, "state")), WithLogger(nil),
+		WithProperties("FragmentPath", "DropInPaths"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sd.Close()
+
+	poll := func() []Change {
+		t.Helper()
+		changes, err := sd.Poll(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return changes
+	}
+	poll() // bootstrap
+
+	// a property that starts being readable is remembered silently
+	c.props["a.service/DropInPaths"] = []string{"/etc/systemd/system/a.service.d/a.conf"}
+	if changes := poll(); len(changes) != 0 {
+		t.Fatalf("changes = %v, want none", changes)
+	}
+	if got := sd.state["/a.service"].Properties["DropInPaths"]; got != "/etc/systemd/system/a.service.d/a.conf" {
+		t.Errorf("DropInPaths = %q, want it remembered", got)
+	}
+
+	c.props["a.service/DropInPaths"] = []string{
+		"/etc/systemd/system/a.service.d/a.conf",
+		"/etc/systemd/system/a.service.d/b.conf",
+	}
+	changes := poll()
+	if len(changes) != 1 || changes[0].Kind != Modified ||
+		!reflect.DeepEqual(changes[0].ChangedProperties, []string{"DropInPaths"}) {
+		t.Fatalf("changes = %v, want DropInPaths modified", changes)
+	}
+	if changes := poll(); len(changes) != 0 {
+		t.Fatalf("changes = %v, want none after the change", changes)
+	}
+}
+
+func TestPropertiesWarnOnce(t *testing.T) {
+	t.Parallel()
+
+	var b bytes.Buffer
+	sd := &Systemd{
+		conn:       &propsConn{fakeConn: &fakeConn{}},
+		properties: []string{"Misspelled"},
+		unreadable: make(map[string]bool),
+	}
+	WithLogger(log.New(&b, "", 0))(sd)
+
+	units := []dbus.UnitStatus{
+		status("a.service", "active", "running"),
+		status("b.service", "active", "running"),
+	}
+	for i := 0; i < 3; i++ {
+		sd.fetchProperties(units)
+	}
+	if n := strings.Count(b.String(), "cannot read property"); n != 1 {
+		t.Errorf("warnings = %d, want 1, log:\n%s", n, b.String())
+	}
+}
@@ -0,0 +1,89 @@
+package systemd
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// QuietRule matches transitions that are not noteworthy, e.g. a oneshot
+// service that exited cleanly being stopped, changes matching
+// any of WithQuietRules are updated in the state but not reported.
+type QuietRule struct {
+	// Pattern is a unit name glob, see filepath.Match, empty matches any.
+	Pattern string
+
+	// From and To are the old and the new states, either an active state,
+	// e.g. "inactive", or an active and a sub state, e.g. "active/exited",
+	// empty or "*" matches any.
+	From string
+	To   string
+}
+
+// DefaultQuietRules are transitions that are expected
+// in normal operation of timers, sockets and oneshot services.
+var DefaultQuietRules = []QuietRule{
+	{Pattern: "*.service", From: "active/exited", To: "inactive/dead"},
+	{Pattern: "*.timer", From: "active/waiting", To: "active/running"},
+	{Pattern: "*.timer", From: "active/running", To: "active/waiting"},
+	{Pattern: "*.socket", From: "active/listening", To: "active/running"},
+	{Pattern: "*.socket", From: "active/running", To: "active/listening"},
+}
+
+// ParseQuietRule parses a rule in the "pattern:from->to" format,
+// e.g. "*.service:active/exited->inactive/dead", the pattern is optional.
+func ParseQuietRule(s string) (QuietRule, error) {
+	var r QuietRule
+	states := s
+	if i := strings.LastIndexByte(s, ':'); i >= 0 {
+		r.Pattern, states = s[:i], s[i+1:]
+		if _, err := filepath.Match(r.Pattern, ""); err != nil {
+			return r, fmt.Errorf("malformed quiet rule pattern %q: %s", r.Pattern, err)
+		}
+	}
+	i := strings.Index(states, "->")
+	if i < 0 {
+		return r, fmt.Errorf("malformed quiet rule %q, want pattern:from->to", s)
+	}
+	r.From, r.To = strings.TrimSpace(states[:i]), strings.TrimSpace(states[i+2:])
+	return r, nil
+}
+
+// String returns the rule in the ParseQuietRule format.
+func (r QuietRule) String() string {
+	return r.Pattern + ":" + r.From + "->" + r.To
+}
+
+// matches reports whether the change is the rule transition.
+func (r *QuietRule) matches(c *Change) bool {
+	if c.Kind != Modified {
+		return false
+	}
+	if r.Pattern != "" {
+		if ok, _ := filepath.Match(r.Pattern, c.Unit.Name); !ok {
+			return false
+		}
+	}
+	return matchState(r.From, &c.Old) && matchState(r.To, &c.Unit)
+}
+
+// matchState reports whether the unit is in the active or active/sub state.
+func matchState(state string, u *Unit) bool {
+	if state == "" || state == "*" {
+		return true
+	}
+	if i := strings.IndexByte(state, '/'); i >= 0 {
+		return state[:i] == u.ActiveState && state[i+1:] == u.SubState
+	}
+	return state == u.ActiveState
+}
+
+// isQuiet reports whether the change matches any of the quiet rules.
+func (sd *Systemd) isQuiet(c *Change) bool {
+	for i := range sd.quietRules {
+		if sd.quietRules[i].matches(c) {
+			return true
+		}
+	}
+	return false
+}
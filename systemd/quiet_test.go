@@ -0,0 +1,58 @@
+package systemd
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coreos/go-systemd/dbus"
+)
+
+func TestParseQuietRule(t *testing.T) {
+	t.Parallel()
+
+	for s, want := range map[string]QuietRule{
+		"*.service:active/exited->inactive/dead": {"*.service", "active/exited", "inactive/dead"},
+		"active->inactive":                       {"", "active", "inactive"},
+		"a.service:*->inactive":                  {"a.service", "*", "inactive"},
+	} {
+		r, err := ParseQuietRule(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r != want {
+			t.Errorf("ParseQuietRule(%q) = %+v, want %+v", s, r, want)
+		}
+	}
+	for _, s := range []string{"active", "[:active->inactive"} {
+		if _, err := ParseQuietRule(s); err == nil {
+			t.Errorf("ParseQuietRule(%q) expected an error", s)
+		}
+	}
+}
+
+func TestQuietRules(t *testing.T) {
+	t.Parallel()
+
+	sd, err := NewOffline(WithInMemoryState(), WithLogger(nil), WithQuietRules(DefaultQuietRules...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sd.Close()
+
+	for i, tc := range []struct {
+		units []dbus.UnitStatus
+		want  int
+	}{
+		{[]dbus.UnitStatus{status("a.service", "active", "exited"), status("b.timer", "active", "waiting")}, 0},
+		{[]dbus.UnitStatus{status("a.service", "inactive", "dead"), status("b.timer", "active", "running")}, 0},
+		{[]dbus.UnitStatus{status("a.service", "failed", "failed"), status("b.timer", "active", "waiting")}, 1},
+	} {
+		changes, err := sd.Replay(context.Background(), tc.units)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(changes) != tc.want {
+			t.Errorf("replay %d: changes = %v, want %d", i, changes, tc.want)
+		}
+	}
+}
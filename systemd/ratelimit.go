@@ -0,0 +1,41 @@
+package systemd
+
+import "time"
+
+// limit is the rate limiter state of a unit, it's a token bucket
+// of size one that's refilled every rate limit interval.
+type limit struct {
+	last       time.Time
+	suppressed int
+}
+
+// allow reports whether the change can be reported now, otherwise it's
+// counted as suppressed and the count is attached to the next allowed one.
+func (sd *Systemd) allow(c *Change) bool {
+	if sd.rateLimit <= 0 {
+		return true
+	}
+	path := string(c.Unit.Path)
+	l, ok := sd.limits[path]
+	if !ok {
+		l = &limit{}
+		sd.limits[path] = l
+	}
+	if !l.last.IsZero() && c.Time.Sub(l.last) < sd.rateLimit {
+		l.suppressed++
+		sd.info("change suppressed by rate limit", "unit", c.Unit.Name, "change_kind", c.Kind)
+		return false
+	}
+	c.Suppressed, l.suppressed, l.last = l.suppressed, 0, c.Time
+	return true
+}
+
+// forgetLimits drops rate limiter states that have no suppressed changes
+// and are refilled already, so they don't pile up for removed units.
+func (sd *Systemd) forgetLimits(now time.Time) {
+	for path, l := range sd.limits {
+		if l.suppressed == 0 && now.Sub(l.last) >= sd.rateLimit {
+			delete(sd.limits, path)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package systemd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAllow(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	sd := &Systemd{rateLimit: time.Minute, limits: map[string]*limit{}}
+	change := func(d time.Duration) *Change {
+		return &Change{
+			Kind: Modified,
+			Unit: Unit{UnitStatus: status("a.service", "failed", "failed")},
+			Time: now.Add(d),
+		}
+	}
+
+	if !sd.allow(change(0)) {
+		t.Fatal("the first change is suppressed")
+	}
+	for _, d := range []time.Duration{time.Second, 30 * time.Second} {
+		if sd.allow(change(d)) {
+			t.Fatalf("change at +%s is allowed", d)
+		}
+	}
+	c := change(time.Minute)
+	if !sd.allow(c) {
+		t.Fatal("change after the interval is suppressed")
+	}
+	if c.Suppressed != 2 {
+		t.Errorf("suppressed = %d, want 2", c.Suppressed)
+	}
+
+	sd.forgetLimits(now.Add(2 * time.Minute))
+	if len(sd.limits) != 0 {
+		t.Errorf("limits = %v, want empty", sd.limits)
+	}
+}
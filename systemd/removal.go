@@ -0,0 +1,69 @@
+package systemd
+
+import (
+	"strings"
+
+	"github.com/coreos/go-systemd/dbus"
+)
+
+// unitFileLister is implemented by connections that can list unit files.
+type unitFileLister interface {
+	ListUnitFilesByPatterns(states, patterns []string) ([]dbus.UnitFile, error)
+}
+
+// fetchRemoval looks up the unit file of the named unit that has
+// disappeared from the list to find out why. Unit files are read
+// from disk, unlike querying a unit it doesn't make systemd load
+// it again, so garbage collected units stay unloaded.
+// It returns an empty string when the reason cannot be read.
+func (sd *Systemd) fetchRemoval(name string) string {
+	fl, ok := sd.conn.(unitFileLister)
+	if !ok {
+		return ""
+	}
+	files, err := fl.ListUnitFilesByPatterns(nil, []string{escapeGlob(name)})
+	if err != nil {
+		sd.warn("cannot look up unit file of removed unit", "unit", name, "error", err)
+		return ""
+	}
+	for _, f := range files {
+		if unitName(f.Path) == name {
+			return removalReason(f.Type)
+		}
+	}
+	return removalReason("")
+}
+
+// removalReason describes why a unit whose unit file has the enablement
+// state is removed, the state is empty when there's no unit file.
+func removalReason(fileState string) string {
+	switch fileState {
+	case "":
+		return "unit file deleted"
+	case "masked", "masked-runtime":
+		return "masked"
+	case "bad":
+		return "unit file is broken"
+	default:
+		// inactive units are garbage collected
+		return "unloaded"
+	}
+}
+
+// unitName returns the unit name of the unit file path.
+func unitName(path string) string {
+	return path[strings.LastIndexByte(path, '/')+1:]
+}
+
+// escapeGlob escapes glob metacharacters in s, unit names
+// contain backslashes, e.g. dev-disk-by\x2duuid.device.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`\*?[`, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,91 @@
+package systemd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/coreos/go-systemd/dbus"
+)
+
+// unitFilesConn is a fakeConn that lists unit files with their states
+// by unit names, units missing in the map have no unit files.
+type unitFilesConn struct {
+	*fakeConn
+	files map[string]string
+}
+
+func (c *unitFilesConn) ListUnitFilesByPatterns(states, patterns []string) ([]dbus.UnitFile, error) {
+	var files []dbus.UnitFile
+	for name, state := range c.files {
+		for _, p := range patterns {
+			if ok, _ := filepath.Match(p, name); ok {
+				files = append(files, dbus.UnitFile{Path: "/lib/systemd/system/" + name, Type: state})
+			}
+		}
+	}
+	return files, nil
+}
+
+func TestRemovalReason(t *testing.T) {
+	c := &unitFilesConn{
+		fakeConn: &fakeConn{script: [][]dbus.UnitStatus{
+			{
+				status("a.service", "active", "running"),
+				status("b.service", "inactive", "dead"),
+				status("c.service", "inactive", "dead"),
+				status(`d\x2dx.service`, "inactive", "dead"),
+			},
+			{},
+		}},
+		// b.service is absent from the unit files list
+		files: map[string]string{
+			"a.service":      "masked",
+			"c.service":      "enabled",
+			`d\x2dx.service`: "static",
+		},
+	}
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sd, err := newWithConn(c, WithStateFile(filepath.Join(dir, "state")), WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sd.Close()
+
+	changes, err := sd.Poll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes, err = sd.Poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]string{}
+	for _, c := range changes {
+		if c.Kind != Removed {
+			t.Errorf("%s change = %s, want removed", c.Unit.Name, c.Kind)
+		}
+		got[c.Unit.Name] = c.RemovalReason
+	}
+	want := map[string]string{
+		"a.service":      "masked",
+		"b.service":      "unit file deleted",
+		"c.service":      "unloaded",
+		`d\x2dx.service`: "unloaded",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("reasons = %v, want %v", got, want)
+	}
+	for name, reason := range want {
+		if got[name] != reason {
+			t.Errorf("%s reason = %q, want %q", name, got[name], reason)
+		}
+	}
+}
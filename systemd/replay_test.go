@@ -0,0 +1,209 @@
+package systemd
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/go-systemd/dbus"
+)
+
+func TestReplay(t *testing.T) {
+	t.Parallel()
+
+	var (
+		running  = status("a.service", "active", "running")
+		failed   = status("a.service", "failed", "failed")
+		starting = status("a.service", "activating", "start")
+		restart  = status("a.service", "activating", "auto-restart")
+		exited   = status("a.service", "active", "exited")
+		other    = status("b.service", "active", "running")
+		timer    = status("c.timer", "active", "waiting")
+	)
+	for _, tc := range []struct {
+		name  string
+		opts  []Option
+		steps [][]dbus.UnitStatus
+		want  [][]string // "unit kind" per step
+	}{
+		{
+			name:  "bootstrap is silent",
+			steps: [][]dbus.UnitStatus{{running, other}},
+			want:  [][]string{nil},
+		},
+		{
+			name:  "unchanged units",
+			steps: [][]dbus.UnitStatus{{running}, {running}},
+			want:  [][]string{nil, nil},
+		},
+		{
+			name:  "added and removed",
+			steps: [][]dbus.UnitStatus{{running}, {running, other}, {other}},
+			want:  [][]string{nil, {"b.service added"}, {"a.service removed"}},
+		},
+		{
+			name:  "failure and recovery",
+			steps: [][]dbus.UnitStatus{{running}, {failed}, {starting}, {running}},
+			want:  [][]string{nil, {"a.service modified"}, {"a.service modified"}, {"a.service recovered"}},
+		},
+		{
+			name:  "failure seen at bootstrap",
+			steps: [][]dbus.UnitStatus{{failed}, {running}},
+			want:  [][]string{nil, {"a.service modified"}},
+		},
+		{
+			name:  "repeated failure",
+			steps: [][]dbus.UnitStatus{{running}, {failed}, {starting}, {failed}, {running}},
+			want: [][]string{nil, {"a.service modified"}, {"a.service modified"},
+				{"a.service modified"}, {"a.service recovered"}},
+		},
+		{
+			name:  "startup report recovery",
+			opts:  []Option{WithStartupReport()},
+			steps: [][]dbus.UnitStatus{{failed}, {running}},
+			want:  [][]string{{"a.service startup"}, {"a.service recovered"}},
+		},
+		{
+			name:  "sub state change",
+			steps: [][]dbus.UnitStatus{{running}, {exited}},
+			want:  [][]string{nil, {"a.service modified"}},
+		},
+		{
+			name:  "startup report",
+			opts:  []Option{WithStartupReport()},
+			steps: [][]dbus.UnitStatus{{failed, other}},
+			want:  [][]string{{"a.service startup"}},
+		},
+		{
+			name:  "failed only",
+			opts:  []Option{WithFailedOnly()},
+			steps: [][]dbus.UnitStatus{{running}, {starting}, {failed}, {running}},
+			want:  [][]string{nil, nil, {"a.service modified"}, {"a.service recovered"}},
+		},
+		{
+			name:  "watched sub states",
+			opts:  []Option{WithFailedOnly(), WithSubStates("auto-restart")},
+			steps: [][]dbus.UnitStatus{{running}, {restart}, {starting}, {restart}, {restart}},
+			want:  [][]string{nil, {"a.service modified"}, nil, {"a.service modified"}, nil},
+		},
+		{
+			name:  "collapsed observations",
+			opts:  []Option{WithCollapse()},
+			steps: [][]dbus.UnitStatus{{running}, {failed, other, starting}, {other, failed, running, starting}},
+			want:  [][]string{nil, {"a.service modified", "b.service added"}, nil},
+		},
+		{
+			name:  "unit types",
+			opts:  []Option{WithUnitTypes("timer")},
+			steps: [][]dbus.UnitStatus{{timer}, {timer, running}, {running}},
+			want:  [][]string{nil, nil, {"c.timer removed"}},
+		},
+		{
+			name:  "exclude",
+			opts:  []Option{WithExclude("a.*")},
+			steps: [][]dbus.UnitStatus{{running, other}, {failed}},
+			want:  [][]string{nil, {"b.service removed"}},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			sd, err := NewOffline(append([]Option{WithInMemoryState(), WithLogger(nil)}, tc.opts...)...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sd.Close()
+
+			for i, units := range tc.steps {
+				changes, err := sd.Replay(context.Background(), units)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var got []string
+				for _, c := range changes {
+					got = append(got, c.Unit.Name+" "+c.Kind.String())
+				}
+				if !reflect.DeepEqual(got, tc.want[i]) {
+					t.Errorf("step %d: changes = %q, want %q", i, got, tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestReplayDoesntModifyUnits(t *testing.T) {
+	t.Parallel()
+
+	sd, err := NewOffline(WithInMemoryState(), WithLogger(nil), WithExclude("a.*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sd.Close()
+
+	units := []dbus.UnitStatus{status("a.service", "active", "running"), status("b.service", "active", "running")}
+	if _, err = sd.Replay(context.Background(), units); err != nil {
+		t.Fatal(err)
+	}
+	if units[0].Name != "a.service" || units[1].Name != "b.service" {
+		t.Errorf("units = %v, filtered in place", units)
+	}
+	if _, err = sd.Poll(context.Background()); err == nil {
+		t.Error("expected an error polling an offline instance")
+	}
+}
+
+func TestReplayFailureLifecycle(t *testing.T) {
+	t.Parallel()
+
+	sd, err := NewOffline(WithInMemoryState(), WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sd.Close()
+
+	replay := func(units ...dbus.UnitStatus) []Change {
+		changes, err := sd.Replay(context.Background(), units)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return changes
+	}
+	unit := func() Unit {
+		return sd.Snapshot()[0]
+	}
+
+	replay(status("a.service", "active", "running"))
+	failure := replay(status("a.service", "failed", "failed"))
+	if u := unit(); u.FailedAt.IsZero() || !u.FailureNotifiedAt.Equal(failure[0].Time) || u.FailureAcked {
+		t.Fatalf("unit = %+v, want a notified unacknowledged failure", u)
+	}
+	if err = sd.Ack(failure); err != nil {
+		t.Fatal(err)
+	}
+	if !unit().FailureAcked {
+		t.Fatal("failure is not acknowledged")
+	}
+
+	// reported again after a restart attempt
+	replay(status("a.service", "activating", "start"))
+	again := replay(status("a.service", "failed", "failed"))
+	if u := unit(); u.FailureAcked || !u.FailureNotifiedAt.Equal(again[0].Time) {
+		t.Fatalf("unit = %+v, want the repeated failure unacknowledged", u)
+	}
+
+	// acknowledging the old failure doesn't acknowledge the new one
+	if err = sd.Ack(failure); err != nil {
+		t.Fatal(err)
+	}
+	if unit().FailureAcked {
+		t.Fatal("stale ack acknowledges the repeated failure")
+	}
+
+	if c := replay(status("a.service", "active", "running")); c[0].Kind != Recovered {
+		t.Fatalf("kind = %s, want %s", c[0].Kind, Recovered)
+	}
+	if u := unit(); !u.FailedAt.IsZero() || !u.FailureNotifiedAt.IsZero() || u.FailureAcked {
+		t.Errorf("unit = %+v, want the failure reset", u)
+	}
+}
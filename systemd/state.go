@@ -0,0 +1,329 @@
+package systemd
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// load loads state from the state file.
+//
+// A state file that cannot be decoded is moved aside to <path>.corrupt
+// and the state is started from scratch in bootstrap mode.
+func (sd *Systemd) load() error {
+	if sd.inMemory {
+		sd.bootstrap = true
+		return nil
+	}
+
+	// bootstrap is enabled when the state file doesn't exist or it's empty.
+	state, err := os.Lstat(sd.statePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			sd.bootstrap = true
+			sd.info("state file doesn't exist, enable bootstrap mode", "path", sd.statePath)
+			return nil
+		}
+		return err
+	}
+	if state.Size() == 0 {
+		sd.bootstrap = true
+		sd.info("state file is empty, enable bootstrap mode", "path", sd.statePath)
+		return nil
+	}
+
+	f, err := os.OpenFile(sd.statePath, os.O_RDONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = decodeState(f, &sd.state)
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, errStateVersion) {
+		// moving it aside would lose the state on a downgrade
+		return fmt.Errorf("%s: %w", sd.statePath, err)
+	}
+
+	sd.error("cannot decode state file, enable bootstrap mode", "path", sd.statePath, "error", err)
+	sd.state = make(map[string]Unit)
+	sd.bootstrap = true
+	if err = os.Rename(sd.statePath, sd.statePath+".corrupt"); err != nil {
+		sd.error("cannot move corrupt state file aside", "path", sd.statePath, "error", err)
+	}
+	return nil
+}
+
+// store flushes current state to the state file.
+//
+// The state is written to a temporary file in the same directory first
+// that's renamed to the state file then, so it's always a complete snapshot.
+func (sd *Systemd) store() error {
+	if sd.inMemory {
+		return nil
+	}
+	return sd.writeFile(sd.statePath, sd.state)
+}
+
+// writeFile atomically replaces the named file with v
+// encoded in the state format.
+func (sd *Systemd) writeFile(name string, v interface{}) error {
+	f, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // noop when renamed
+
+	if err = encodeState(f, v, sd.stateFormat, sd.compress); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+
+	err = os.Rename(f.Name(), name)
+	if lerr, ok := err.(*os.LinkError); ok && lerr.Err == syscall.EXDEV {
+		// the state file is on a different filesystem than its
+		// directory, e.g. it's bind-mounted into a container
+		return copyFile(name, f.Name())
+	}
+	return err
+}
+
+// StateFormat is a state file encoding.
+type StateFormat string
+
+const (
+	// GobFormat is gob encoding, it's compact but opaque.
+	GobFormat StateFormat = "gob"
+
+	// JSONFormat is pretty-printed json that's easy to inspect and edit.
+	JSONFormat StateFormat = "json"
+)
+
+// Compression is a state file compression algorithm.
+type Compression string
+
+const (
+	// NoCompression writes the state as is.
+	NoCompression Compression = "none"
+
+	// GzipCompression is gzip, it's readable with standard tools.
+	GzipCompression Compression = "gzip"
+
+	// ZstdCompression is zstd, it's faster and more compact than gzip.
+	ZstdCompression Compression = "zstd"
+)
+
+// zstdMagic is the zstd frame magic number.
+const zstdMagic = "\x28\xb5\x2f\xfd"
+
+// gobMagic prefixes gob state files followed by a version byte,
+// a gob stream never starts with zero because it's a message length.
+const gobMagic = "\x00sds"
+
+// gobVersion is the gob state schema version, bump it when Unit or Change
+// is changed incompatibly and convert older versions in decodeState.
+//
+// Files without the header are version 0, they differ only
+// in having no header, gob ignores added and missing fields.
+const gobVersion = 1
+
+// errStateVersion is returned for state files written by a newer version.
+var errStateVersion = errors.New("state file is written by a newer version")
+
+// decodeState reads state written by encodeState from r into v,
+// the format and compression are detected automatically.
+func decodeState(r io.Reader, v interface{}) error {
+	br := bufio.NewReader(r)
+	b, err := br.Peek(2)
+	if err != nil {
+		return err
+	}
+
+	if m, _ := br.Peek(len(zstdMagic)); string(m) == zstdMagic {
+		zr, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		br = bufio.NewReader(zr)
+		if b, err = br.Peek(1); err != nil {
+			return err
+		}
+	}
+
+	// gzip magic number
+	if b[0] == 0x1f && len(b) > 1 && b[1] == 0x8b {
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		br = bufio.NewReader(gr)
+		if b, err = br.Peek(1); err != nil {
+			return err
+		}
+	}
+
+	// gob streams start with a type definition length that's never
+	// a printable character, so it doesn't collide with a json object
+	if b[0] == '{' || b[0] == '[' {
+		return json.NewDecoder(br).Decode(v)
+	}
+	if h, _ := br.Peek(len(gobMagic) + 1); len(h) == len(gobMagic)+1 && string(h[:len(gobMagic)]) == gobMagic {
+		if version := h[len(gobMagic)]; version > gobVersion {
+			return fmt.Errorf("%w: %d, supported %d", errStateVersion, version, gobVersion)
+		}
+		br.Discard(len(h))
+	}
+	return gob.NewDecoder(br).Decode(v)
+}
+
+// encodeState writes v to w in the given format and compression,
+// empty compression means no compression.
+func encodeState(w io.Writer, v interface{}, format StateFormat, compress Compression) error {
+	var cw io.WriteCloser
+	switch compress {
+	case "", NoCompression:
+		return encode(w, v, format)
+	case GzipCompression:
+		cw = gzip.NewWriter(w)
+	case ZstdCompression:
+		zw, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1), zstd.WithEncoderLevel(zstd.SpeedFastest))
+		if err != nil {
+			return err
+		}
+		cw = zw
+	default:
+		return fmt.Errorf("unknown state compression %q", compress)
+	}
+	if err := encode(cw, v, format); err != nil {
+		cw.Close()
+		return err
+	}
+	return cw.Close()
+}
+
+// encode writes v to w in the given format.
+func encode(w io.Writer, v interface{}, format StateFormat) error {
+	switch format {
+	case GobFormat:
+		if _, err := w.Write(append([]byte(gobMagic), gobVersion)); err != nil {
+			return err
+		}
+		return gob.NewEncoder(w).Encode(v)
+	case JSONFormat:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	default:
+		return fmt.Errorf("unknown state format %q", format)
+	}
+}
+
+// copyFile overwrites dst file with src contents in place.
+func copyFile(dst, src string) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	if err = w.Sync(); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// defaultStatePath returns the default state file path following
+// systemd and XDG conventions: StateDirectory= of the service first,
+// then /var/lib for root and XDG_STATE_HOME for other users,
+// the current directory is used only when nothing else is known.
+func defaultStatePath(getenv func(string) string, uid int) string {
+	if dir := getenv("STATE_DIRECTORY"); dir != "" {
+		// multiple directories are separated by colons
+		if i := strings.IndexByte(dir, ':'); i >= 0 {
+			dir = dir[:i]
+		}
+		return filepath.Join(dir, "systemd-slack.state")
+	}
+	if uid == 0 {
+		return "/var/lib/systemd-slack/state"
+	}
+	if dir := getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "systemd-slack", "state")
+	}
+	if home := getenv("HOME"); home != "" {
+		return filepath.Join(home, ".local", "state", "systemd-slack", "state")
+	}
+	return "systemd.state"
+}
+
+// lock acquires an exclusive advisory lock on <state file>.lock,
+// the state file itself cannot be locked because store replaces it.
+//
+// The state file directory is created when it doesn't exist.
+func (sd *Systemd) lock() error {
+	if sd.inMemory {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(sd.statePath), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(sd.statePath+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return fmt.Errorf("another instance holds the lock on %s", f.Name())
+		}
+		return err
+	}
+	sd.lockFile = f
+	return nil
+}
+
+// unlock releases the state file lock, the lock file is left in place
+// because removing it races with other instances acquiring the lock.
+func (sd *Systemd) unlock() error {
+	if sd.lockFile == nil {
+		return nil
+	}
+	err := sd.lockFile.Close()
+	sd.lockFile = nil
+	return err
+}
@@ -0,0 +1,312 @@
+package systemd
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/go-systemd/dbus"
+)
+
+func TestStore(t *testing.T) {
+	for _, format := range []StateFormat{GobFormat, JSONFormat} {
+		for _, compress := range []Compression{NoCompression, GzipCompression, ZstdCompression} {
+			t.Run(fmt.Sprintf("%s/%s", format, compress), func(t *testing.T) {
+				testStore(t, format, compress)
+			})
+		}
+	}
+}
+
+func testStore(t *testing.T, format StateFormat, compress Compression) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sd := &Systemd{
+		stateFormat: format,
+		compress:    compress,
+		state: map[string]Unit{
+			"/foo": {UnitStatus: dbus.UnitStatus{Name: "foo.service"}},
+			"/bar": {UnitStatus: dbus.UnitStatus{Name: "bar.service"}},
+		},
+		statePath: filepath.Join(dir, "state"),
+	}
+	if err = sd.store(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a smaller state mustn't leave a tail of the previous one
+	delete(sd.state, "/bar")
+	if err = sd.store(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("temporary files are left in the state directory: %d files", len(files))
+	}
+
+	sd.state = map[string]Unit{}
+	if err = sd.load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(sd.state) != 1 || sd.state["/foo"].Name != "foo.service" {
+		t.Errorf("state = %v, want only foo.service", sd.state)
+	}
+}
+
+func TestCloseFlushes(t *testing.T) {
+	sd := newFake(t, [][]dbus.UnitStatus{
+		{status("a.service", "active", "running")},
+	})
+	if _, err := sd.Poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// usage is remembered without flushing the state
+	u := sd.state["/a.service"]
+	u.MemoryCurrent = 42
+	sd.state["/a.service"] = u
+	if err := sd.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := &Systemd{statePath: sd.statePath, state: map[string]Unit{}}
+	if err := loaded.load(); err != nil {
+		t.Fatal(err)
+	}
+	if got := loaded.state["/a.service"].MemoryCurrent; got != 42 {
+		t.Errorf("stored memory = %d, want 42", got)
+	}
+}
+
+func TestCloseBootstrap(t *testing.T) {
+	sd := newFake(t, [][]dbus.UnitStatus{
+		{status("a.service", "active", "running")},
+	})
+	if err := sd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(sd.statePath); !os.IsNotExist(err) {
+		t.Errorf("state file is written before the first poll: %v", err)
+	}
+}
+
+func TestLoadCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "state")
+	if err = ioutil.WriteFile(path, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sd := &Systemd{state: map[string]Unit{}, statePath: path}
+	if err = sd.load(); err != nil {
+		t.Fatal(err)
+	}
+	if !sd.bootstrap {
+		t.Errorf("bootstrap mode is not enabled")
+	}
+	if _, err = os.Stat(path + ".corrupt"); err != nil {
+		t.Errorf("corrupt state file is not moved aside: %s", err)
+	}
+}
+
+func TestStateVersion(t *testing.T) {
+	t.Parallel()
+
+	want := map[string]Unit{"/foo": {UnitStatus: dbus.UnitStatus{Name: "foo.service"}}}
+	var legacy, current bytes.Buffer
+	if err := gob.NewEncoder(&legacy).Encode(want); err != nil {
+		t.Fatal(err)
+	}
+	if err := encodeState(&current, want, GobFormat, NoCompression); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(current.Bytes(), []byte(gobMagic+"\x01")) {
+		t.Fatalf("state = %q, want the version header", current.Bytes())
+	}
+
+	for name, b := range map[string][]byte{"legacy": legacy.Bytes(), "current": current.Bytes()} {
+		var got map[string]Unit
+		if err := decodeState(bytes.NewReader(b), &got); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: state = %v, want %v", name, got, want)
+		}
+	}
+
+	newer := append([]byte(gobMagic+"\x02"), legacy.Bytes()...)
+	var got map[string]Unit
+	if err := decodeState(bytes.NewReader(newer), &got); !errors.Is(err, errStateVersion) {
+		t.Fatalf("err = %v, want a version error", err)
+	}
+
+	// loading is refused and the file is kept
+	path := filepath.Join(t.TempDir(), "state")
+	if err := ioutil.WriteFile(path, newer, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sd := &Systemd{state: map[string]Unit{}, statePath: path}
+	if err := sd.load(); !errors.Is(err, errStateVersion) {
+		t.Fatalf("load err = %v, want a version error", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("newer state file is moved: %s", err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	t.Parallel()
+
+	want := map[string]Unit{"/foo": {UnitStatus: dbus.UnitStatus{Name: "foo.service"}}}
+	for compress, magic := range map[Compression]string{
+		NoCompression:   gobMagic,
+		GzipCompression: "\x1f\x8b",
+		ZstdCompression: zstdMagic,
+	} {
+		var b bytes.Buffer
+		if err := encodeState(&b, want, GobFormat, compress); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(b.Bytes(), []byte(magic)) {
+			t.Errorf("%s: state starts with %q, want %q", compress, b.Bytes()[:4], magic)
+		}
+		var got map[string]Unit
+		if err := decodeState(&b, &got); err != nil {
+			t.Fatalf("%s: %s", compress, err)
+		}
+		if got["/foo"].Name != "foo.service" {
+			t.Errorf("%s: state = %v, want %v", compress, got, want)
+		}
+	}
+}
+
+// BenchmarkEncodeState compares compression algorithms
+// on encoding of a large state map.
+func BenchmarkEncodeState(b *testing.B) {
+	state := make(map[string]Unit, 5000)
+	for i := 0; i < 5000; i++ {
+		name := fmt.Sprintf("unit-%d.service", i)
+		state["/"+name] = Unit{UnitStatus: dbus.UnitStatus{
+			Name:        name,
+			Description: "benchmark unit " + name,
+			LoadState:   "loaded",
+			ActiveState: "active",
+			SubState:    "running",
+		}}
+	}
+	for _, compress := range []Compression{NoCompression, GzipCompression, ZstdCompression} {
+		b.Run(string(compress), func(b *testing.B) {
+			var buf bytes.Buffer
+			for i := 0; i < b.N; i++ {
+				buf.Reset()
+				if err := encodeState(&buf, state, GobFormat, compress); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(buf.Len()), "bytes/state")
+		})
+	}
+}
+
+func TestLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the state directory is created by the first lock
+	path := filepath.Join(dir, "sub", "state")
+	sd1 := &Systemd{statePath: path}
+	if err = sd1.lock(); err != nil {
+		t.Fatal(err)
+	}
+
+	sd2 := &Systemd{statePath: path}
+	if err = sd2.lock(); err == nil {
+		t.Fatal("lock is acquired twice")
+	}
+
+	if err = sd1.unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err = sd2.lock(); err != nil {
+		t.Fatal(err)
+	}
+	sd2.unlock()
+}
+
+func TestDefaultStatePath(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		env  map[string]string
+		uid  int
+		want string
+	}{
+		{map[string]string{"STATE_DIRECTORY": "/var/lib/a:/var/lib/b"}, 0, "/var/lib/a/systemd-slack.state"},
+		{map[string]string{"XDG_STATE_HOME": "/home/u/.state"}, 0, "/var/lib/systemd-slack/state"},
+		{map[string]string{"XDG_STATE_HOME": "/home/u/.state", "HOME": "/home/u"}, 1000, "/home/u/.state/systemd-slack/state"},
+		{map[string]string{"HOME": "/home/u"}, 1000, "/home/u/.local/state/systemd-slack/state"},
+		{nil, 1000, "systemd.state"},
+	} {
+		getenv := func(k string) string { return tc.env[k] }
+		if s := defaultStatePath(getenv, tc.uid); s != tc.want {
+			t.Errorf("defaultStatePath(%v, %d) = %q, want %q", tc.env, tc.uid, s, tc.want)
+		}
+	}
+}
+
+func TestInMemoryState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sd := &Systemd{
+		state:     map[string]Unit{"/foo": {}},
+		statePath: filepath.Join(dir, "state"),
+		inMemory:  true,
+	}
+	if err = sd.lock(); err != nil {
+		t.Fatal(err)
+	}
+	if err = sd.load(); err != nil {
+		t.Fatal(err)
+	}
+	if !sd.bootstrap {
+		t.Errorf("bootstrap mode is not enabled")
+	}
+	if err = sd.store(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("state directory contains %d files, want none", len(files))
+	}
+}
@@ -1,219 +1,1745 @@
 package systemd
 
 import (
-	"compress/gzip"
-	"encoding/gob"
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"log/slog"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/amenzhinsky/systemd-slack/clock"
+	"github.com/amenzhinsky/systemd-slack/metrics"
 	"github.com/coreos/go-systemd/dbus"
 )
 
 var (
-	DefaultStateFile = "systemd.state"
+	DefaultStateFile = defaultStatePath(os.Getenv, os.Getuid())
 	DefaultInterval  = 500 * time.Millisecond
 )
 
+// MinInterval is the shortest allowed interval, shorter ones
+// make the watcher spin listing units and load dbus for nothing.
+const MinInterval = 100 * time.Millisecond
+
+// DefaultIntervalJitter is the default poll interval jitter fraction.
+const DefaultIntervalJitter = 0.1
+
 // Option is a configuration value.
 type Option func(sd *Systemd)
 
 // WithStateFile sets path to the state file, if the file doesn't
-// exist it's created automatically when systemd flushes its state.
+// exist it's created automatically when systemd flushes its state,
+// along with its directory.
+//
+// The state file is guarded by an advisory lock on <path>.lock
+// that's held until Close, so only one instance can use it.
 func WithStateFile(path string) Option {
 	return func(sd *Systemd) {
 		sd.statePath = path
 	}
 }
 
+// WithStateFormat sets the state file format, GobFormat is the default.
+// Existing state files are loaded regardless of their format.
+func WithStateFormat(format StateFormat) Option {
+	return func(sd *Systemd) {
+		sd.stateFormat = format
+	}
+}
+
+// WithCompression sets compression of the state file, by default only
+// GobFormat state is gzipped, zstd is faster and smaller on big states.
+// Existing state files are loaded regardless of their compression.
+func WithCompression(c Compression) Option {
+	return func(sd *Systemd) {
+		sd.compress = c
+		sd.compressSet = true
+	}
+}
+
+// WithInMemoryState keeps the state only in memory for the process
+// lifetime, the state file isn't read, written nor locked.
+// The first poll is still silent like in bootstrap mode.
+func WithInMemoryState() Option {
+	return func(sd *Systemd) {
+		sd.inMemory = true
+	}
+}
+
+// WithDeliveryTracking keeps changes returned by Next in <state-file>.pending
+// until they are acknowledged with Ack, the ones left from a crashed
+// or interrupted run are returned by the first Next call.
+// That gives at-least-once delivery, so a change may be repeated.
+//
+// It cannot be used together with WithInMemoryState.
+func WithDeliveryTracking() Option {
+	return func(sd *Systemd) {
+		sd.delivery = true
+	}
+}
+
+// DefaultOutboxSize and DefaultOutboxAge bound the changes
+// kept by WithDeliveryTracking by default.
+const (
+	DefaultOutboxSize = 1000
+	DefaultOutboxAge  = 24 * time.Hour
+)
+
+// WithOutboxLimits bounds the changes kept by WithDeliveryTracking,
+// ones older than age and the oldest ones above size are dropped and
+// that's logged, so a long notifier outage doesn't make the outbox
+// grow without limit. Zero values disable the corresponding limit.
+func WithOutboxLimits(size int, age time.Duration) Option {
+	return func(sd *Systemd) {
+		sd.outboxSize = size
+		sd.outboxAge = age
+	}
+}
+
 // WithLogger sets logger, nil disables logging.
+// Messages are formatted as key=value pairs, see WithSlogger.
 func WithLogger(l *log.Logger) Option {
+	return func(sd *Systemd) {
+		sd.logger = nil
+		if l != nil {
+			sd.logger = slog.New(newLogHandler(l))
+		}
+	}
+}
+
+// WithSlogger sets structured logger, nil disables logging.
+// Unit changes are logged with unit, change_kind, active_state,
+// load_state and sub_state attributes.
+func WithSlogger(l *slog.Logger) Option {
 	return func(sd *Systemd) {
 		sd.logger = l
 	}
 }
 
-// WithInterval sets systemd the interval between the ListUnits api call.
+// WithInterval sets systemd the interval between the ListUnits api call,
+// it cannot be shorter than MinInterval.
+//
+// States that last shorter than the interval may go unnoticed, so
+// intervals longer than a few seconds miss quick restarts and more than
+// a minute delay notifications considerably, use WithSubscription instead.
 func WithInterval(d time.Duration) Option {
 	return func(sd *Systemd) {
 		sd.interval = d
 	}
 }
 
-// New returns a systemd instance.
-func New(opts ...Option) (*Systemd, error) {
-	c, err := dbus.New()
+// WithIntervalJitter randomizes every sleep between polls by up to
+// the fraction of the interval in both directions, so watchers started
+// on many hosts at once don't list units simultaneously.
+// It's DefaultIntervalJitter by default, 0 disables it.
+func WithIntervalJitter(fraction float64) Option {
+	return func(sd *Systemd) {
+		sd.jitter = fraction
+	}
+}
+
+// WithAdaptiveInterval makes the interval double after every poll
+// without changes up to max and drop back to the WithInterval one
+// as soon as a change is seen, that cuts dbus load on idle systems
+// while staying responsive during bursts. Zero disables it.
+//
+// It affects only polling, with WithSubscription updates trigger polls.
+func WithAdaptiveInterval(max time.Duration) Option {
+	return func(sd *Systemd) {
+		sd.maxInterval = max
+	}
+}
+
+// WithExtendedEquality makes all dbus.UnitStatus fields count when units
+// are compared between polls, by default only Name, LoadState, ActiveState
+// and SubState do, so changes of Description, Followed, JobId, JobType
+// and JobPath are reported as Modified too.
+func WithExtendedEquality() Option {
+	return func(sd *Systemd) {
+		sd.extendedEqual = true
+	}
+}
+
+// WithBootstrap overrides whether the first poll is silent, by default
+// it is only when the state file doesn't exist, is empty or corrupt.
+//
+// With false and no state all currently present units are reported
+// as Added once, with true the first poll never reports anything
+// and just records changes made during the downtime.
+func WithBootstrap(silent bool) Option {
+	return func(sd *Systemd) {
+		sd.forceBootstrap = silent
+		sd.bootstrapSet = true
+	}
+}
+
+// WithSubscription makes systemd subscribe to dbus unit signals
+// and call ListUnits only when a unit change is pushed instead of
+// polling it every interval. When the subscription cannot be set up
+// it falls back to polling.
+func WithSubscription() Option {
+	return func(sd *Systemd) {
+		sd.subscribe = true
+	}
+}
+
+// WithListUnitsRetry sets how many times a ListUnits call is retried
+// on transient errors like timeouts before giving up, others errors
+// such as access denied are returned immediately.
+func WithListUnitsRetry(n int) Option {
+	return func(sd *Systemd) {
+		sd.listRetries = n
+	}
+}
+
+// WithDBusAddress makes systemd connect to the bus at addr instead of
+// the system one, e.g. unix:path=/proc/<leader pid>/root/run/dbus/system_bus_socket
+// to watch a container's service manager, or unix:path=/run/systemd/private
+// to talk to systemd directly. Journal tails are still read locally.
+func WithDBusAddress(addr string) Option {
+	return func(sd *Systemd) {
+		sd.busAddress = addr
+		sd.connect = addressConnection(addr)
+	}
+}
+
+// WithStartupReport makes the first poll in bootstrap mode report units
+// that are already failed as Startup changes instead of staying silent.
+func WithStartupReport() Option {
+	return func(sd *Systemd) {
+		sd.startupReport = true
+	}
+}
+
+// WithUserBus makes systemd connect to the user session bus
+// to watch units of the current user's service manager, that are
+// managed with systemctl --user, instead of the system ones.
+func WithUserBus() Option {
+	return func(sd *Systemd) {
+		sd.connect = dbus.NewUserConnection
+		sd.userBus = true
+	}
+}
+
+// WithUnitTypes makes systemd watch only units of the given types,
+// that are unit name suffixes like ".service" or ".timer", the leading
+// dot can be omitted. All unit types are watched by default.
+func WithUnitTypes(types ...string) Option {
+	return func(sd *Systemd) {
+		for _, t := range types {
+			if !strings.HasPrefix(t, ".") {
+				t = "." + t
+			}
+			sd.unitTypes = append(sd.unitTypes, t)
+		}
+	}
+}
+
+// WithMetrics makes systemd report the number of tracked
+// and failed units and detected changes to m.
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(sd *Systemd) {
+		sd.metrics = m
+	}
+}
+
+// WithDebounce makes Next report a unit change only after the unit
+// has stayed in the same state for at least d, intermediate states
+// of a flapping unit collapse into a single change from the state it
+// had before the first change to the last one, d = 0 disables it.
+//
+// When polling, states are observed only every interval, so flaps
+// shorter than it may go unnoticed at all, units are also listed when
+// a pending change is due so it's reported about d after the last
+// observed change. Pending changes are not stored and lost on restart.
+func WithDebounce(d time.Duration) Option {
+	return func(sd *Systemd) {
+		sd.debounce = d
+	}
+}
+
+// WithFailureGracePeriod makes Next report a failure only when the unit
+// has stayed failed for at least d. Failures of units that leave the
+// failed state within d aren't reported at all, neither are their changes
+// until they leave it nor the restart that follows until the unit settles,
+// settling back in the state before the failure isn't reported either.
+// Held failures are not stored and are lost on restart. d = 0 disables it.
+func WithFailureGracePeriod(d time.Duration) Option {
+	return func(sd *Systemd) {
+		sd.grace = d
+	}
+}
+
+// WithFlapDetection makes Next report a single Flapping change instead
+// of individual ones when a unit changes its state at least threshold
+// times within window, next changes are suppressed until the unit calms
+// down, then the change from the state before flapping is reported.
+// threshold = 0 disables it.
+func WithFlapDetection(threshold int, window time.Duration) Option {
+	return func(sd *Systemd) {
+		sd.flapThreshold = threshold
+		sd.flapWindow = window
+	}
+}
+
+// WithPerUnitRateLimit makes Next report at most one change of every
+// unit per interval, the number of dropped changes is attached to the
+// next reported one, interval = 0 disables it.
+func WithPerUnitRateLimit(interval time.Duration) Option {
+	return func(sd *Systemd) {
+		sd.rateLimit = interval
+	}
+}
+
+// WithDedup makes Next drop a change when an identical one, that is of the
+// same kind and with the same unit states, has been reported within ttl,
+// that guards against posting the same message twice. Zero disables it.
+//
+// Keep ttl short, a unit that really fails twice within it is reported once.
+func WithDedup(ttl time.Duration) Option {
+	return func(sd *Systemd) {
+		sd.dedup = ttl
+	}
+}
+
+// WithQuietRules makes Next drop changes matching any of the rules,
+// e.g. DefaultQuietRules, the state is updated regardless of them.
+func WithQuietRules(rules ...QuietRule) Option {
+	return func(sd *Systemd) {
+		sd.quietRules = append(sd.quietRules, rules...)
+	}
+}
+
+// WithSuppressionHook makes Next call fn with every change dropped
+// by WithFailedOnly, WithQuietRules, WithDedup or WithPerUnitRateLimit and the reason,
+// "filtered", "duplicate" or "rate limited". fn is called while polling,
+// so it must not block or call methods of the watcher.
+func WithSuppressionHook(fn func(c Change, reason string)) Option {
+	return func(sd *Systemd) {
+		sd.onSuppress = fn
+	}
+}
+
+// WithRestarts makes Next read NRestarts of service units and report
+// Modified changes when they increase, that catches units restarted
+// by systemd after crashes or OOM kills without entering the failed state.
+// It costs an extra dbus call per watched service unit on every poll.
+func WithRestarts() Option {
+	return func(sd *Systemd) {
+		sd.restarts = true
+	}
+}
+
+// WithProperties makes Next track the named properties of loaded units,
+// e.g. Description, FragmentPath or DropInPaths, and report Modified
+// changes listing them in Change.ChangedProperties when they change,
+// that catches reconfigurations and redeploys.
+// It costs an extra dbus call per property and loaded unit on every poll.
+func WithProperties(names ...string) Option {
+	return func(sd *Systemd) {
+		sd.properties = append(sd.properties, names...)
+	}
+}
+
+// WithDependencies makes Next look up dependencies of failed units,
+// such as Requires, After and TriggeredBy, and list the failed ones
+// in Change.CausedBy, that helps telling cascading failures apart.
+// It costs a few extra dbus calls per failure.
+func WithDependencies() Option {
+	return func(sd *Systemd) {
+		sd.dependencies = true
+	}
+}
+
+// WithResourceUsage makes Next remember memory and cpu usage of running
+// units, so changes have the last known values when units fail or restart.
+// It costs two extra dbus calls per running unit on every poll.
+func WithResourceUsage() Option {
+	return func(sd *Systemd) {
+		sd.usage = true
+	}
+}
+
+// WithJournalTail makes Next attach the last n journal lines of units
+// that have just failed to their changes, n = 0 disables it.
+// Lines are read with journalctl, too long lines are truncated.
+func WithJournalTail(n int) Option {
+	return func(sd *Systemd) {
+		sd.journalLines = n
+	}
+}
+
+// WithUnitPropertyFetcher makes Next attach key-value pairs returned by fn
+// to reported changes of units, e.g. a version label taken from the unit's
+// environment. It's called for every reported change after the state lock
+// is released and it's abandoned after the timeout, timeout <= 0 means
+// DefaultFetcherTimeout. Failed calls are logged and skipped, changes
+// redelivered by WithDeliveryTracking are posted without the pairs.
+func WithUnitPropertyFetcher(fn func(ctx context.Context, unit string) (map[string]string, error), timeout time.Duration) Option {
+	return func(sd *Systemd) {
+		if timeout <= 0 {
+			timeout = DefaultFetcherTimeout
+		}
+		sd.fetcher, sd.fetcherTimeout = fn, timeout
+	}
+}
+
+// WithUnits makes systemd watch only the named units, they're fetched with
+// ListUnitsByNames that doesn't scan all loaded units and returns
+// even inactive ones. A removed unit is reported as Modified
+// with "not-found" LoadState. Other filters still apply.
+// It can be used multiple times, names are accumulated.
+func WithUnits(names ...string) Option {
+	return func(sd *Systemd) {
+		sd.names = append(sd.names, names...)
+	}
+}
+
+// WithInclude makes systemd watch only units whose names match at least
+// one of the given patterns, see filepath.Match for the patterns syntax.
+// It can be used multiple times, patterns are accumulated.
+func WithInclude(patterns ...string) Option {
+	return func(sd *Systemd) {
+		sd.include = append(sd.include, patterns...)
+	}
+}
+
+// WithExclude makes systemd ignore units whose names match any
+// of the given patterns, exclusion takes precedence over WithInclude.
+// Patterns syntax is the same as for filepath.Match.
+func WithExclude(patterns ...string) Option {
+	return func(sd *Systemd) {
+		sd.exclude = append(sd.exclude, patterns...)
+	}
+}
+
+// WithFailedOnly makes Next report only units that enter
+// or leave the failed state, other changes are tracked silently.
+func WithFailedOnly() Option {
+	return func(sd *Systemd) {
+		sd.failedOnly = true
+	}
+}
+
+// WithCollapse makes units observed several times within a single
+// poll, e.g. after a burst of subscription updates, reported once
+// with the net change between the stored and the last observed state.
+func WithCollapse() Option {
+	return func(sd *Systemd) {
+		sd.collapse = true
+	}
+}
+
+// WithMaxUnits caps the number of units kept in the state, so it and
+// the state file cannot grow without bound on hosts with many transient
+// units, n = 0 means no limit. When the state is full transient units,
+// such as scopes, sessions and mounts, are evicted first, then the ones
+// that have changed least recently, evictions are logged. Failed units and
+// active ones with a failure, restart or annotation history are never
+// evicted. Evicted units are not reported until there's room for them
+// again, unless they fail, then they're reported as added.
+func WithMaxUnits(n int) Option {
+	return func(sd *Systemd) {
+		sd.maxUnits = n
+	}
+}
+
+// WithFailedCrossCheck makes every poll cross-check the listed units
+// against ListUnitsFiltered with the failed state, so the watcher's
+// failures match systemctl --failed, discrepancies are logged and
+// reconciled in favour of the failed list.
+func WithFailedCrossCheck() Option {
+	return func(sd *Systemd) {
+		sd.crossCheck = true
+	}
+}
+
+// WithSubStates makes Next always report units entering any of the sub
+// states, e.g. auto-restart, even when WithFailedOnly or WithQuietRules
+// would drop the change, WithDedup and WithPerUnitRateLimit still apply.
+func WithSubStates(states ...string) Option {
+	return func(sd *Systemd) {
+		sd.subStates = append(sd.subStates, states...)
+	}
+}
+
+// WithClock replaces the wall clock used for polling intervals, debouncing,
+// grace periods, rate limits and retries, it's mostly needed in tests.
+func WithClock(c clock.Clock) Option {
+	return func(sd *Systemd) {
+		sd.clock = c
+	}
+}
+
+// New returns a systemd instance, ctx is used only for establishing
+// the dbus connection.
+func New(ctx context.Context, opts ...Option) (*Systemd, error) {
+	sd, err := configure(opts)
+	if err != nil {
+		return nil, err
+	}
+	sd.dial = func(ctx context.Context) (conn, error) {
+		c, err := dial(ctx, sd.connect)
+		if err != nil {
+			if sd.busAddress != "" {
+				return nil, fmt.Errorf("cannot connect to dbus at %s: %w", sd.busAddress, err)
+			}
+			return nil, err
+		}
+		return c, nil
+	}
+
+	c, err := sd.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err = sd.init(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+	sd.notifyReady()
+	return sd, nil
+}
+
+// ListUnits connects to dbus and returns units passing the filters
+// sorted by names, the state file is not touched, opts are the same
+// as of New but only the connection and filter ones are in effect.
+func ListUnits(ctx context.Context, opts ...Option) ([]dbus.UnitStatus, error) {
+	sd, err := configure(opts)
+	if err != nil {
+		return nil, err
+	}
+	c, err := dial(ctx, sd.connect)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	sd.conn = c
+
+	units, err := sd.callListUnits(ctx)
+	if err != nil {
+		return nil, err
+	}
+	n := 0
+	for _, u := range units {
+		if sd.isWatched(u.Name) {
+			units[n] = u
+			n++
+		}
+	}
+	units = units[:n]
+	sort.Slice(units, func(i, j int) bool {
+		return units[i].Name < units[j].Name
+	})
+	return units, nil
+}
+
+// NewOffline returns a systemd instance without a dbus connection,
+// units are fed to it with Replay, Next and Poll fail.
+func NewOffline(opts ...Option) (*Systemd, error) {
+	return newWithConn(offlineConn{}, opts...)
+}
+
+// offlineConn is the connection of offline instances.
+type offlineConn struct{}
+
+func (offlineConn) ListUnits() ([]dbus.UnitStatus, error) {
+	return nil, errors.New("systemd: offline instance cannot list units")
+}
+
+func (offlineConn) Close() {}
+
+// newWithConn creates a systemd instance using the given connection,
+// it's needed to inject a fake connection in tests.
+func newWithConn(c conn, opts ...Option) (*Systemd, error) {
+	sd, err := configure(opts)
 	if err != nil {
 		return nil, err
 	}
+	if err = sd.init(c); err != nil {
+		return nil, err
+	}
+	return sd, nil
+}
 
+// configure creates a systemd instance with default settings
+// and applies opts to it.
+func configure(opts []Option) (*Systemd, error) {
 	sd := &Systemd{
-		conn:      c,
-		state:     make(map[string]Unit),
-		statePath: DefaultStateFile,
-		interval:  DefaultInterval,
-		logger:    log.New(os.Stdout, "[systemd] ", log.LstdFlags),
+		connect:     dbus.New,
+		clock:       clock.Real,
+		retryDelay:  time.Second,
+		listRetries: 3,
+		state:       make(map[string]Unit),
+		pending:     make(map[string]Change),
+		failing:     make(map[string]Change),
+		recovering:  make(map[string]Unit),
+		flaps:       make(map[string]*flap),
+		limits:      make(map[string]*limit),
+		seen:        make(map[dedupKey]time.Time),
+		unreadable:  make(map[string]bool),
+		evicted:     make(map[string]struct{}),
+		statePath:   DefaultStateFile,
+		stateFormat: GobFormat,
+		outboxSize:  DefaultOutboxSize,
+		outboxAge:   DefaultOutboxAge,
+		interval:    DefaultInterval,
+		jitter:      DefaultIntervalJitter,
+		logger:      slog.New(slog.NewTextHandler(os.Stdout, nil)).With("component", "systemd"),
 	}
 	for _, opt := range opts {
 		opt(sd)
 	}
+	switch sd.stateFormat {
+	case GobFormat, JSONFormat:
+	default:
+		return nil, fmt.Errorf("unknown state format %q", sd.stateFormat)
+	}
+	if !sd.compressSet {
+		sd.compress = NoCompression
+		if sd.stateFormat == GobFormat {
+			sd.compress = GzipCompression
+		}
+	}
+	switch sd.compress {
+	case NoCompression, GzipCompression, ZstdCompression:
+	default:
+		return nil, fmt.Errorf("unknown state compression %q", sd.compress)
+	}
+	for _, p := range append(sd.include, sd.exclude...) {
+		if _, err := filepath.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("malformed pattern %q: %s", p, err)
+		}
+	}
+	if sd.interval < MinInterval {
+		return nil, fmt.Errorf("interval %s is shorter than %s", sd.interval, MinInterval)
+	}
+	if sd.maxInterval != 0 && sd.maxInterval < sd.interval {
+		return nil, fmt.Errorf("maximum interval %s is shorter than interval %s", sd.maxInterval, sd.interval)
+	}
+	if sd.jitter < 0 || sd.jitter >= 1 {
+		return nil, fmt.Errorf("interval jitter %g is out of [0, 1) range", sd.jitter)
+	}
+	if sd.busAddress != "" {
+		if sd.userBus {
+			return nil, errors.New("dbus address cannot be used with the user bus")
+		}
+		if err := validateBusAddress(sd.busAddress); err != nil {
+			return nil, err
+		}
+	}
+	if sd.delivery && sd.inMemory {
+		return nil, errors.New("delivery tracking requires a state file")
+	}
+	if sd.flapThreshold > 0 && sd.flapWindow <= 0 {
+		return nil, fmt.Errorf("flap detection window must be positive, got %s", sd.flapWindow)
+	}
+	if sd.maxUnits < 0 {
+		return nil, fmt.Errorf("max units must not be negative, got %d", sd.maxUnits)
+	}
+	return sd, nil
+}
+
+// init makes sd use the connection c and loads the state.
+func (sd *Systemd) init(c conn) error {
+	sd.conn = c
+	if err := sd.lock(); err != nil {
+		return err
+	}
+
+	if sd.subscribe {
+		if err := sd.subscribeUpdates(); err != nil {
+			sd.warn("subscription failed, fall back to polling", "error", err)
+		}
+	}
+	if sd.updates != nil {
+		sd.info("watching units using dbus subscription")
+	} else {
+		sd.info("watching units by polling", "interval", sd.interval)
+	}
 
 	// load state
-	if err = sd.load(); err != nil {
-		return nil, err
+	if err := sd.load(); err != nil {
+		sd.unlock()
+		return err
 	}
-	return sd, nil
+	if sd.delivery {
+		if err := sd.loadOutbox(); err != nil {
+			sd.unlock()
+			return err
+		}
+	}
+	if sd.bootstrapSet && sd.bootstrap != sd.forceBootstrap {
+		sd.bootstrap = sd.forceBootstrap
+		sd.info("bootstrap mode is overridden", "bootstrap", sd.bootstrap)
+	}
+	return nil
 }
 
 // Systemd is an units watcher.
+//
+// Next and Watch must not be called concurrently with each other,
+// the rest of the methods are safe to call from multiple goroutines
+// as well as concurrently with Next except for Close.
 type Systemd struct {
-	conn      conn
-	state     map[string]Unit
-	statePath string
-	logger    *log.Logger
-	interval  time.Duration
-	bootstrap bool
-}
+	// lastPoll is unix nanoseconds, it's accessed atomically
+	// so it has to be the first field to be 64-bit aligned
+	lastPoll int64
 
-// conn is needed to mock systemd connection in tests
-type conn interface {
-	ListUnits() ([]dbus.UnitStatus, error)
-	Close()
-}
+	// mu guards the state and the bootstrap flag, they're read
+	// and annotated while Next is running, and the filters
+	// and the interval that are changed by Reload.
+	// It's held for the whole poll, so a snapshot is always consistent.
+	mu sync.RWMutex
 
-// Next
-func (sd *Systemd) Next() ([]Unit, error) {
-	first := true
+	conn           conn
+	connect        func() (*dbus.Conn, error)
+	userBus        bool
+	busAddress     string
+	dial           func(ctx context.Context) (conn, error)
+	retryDelay     time.Duration
+	listRetries    int
+	state          map[string]Unit
+	lastChange     time.Time
+	statePath      string
+	stateFormat    StateFormat
+	compress       Compression
+	compressSet    bool
+	lockFile       *os.File
+	inMemory       bool
+	delivery       bool
+	redeliver      bool
+	outbox         []Change
+	outboxSize     int
+	outboxAge      time.Duration
+	logger         *slog.Logger
+	interval       time.Duration
+	jitter         float64
+	maxInterval    time.Duration
+	idlePolls      int
+	bootstrap      bool
+	bootstrapSet   bool
+	forceBootstrap bool
+	polled         bool
+	subscribe      bool
+	include        []string
+	exclude        []string
+	unitTypes      []string
+	names          []string
+	failedOnly     bool
+	collapse       bool
+	maxUnits       int
+	evicted        map[string]struct{}
+	crossCheck     bool
+	subStates      []string
+	quietRules     []QuietRule
+	startupReport  bool
+	journalLines   int
+	fetcher        func(ctx context.Context, unit string) (map[string]string, error)
+	fetcherTimeout time.Duration
+	restarts       bool
+	restartsBuf    map[string]uint32
+	dependencies   bool
+	extendedEqual  bool
+	properties     []string
+	unreadable     map[string]bool
+	usage          bool
+	usageBuf       map[string]usage
+	listed         map[string]struct{}
+	debounce       time.Duration
+	grace          time.Duration
+	failing        map[string]Change
+	recovering     map[string]Unit
+	pending        map[string]Change
+	flapThreshold  int
+	flapWindow     time.Duration
+	flaps          map[string]*flap
+	rateLimit      time.Duration
+	limits         map[string]*limit
+	dedup          time.Duration
+	seen           map[dedupKey]time.Time
+	onSuppress     func(c Change, reason string)
+	watchdog       time.Duration
+	clock          clock.Clock
+	metrics        *metrics.Metrics
+	updates        chan *dbus.SubStateUpdate
+	errs           chan error
+}
 
+// Next blocks until at least one unit is added, modified or removed
+// and returns the changes, ListUnits is called once per interval.
+//
+// With WithDeliveryTracking the first call returns changes
+// that were not acknowledged by the previous run if there are any.
+//
+// It returns ctx.Err() when the context is cancelled.
+func (sd *Systemd) Next(ctx context.Context) ([]Change, error) {
+	if sd.redeliver {
+		return sd.undelivered(), nil
+	}
 	for {
-		units, err := sd.conn.ListUnits()
+		if sd.polled {
+			if err := sd.wait(ctx); err != nil {
+				return nil, err
+			}
+		}
+		changes, err := sd.poll(ctx)
 		if err != nil {
 			return nil, err
 		}
+		if len(changes) != 0 {
+			sd.idlePolls = 0
+			return changes, nil
+		}
+		sd.idlePolls++
+	}
+}
+
+// Poll calls ListUnits once without waiting and returns the changes,
+// there may be none, it's meant for running periodically, e.g. by cron.
+//
+// With WithDeliveryTracking the first call returns changes that were
+// not acknowledged by the previous run in front of the new ones.
+// Changes held by WithDebounce are reported only by later calls.
+func (sd *Systemd) Poll(ctx context.Context) ([]Change, error) {
+	var changes []Change
+	if sd.redeliver {
+		changes = sd.undelivered()
+	}
+	polled, err := sd.poll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return append(changes, polled...), nil
+}
+
+// Watch runs Next in a separate goroutine and sends change batches
+// to the returned channel until ctx is done, both channels are closed then.
+//
+// A fatal error is sent to the error channel before closing them,
+// Next mustn't be called while the watcher is running.
+func (sd *Systemd) Watch(ctx context.Context) (<-chan []Change, <-chan error) {
+	changec := make(chan []Change)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(changec)
+		defer close(errc)
+		for {
+			changes, err := sd.Next(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					errc <- err
+				}
+				return
+			}
+
+			select {
+			case changec <- changes:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return changec, errc
+}
 
-		flush := false
-		for _, s := range units {
-			if unit, ok := sd.state[string(s.Path)]; ok && unit.isEqual(s) {
+// poll calls ListUnits once, diffs the result against the current state
+// and flushes the state when anything has changed.
+func (sd *Systemd) poll(ctx context.Context) ([]Change, error) {
+	units, err := sd.listUnits(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if sd.crossCheck {
+		units = sd.reconcileFailed(units)
+	}
+	sd.polled = true
+	atomic.StoreInt64(&sd.lastPoll, sd.now().UnixNano())
+	sd.notifyWatchdog()
+	changes, err := sd.diff(ctx, units)
+	if err != nil {
+		return nil, err
+	}
+	sd.attachExtra(ctx, changes)
+	return changes, nil
+}
+
+// Replay diffs units against the state as if ListUnits returned them
+// and returns the changes, it's the same logic that Next runs on every
+// poll including filters, so notifiers and filters can be tested
+// end-to-end with synthetic units, see NewOffline. units are not modified.
+//
+// It must not be called concurrently with Next.
+func (sd *Systemd) Replay(ctx context.Context, units []dbus.UnitStatus) ([]Change, error) {
+	changes, err := sd.diff(ctx, append([]dbus.UnitStatus(nil), units...))
+	if err != nil {
+		return nil, err
+	}
+	sd.attachExtra(ctx, changes)
+	return changes, nil
+}
+
+// diff filters units in place, compares them with the state
+// and flushes the state when anything has changed. Only comparing
+// holds the state lock, units and changes are enriched with dbus calls
+// and the journal around it, so Snapshot, Ack and annotations
+// don't wait for them.
+func (sd *Systemd) diff(ctx context.Context, units []dbus.UnitStatus) ([]Change, error) {
+	units = sd.filter(units)
+	f := sd.fetch(units)
+	changes, failed, flush := sd.compare(units, f)
+	sd.enrich(ctx, changes, failed)
+	if err := sd.commit(changes, flush); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// filter drops units that are not watched in place,
+// ListUnits returns a new slice every time.
+func (sd *Systemd) filter(units []dbus.UnitStatus) []dbus.UnitStatus {
+	sd.mu.RLock()
+	defer sd.mu.RUnlock()
+	n := 0
+	for _, s := range units {
+		if sd.isWatched(s.Name) {
+			units[n] = s
+			n++
+		}
+	}
+	units = units[:n]
+	if sd.collapse {
+		units = collapse(units)
+	}
+	return units
+}
+
+// fetched are properties of listed units that are compared with
+// the state or remembered in it, they're fetched without the state lock.
+type fetched struct {
+	restarts map[string]uint32
+	props    map[string]map[string]string
+	usages   map[string]usage
+}
+
+// fetch reads the properties of units that are enabled by options.
+func (sd *Systemd) fetch(units []dbus.UnitStatus) fetched {
+	var f fetched
+	if sd.restarts {
+		f.restarts = sd.fetchRestarts(units)
+	}
+	if len(sd.properties) != 0 {
+		f.props = sd.fetchProperties(units)
+	}
+	if sd.usage {
+		f.usages = sd.fetchUsage(units)
+	}
+	return f
+}
+
+// compare compares units with the state and updates it, it returns
+// the reported changes, names of failed units when causes of failures
+// have to be looked up and whether the state has to be flushed.
+func (sd *Systemd) compare(units []dbus.UnitStatus, f fetched) ([]Change, map[string]bool, bool) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	// usage doesn't make units changed, it's only remembered
+	for path, us := range f.usages {
+		if u, ok := sd.state[path]; ok {
+			u.setUsage(us)
+			sd.state[path] = u
+		}
+	}
+
+	// listed units are collected to find removed ones in a single pass,
+	// the set is reused between polls like the restarts and usage maps
+	if sd.listed == nil {
+		sd.listed = make(map[string]struct{}, len(units))
+	}
+	clear(sd.listed)
+
+	var changes []Change
+	flush := false
+	now := sd.now()
+	for _, s := range units {
+		sd.listed[string(s.Path)] = struct{}{}
+		if sd.maxUnits > 0 {
+			if skip, adopted := sd.readmit(s); skip {
+				flush = flush || adopted
 				continue
 			}
+		}
+		old, ok := sd.state[string(s.Path)]
+		r, hasRestarts := f.restarts[string(s.Path)]
+		p, hasProps := f.props[string(s.Path)]
+		var changed []string
+		if hasProps {
+			changed = sd.changedProperties(old.Properties, p)
+		}
+		if ok && old.isEqual(s, sd.extendedEqual) && (!hasRestarts || r <= old.Restarts) && len(changed) == 0 {
+			// the counter is reset when the unit is stopped manually
+			if hasRestarts && r < old.Restarts {
+				old.Restarts = r
+				sd.state[string(s.Path)] = old
+				flush = true
+			}
+			// newly watched properties are remembered silently
+			if hasProps && !equalProperties(old.Properties, p) {
+				old.Properties = p
+				sd.state[string(s.Path)] = old
+				flush = true
+			}
+			continue
+		}
+
+		var c Change
+		if ok {
+			c = newChange(&old, s, now)
+		} else {
+			c = newChange(nil, s, now)
+		}
+		if hasRestarts {
+			c.Unit.Restarts = r
+		}
+		if hasProps {
+			c.Unit.Properties = p
+			c.ChangedProperties = changed
+		}
+		if us, ok := f.usages[string(s.Path)]; ok {
+			c.Unit.setUsage(us)
+		}
+
+		flush = true
+		c.Unit.ChangedAt = now
+		sd.state[string(s.Path)] = c.Unit
+		sd.lastChange = now
+
+		// don't report anything on the first run but already failed units
+		if sd.bootstrap {
+			if sd.startupReport && s.ActiveState == "failed" {
+				startup := Change{Kind: Startup, Unit: c.Unit, Time: now}
+				sd.notified(&startup)
+				changes = append(changes, startup)
+			}
+			continue
+		}
+
+		// ActiveState
+		//
+		// active
+		// inactive
+		// activating
+		// deactivating
+		// failed
 
-			flush = true
-			sd.state[string(s.Path)] = Unit{s}
+		// LoadState
+		//
+		// loaded
+		// not-found
 
-			// don't report anything on the first run
-			if sd.bootstrap && first {
+		// SubState
+		//
+		// running
+		// start-pre
+		// stop-sig*
+
+		prev := &old
+		if !ok {
+			prev = nil
+		}
+		sd.info("unit changed", "unit", s.Name, "change_kind", c.Kind,
+			"active_state", s.ActiveState, "load_state", s.LoadState, "sub_state", s.SubState,
+			"transition", transition(prev, &c.Unit))
+		if sd.flapThreshold > 0 {
+			var ok bool
+			if c, ok = sd.detectFlap(c); !ok {
 				continue
 			}
+		}
+		if sd.grace > 0 && c.Kind != Flapping {
+			var ok bool
+			if c, ok = sd.delayFailure(c); !ok {
+				continue
+			}
+		}
+		if sd.debounce > 0 && c.Kind != Flapping {
+			sd.hold(c)
+			continue
+		}
+		changes = sd.report(changes, c)
+	}
 
-			// ActiveState
-			//
-			// active
-			// inactive
-			// activating
-			// deactivating
-			// failed
-
-			// LoadState
-			//
-			// loaded
-			// not-found
-
-			// SubState
-			//
-			// running
-			// start-pre
-			// stop-sig*
-
-			sd.logf("%s active=%s load=%s sub=%s", s.Name, s.ActiveState, s.LoadState, s.SubState)
-		}
-
-	Loop:
-		for path, u := range sd.state {
-			for _, s := range units {
-				if string(s.Path) == path {
-					continue Loop
-				}
+	for path, u := range sd.state {
+		if _, ok := sd.listed[path]; ok {
+			continue
+		}
+
+		flush = true
+		sd.lastChange = now
+		delete(sd.state, path)
+		delete(sd.pending, path)
+		delete(sd.failing, path)
+		delete(sd.recovering, path)
+		delete(sd.flaps, path)
+
+		// filters may have changed since the state was stored
+		if !sd.isWatched(u.Name) {
+			continue
+		}
+		sd.info("unit changed", "unit", u.Name, "change_kind", Removed,
+			"transition", transition(&u, nil))
+		changes = sd.report(changes, Change{Kind: Removed, Unit: u, Time: now})
+	}
+
+	if sd.maxUnits > 0 && sd.evict() {
+		flush = true
+	}
+
+	for _, c := range sd.settled(now) {
+		changes = sd.report(changes, c)
+	}
+	for _, c := range sd.graced(now) {
+		changes = sd.report(changes, c)
+	}
+	for _, c := range sd.unflapped(now) {
+		changes = sd.report(changes, c)
+	}
+	sd.forgetLimits(now)
+	sd.forgetSeen(now)
+
+	var failedNames map[string]bool
+	if sd.dependencies && hasFailures(changes) {
+		failedNames = map[string]bool{}
+		for _, u := range sd.state {
+			if u.ActiveState == "failed" {
+				failedNames[u.Name] = true
 			}
+		}
+	}
 
-			flush = true
-			delete(sd.state, path)
-			sd.logf("%s deleted", u.Name)
+	var failed int
+	for _, u := range sd.state {
+		if u.ActiveState == "failed" {
+			failed++
 		}
+	}
+	sd.metrics.SetUnits(len(sd.state), failed)
+	for i := range changes {
+		sd.metrics.IncChanges(changes[i].Kind.String())
+	}
 
-		first = false
-		if flush {
-			if err = sd.store(); err != nil {
-				return nil, err
+	sd.bootstrap = false
+	return changes, failedNames, flush
+}
+
+// enrich attaches timestamps, exit statuses, removal reasons, journal
+// tails and causes of failures to the changes, it's called without
+// the state lock, failed are names of failed units or nil.
+func (sd *Systemd) enrich(ctx context.Context, changes []Change, failed map[string]bool) {
+	for i := range changes {
+		c := &changes[i]
+		if c.Kind != Removed && c.Kind != Startup {
+			sd.fetchTimestamps(&c.Unit)
+			c.InState = inState(&c.Unit, c.Time)
+		}
+		if c.EnteredFailed() {
+			c.Exit = sd.fetchExit(c.Unit.Name)
+		}
+		if c.Kind == Removed {
+			c.RemovalReason = sd.fetchRemoval(c.Unit.Name)
+		}
+		if sd.journalLines > 0 && c.EnteredFailed() {
+			var err error
+			if c.Journal, err = journalTail(ctx, c.Unit.Name, sd.journalLines, sd.userBus); err != nil {
+				sd.warn("cannot read journal", "unit", c.Unit.Name, "error", err)
 			}
 		}
-		time.Sleep(sd.interval)
+	}
+	if failed != nil {
+		sd.attachCauses(changes, failed)
 	}
 }
 
-// load loads state from the state file.
-func (sd *Systemd) load() error {
-	// bootstrap is enabled when the state file doesn't exist or it's empty.
-	state, err := os.Lstat(sd.statePath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			sd.bootstrap = true
-			sd.logf("state file doesn't exist, enable bootstrap mode")
-			return nil
+// commit remembers the fetched timestamps of the changes, keeps the
+// changes for redelivery and flushes the state when flush is true.
+func (sd *Systemd) commit(changes []Change, flush bool) error {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	for i := range changes {
+		c := &changes[i]
+		if c.Kind == Removed || c.Kind == Startup {
+			continue
+		}
+		if u, ok := sd.state[string(c.Unit.Path)]; ok {
+			u.ActiveEnterTimestamp = c.Unit.ActiveEnterTimestamp
+			u.InactiveEnterTimestamp = c.Unit.InactiveEnterTimestamp
+			sd.state[string(c.Unit.Path)] = u
+		}
+	}
+	if sd.delivery && len(changes) != 0 {
+		// written before the state, so a crash in between
+		// results in a duplicate rather than a lost change
+		sd.outbox = append(sd.outbox, changes...)
+		sd.pruneOutbox(sd.now())
+		if err := sd.storeOutbox(); err != nil {
+			return err
+		}
+	}
+	if flush {
+		if err := sd.store(); err != nil {
+			return err
 		}
-		return err
 	}
-	if state.Size() == 0 {
+	return nil
+}
+
+// hasFailures reports whether any of the changes is a failure.
+func hasFailures(changes []Change) bool {
+	for i := range changes {
+		if changes[i].EnteredFailed() {
+			return true
+		}
+	}
+	return false
+}
+
+// report appends c to changes if it passes the reporting filters
+// and the per-unit rate limit, the state lock has to be held.
+func (sd *Systemd) report(changes []Change, c Change) []Change {
+	var reason string
+	switch {
+	case !sd.isReported(&c):
+		reason = "filtered"
+	case sd.isDuplicate(&c):
+		reason = "duplicate"
+	case !sd.allow(&c):
+		reason = "rate limited"
+	}
+	if reason != "" {
+		if sd.onSuppress != nil {
+			sd.onSuppress(c, reason)
+		}
+		return changes
+	}
+	if c.EnteredFailed() || c.Kind == Startup {
+		sd.notified(&c)
+	}
+	return append(changes, c)
+}
+
+// notified records that the failure of the unit is reported.
+func (sd *Systemd) notified(c *Change) {
+	c.Unit.FailureNotifiedAt, c.Unit.FailureAcked = c.Time, false
+	if u, ok := sd.state[string(c.Unit.Path)]; ok && !u.FailedAt.IsZero() {
+		u.FailureNotifiedAt, u.FailureAcked = c.Time, false
+		sd.state[string(c.Unit.Path)] = u
+	}
+}
+
+// isWatched reports whether the named unit passes unit type,
+// include and exclude filters.
+func (sd *Systemd) isWatched(name string) bool {
+	if len(sd.names) != 0 && !contains(sd.names, name) {
+		return false
+	}
+	if len(sd.unitTypes) != 0 && !hasAnySuffix(name, sd.unitTypes) {
+		return false
+	}
+	for _, p := range sd.exclude {
+		if ok, _ := filepath.Match(p, name); ok {
+			return false
+		}
+	}
+	if len(sd.include) == 0 {
+		return true
+	}
+	for _, p := range sd.include {
+		if ok, _ := filepath.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// contains reports whether s is in the list.
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// hasAnySuffix reports whether s ends with any of the suffixes.
+func hasAnySuffix(s string, suffixes []string) bool {
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(s, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isReported reports whether the change is returned to the caller,
+// the state is updated regardless of it.
+func (sd *Systemd) isReported(c *Change) bool {
+	if c.enteredSubState(sd.subStates) {
+		return true
+	}
+	if sd.isQuiet(c) {
+		return false
+	}
+	if sd.failedOnly {
+		return c.EnteredFailed() || c.LeftFailed() || c.Kind == Recovered || c.Kind == Flapping
+	}
+	return true
+}
+
+// wait blocks until the next poll should be made, that is either
+// interval elapses or a subscription update is received, or earlier
+// when a pending change settles, a grace period ends or a flapping
+// unit's transitions leave the flap window.
+func (sd *Systemd) wait(ctx context.Context) error {
+	sd.mu.RLock()
+	interval, maxInterval := sd.interval, sd.maxInterval
+	sd.mu.RUnlock()
+
+	// pending changes, held failures and flaps are accessed only by Next
+	now := sd.now()
+	settle, hasPending := sd.nextSettle(now)
+	if d, ok := sd.nextGrace(now); ok && (!hasPending || d < settle) {
+		settle, hasPending = d, true
+	}
+	if d, ok := sd.nextUnflap(now); ok && (!hasPending || d < settle) {
+		settle, hasPending = d, true
+	}
+	if sd.updates == nil {
+		if hasPending && settle < interval {
+			return sd.sleep(ctx, settle)
+		}
+		d := sd.adaptiveInterval(interval, maxInterval)
+		return sd.sleep(ctx, jitter(d, sd.jitter))
+	}
+
+	// poll every interval anyway when the watchdog is enabled
+	// and when pending changes are due
+	var tc <-chan time.Time
+	if sd.watchdog != 0 || hasPending {
+		d := interval
+		if hasPending && (sd.watchdog == 0 || settle < d) {
+			d = settle
+		}
+		tc = sd.after(d)
+	}
+
+	select {
+	case <-tc:
 		return nil
+	case <-sd.updates:
+	case err := <-sd.errs:
+		// an update may have been dropped, so poll anyway
+		sd.warn("subscription error", "error", err)
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 
-	f, err := os.OpenFile(sd.statePath, os.O_RDONLY, 0644)
-	if err != nil {
-		return err
+	// one ListUnits call covers all updates received so far
+	for {
+		select {
+		case <-sd.updates:
+		default:
+			return nil
+		}
 	}
-	defer f.Close()
+}
 
-	r, err := gzip.NewReader(f)
+// jitter randomizes d by up to the fraction of it in both directions.
+func jitter(d time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return d
+	}
+	return d + time.Duration((rand.Float64()*2-1)*fraction*float64(d))
+}
+
+// Reload applies unit type, include and exclude filters and the interval
+// of opts to the running instance without reconnecting or dropping
+// the state, it's safe to call concurrently with Next.
+//
+// opts are applied to the default settings like in New and replace
+// the current filters, so all of them have to be passed every time.
+// Changing the state file is an error, other options are ignored.
+func (sd *Systemd) Reload(opts ...Option) error {
+	n, err := configure(opts)
 	if err != nil {
 		return err
 	}
-	defer r.Close()
+	if n.statePath != sd.statePath {
+		return fmt.Errorf("state file cannot be changed at runtime: %s", n.statePath)
+	}
 
-	return gob.NewDecoder(r).Decode(&sd.state)
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	sd.unitTypes, sd.include, sd.exclude = n.unitTypes, n.include, n.exclude
+	sd.names = n.names
+	sd.interval, sd.maxInterval = n.interval, n.maxInterval
+	sd.info("configuration reloaded", "interval", sd.interval, "max_interval", sd.maxInterval,
+		"include", sd.include, "exclude", sd.exclude, "unit_types", sd.unitTypes, "units", sd.names)
+	return nil
 }
 
-// store flushes current state to the state file.
-func (sd *Systemd) store() error {
-	f, err := os.OpenFile(sd.statePath, os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
+// LastPoll returns the time of the last successful ListUnits call,
+// it's zero until the first one. It's safe to call it concurrently with Next.
+//
+// In the subscription mode units are listed only when systemd
+// reports changes, so it may be long ago on a quiet system.
+func (sd *Systemd) LastPoll() time.Time {
+	n := atomic.LoadInt64(&sd.lastPoll)
+	if n == 0 {
+		return time.Time{}
 	}
-	defer f.Close()
+	return time.Unix(0, n)
+}
 
-	w := gzip.NewWriter(f)
-	defer w.Close()
+// LastChange returns the time of the last poll that found any units
+// added, modified or removed, reported or not, it's zero until then.
+// Together with LastPoll it tells a quiet system from a stuck watcher.
+func (sd *Systemd) LastChange() time.Time {
+	sd.mu.RLock()
+	defer sd.mu.RUnlock()
+	return sd.lastChange
+}
+
+// Snapshot returns a copy of the current state sorted by unit names.
+func (sd *Systemd) Snapshot() []Unit {
+	sd.mu.RLock()
+	defer sd.mu.RUnlock()
+	units := make([]Unit, 0, len(sd.state))
+	for _, u := range sd.state {
+		if u.Annotations != nil {
+			annotations := make(map[string]string, len(u.Annotations))
+			for k, v := range u.Annotations {
+				annotations[k] = v
+			}
+			u.Annotations = annotations
+		}
+		units = append(units, u)
+	}
+	sort.Slice(units, func(i, j int) bool {
+		return units[i].Name < units[j].Name
+	})
+	return units
+}
 
-	return gob.NewEncoder(w).Encode(sd.state)
+// Annotation returns the named annotation of the unit with the given path.
+func (sd *Systemd) Annotation(path, key string) string {
+	sd.mu.RLock()
+	defer sd.mu.RUnlock()
+	return sd.state[path].Annotations[key]
 }
 
-// logf logs a message, arguments are treated like fmt.Sprintf.
-func (sd *Systemd) logf(s string, v ...interface{}) {
-	if sd.logger != nil {
-		sd.logger.Printf(s, v...)
+// SetAnnotation attaches the value to the unit with the given path
+// and flushes the state, an empty value deletes the annotation.
+// It's a noop when the unit is not tracked.
+func (sd *Systemd) SetAnnotation(path, key, value string) error {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	u, ok := sd.state[path]
+	if !ok {
+		return nil
 	}
+
+	// copy the map because it's shared with changes returned by Next
+	annotations := make(map[string]string, len(u.Annotations)+1)
+	for k, v := range u.Annotations {
+		annotations[k] = v
+	}
+	if value == "" {
+		delete(annotations, key)
+	} else {
+		annotations[key] = value
+	}
+	u.Annotations = annotations
+	sd.state[path] = u
+	return sd.store()
 }
 
-// Close closes dbus connection.
+// Close flushes the state, closes dbus connection and releases
+// the state file lock, the state is not flushed when no poll has
+// finished yet, so the bootstrap mode isn't lost. The lock is released
+// even when flushing fails and the flush error is returned then.
 func (sd *Systemd) Close() error {
+	sd.mu.Lock()
+	var err error
+	if !sd.bootstrap {
+		err = sd.store()
+	}
+	sd.mu.Unlock()
+
 	sd.conn.Close()
-	return nil
+	if uerr := sd.unlock(); err == nil {
+		err = uerr
+	}
+	return err
 }
 
 // Unit is a unit status object.
 type Unit struct {
 	dbus.UnitStatus
+
+	// FailedAt is the time when the unit was first seen failed,
+	// it's reset when the unit becomes active again.
+	FailedAt time.Time
+
+	// FailureNotifiedAt is the last time the unit failure was reported,
+	// a unit becoming active is Recovered only when it's set, so there're
+	// no recoveries of failures that were never reported, e.g. ones seen
+	// in the bootstrap mode or filtered out. It's reset with FailedAt.
+	FailureNotifiedAt time.Time
+
+	// FailureAcked is set when the reported failure is passed to Ack,
+	// that is when a notifier has delivered it. It's reset with FailedAt
+	// and every time the failure is reported again.
+	FailureAcked bool
+
+	// Annotations are arbitrary values attached to the unit by
+	// consumers with SetAnnotation, they survive unit state changes.
+	Annotations map[string]string
+
+	// Restarts is the service NRestarts property, it's read only with WithRestarts.
+	Restarts uint32
+
+	// Properties are the last known values of properties
+	// tracked by WithProperties formatted as strings.
+	Properties map[string]string
+
+	// MemoryCurrent and CPUUsageNSec are the last known resource usage
+	// of the running unit in bytes and nanoseconds, they're read only
+	// with WithResourceUsage and zero when accounting is disabled.
+	MemoryCurrent uint64
+	CPUUsageNSec  uint64
+
+	// ActiveEnterTimestamp and InactiveEnterTimestamp are the last times
+	// the unit has entered the active and inactive states, they're read
+	// for reported changes only and zero when unknown.
+	ActiveEnterTimestamp   time.Time
+	InactiveEnterTimestamp time.Time
+
+	// ChangedAt is the last time the watcher has observed the unit
+	// change, unlike the timestamps above it's not systemd's time.
+	// It's zero for units stored by previous versions.
+	ChangedAt time.Time
+}
+
+// isEqual reports whether the unit is in the same state as s.
+//
+// Only Name, LoadState, ActiveState and SubState are compared, when
+// extended is true Description, Followed, Path, JobId, JobType and JobPath
+// are compared as well, that is the whole dbus.UnitStatus, so a queued
+// job or a changed description makes the unit modified.
+func (u *Unit) isEqual(s dbus.UnitStatus, extended bool) bool {
+	if extended {
+		return u.UnitStatus == s
+	}
+	return u.Name == s.Name &&
+		u.LoadState == s.LoadState &&
+		u.ActiveState == s.ActiveState &&
+		u.SubState == s.SubState
+}
+
+// Kind is a type of a unit change.
+type Kind int
+
+const (
+	// Added means that a new unit has appeared.
+	Added Kind = iota
+
+	// Removed means that a unit has disappeared from the units list.
+	Removed
+
+	// Modified means that a unit has changed its state.
+	Modified
+
+	// Recovered means that a previously failed unit has become active.
+	Recovered
+
+	// Startup means that a unit has been already failed when the watcher
+	// started in bootstrap mode, it's reported only with WithStartupReport.
+	Startup
+
+	// Flapping means that a unit has changed its state too many times
+	// in a short period, it's reported only with WithFlapDetection.
+	Flapping
+)
+
+// String returns the kind name.
+func (k Kind) String() string {
+	switch k {
+	case Added:
+		return "added"
+	case Removed:
+		return "removed"
+	case Modified:
+		return "modified"
+	case Recovered:
+		return "recovered"
+	case Startup:
+		return "startup"
+	case Flapping:
+		return "flapping"
+	default:
+		return fmt.Sprintf("kind(%d)", int(k))
+	}
+}
+
+// MarshalText encodes the kind as its name, so it's readable in json.
+func (k Kind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// UnmarshalText decodes a kind name produced by MarshalText.
+func (k *Kind) UnmarshalText(b []byte) error {
+	for n := Added; n <= Flapping; n++ {
+		if n.String() == string(b) {
+			*k = n
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown change kind %q", b)
+}
+
+// Change describes what happened to a unit.
+type Change struct {
+	Kind Kind
+
+	// Unit is the current unit status, for Removed it's the last known one.
+	Unit Unit
+
+	// Old is the previous unit status, it's set only for Modified and Recovered
+	// so the previous ActiveState and SubState can be taken from it.
+	Old Unit
+
+	// Downtime is how long the unit has been down, it's set only for Recovered.
+	Downtime time.Duration
+
+	// Journal contains the last unit's journal lines when it has failed,
+	// it's set only with WithJournalTail.
+	Journal []string
+
+	// Time is when the change has been observed.
+	Time time.Time
+
+	// Transitions is the number of state changes during Window,
+	// they're set only for Flapping.
+	Transitions int
+	Window      time.Duration
+
+	// InState is how long the unit has been in the current active state
+	// when the change is reported, it's zero when it's unknown.
+	// Inactive, failed and activating states are counted together.
+	InState time.Duration
+
+	// Exit is the main process exit status of a service that
+	// has just failed, it's nil for other units and changes.
+	Exit *Exit
+
+	// Suppressed is the number of the unit changes dropped
+	// by the rate limiter since the previous reported one.
+	Suppressed int
+
+	// CausedBy lists failed dependencies of a failed
+	// unit, it's set only with WithDependencies.
+	CausedBy []string
+
+	// ChangedProperties lists properties tracked by WithProperties
+	// that have changed, it's set only for Modified and Recovered.
+	ChangedProperties []string
+
+	// RemovalReason describes why the unit has disappeared, e.g. masked
+	// or unit file deleted, it's set only for Removed when it's known.
+	RemovalReason string
+
+	// Extra is the context returned by the WithUnitPropertyFetcher
+	// callback, it's nil when the callback isn't set or has failed.
+	Extra map[string]string
+}
+
+// newChange creates a change from the previous unit state, that is nil
+// for newly added units, to the current status s observed at now.
+func newChange(old *Unit, s dbus.UnitStatus, now time.Time) Change {
+	c := Change{Kind: Added, Unit: Unit{UnitStatus: s}, Time: now}
+	if old != nil {
+		c.Kind = Modified
+		c.Old = *old
+		c.Unit.FailedAt = old.FailedAt
+		c.Unit.FailureNotifiedAt = old.FailureNotifiedAt
+		c.Unit.FailureAcked = old.FailureAcked
+		c.Unit.Annotations = old.Annotations
+		c.Unit.Restarts = old.Restarts
+		c.Unit.Properties = old.Properties
+		c.Unit.MemoryCurrent = old.MemoryCurrent
+		c.Unit.CPUUsageNSec = old.CPUUsageNSec
+		c.Unit.ActiveEnterTimestamp = old.ActiveEnterTimestamp
+		c.Unit.InactiveEnterTimestamp = old.InactiveEnterTimestamp
+	}
+
+	switch s.ActiveState {
+	case "failed":
+		if c.Unit.FailedAt.IsZero() {
+			c.Unit.FailedAt = now
+		}
+	case "active":
+		if c.Unit.FailedAt.IsZero() {
+			break
+		}
+		if c.Kind == Modified && !c.Unit.FailureNotifiedAt.IsZero() {
+			c.Kind = Recovered
+			c.Downtime = now.Sub(c.Unit.FailedAt)
+		}
+		c.Unit.FailedAt, c.Unit.FailureNotifiedAt, c.Unit.FailureAcked = time.Time{}, time.Time{}, false
+	}
+	return c
+}
+
+// EnteredFailed reports whether the unit has switched to the failed state.
+func (c *Change) EnteredFailed() bool {
+	switch c.Kind {
+	case Added:
+		return c.Unit.ActiveState == "failed"
+	case Modified:
+		return c.Unit.ActiveState == "failed" && c.Old.ActiveState != "failed"
+	default:
+		return false
+	}
+}
+
+// Restarted reports whether the service has been restarted automatically,
+// it's known only with WithRestarts.
+func (c *Change) Restarted() bool {
+	return (c.Kind == Modified || c.Kind == Recovered) && c.Unit.Restarts > c.Old.Restarts
+}
+
+// enteredSubState reports whether the unit has switched to any of the sub states.
+func (c *Change) enteredSubState(states []string) bool {
+	switch c.Kind {
+	case Added, Modified, Recovered:
+		return c.Unit.SubState != c.Old.SubState && contains(states, c.Unit.SubState)
+	default:
+		return false
+	}
 }
 
-// isEqual compares the unit to a dbus.UnitStatus.
-func (u *Unit) isEqual(u2 dbus.UnitStatus) bool {
-	return u.UnitStatus == u2
+// LeftFailed reports whether the unit has switched from the failed state to any other.
+func (c *Change) LeftFailed() bool {
+	return (c.Kind == Modified || c.Kind == Recovered) &&
+		c.Old.ActiveState == "failed" && c.Unit.ActiveState != "failed"
 }
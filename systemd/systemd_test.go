@@ -1,11 +1,19 @@
 package systemd
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/coreos/go-systemd/dbus"
+	godbus "github.com/godbus/dbus"
 )
 
 func TestNew(t *testing.T) {
@@ -15,7 +23,7 @@ func TestNew(t *testing.T) {
 	}
 	defer os.Remove(f.Name())
 
-	sd, err := New(
+	sd, err := New(context.Background(),
 		WithStateFile(f.Name()),
 		WithLogger(log.New(os.Stderr, "", log.LstdFlags)),
 		WithInterval(100*time.Millisecond),
@@ -32,3 +40,550 @@ func TestNew(t *testing.T) {
 		}
 	}()
 }
+
+func TestIsWatched(t *testing.T) {
+	sd := &Systemd{
+		include: []string{"*.service", "*.timer", "*.mount"},
+		exclude: []string{"getty@*"},
+	}
+	WithUnitTypes("service", ".timer")(sd)
+
+	for name, want := range map[string]bool{
+		"nginx.service":        true,
+		"logrotate.timer":      true,
+		"getty@tty1.service":   false,
+		"home.mount":           false,
+		"dev-sda1.device":      false,
+		"session-1.scope":      false,
+		"systemd-udevd.socket": false,
+	} {
+		if got := sd.isWatched(name); got != want {
+			t.Errorf("isWatched(%q) = %t, want %t", name, got, want)
+		}
+	}
+}
+
+func TestChangeFailed(t *testing.T) {
+	unit := func(state string) Unit {
+		var u Unit
+		u.ActiveState = state
+		return u
+	}
+	for _, c := range []struct {
+		change        Change
+		entered, left bool
+	}{
+		{Change{Kind: Added, Unit: unit("failed")}, true, false},
+		{Change{Kind: Added, Unit: unit("active")}, false, false},
+		{Change{Kind: Modified, Unit: unit("failed"), Old: unit("activating")}, true, false},
+		{Change{Kind: Modified, Unit: unit("failed"), Old: unit("failed")}, false, false},
+		{Change{Kind: Modified, Unit: unit("active"), Old: unit("failed")}, false, true},
+		{Change{Kind: Modified, Unit: unit("active"), Old: unit("activating")}, false, false},
+		{Change{Kind: Removed, Unit: unit("failed")}, false, false},
+	} {
+		if got := c.change.EnteredFailed(); got != c.entered {
+			t.Errorf("%s %s->%s: EnteredFailed() = %t, want %t",
+				c.change.Kind, c.change.Old.ActiveState, c.change.Unit.ActiveState, got, c.entered)
+		}
+		if got := c.change.LeftFailed(); got != c.left {
+			t.Errorf("%s %s->%s: LeftFailed() = %t, want %t",
+				c.change.Kind, c.change.Old.ActiveState, c.change.Unit.ActiveState, got, c.left)
+		}
+	}
+}
+
+func TestNewChangeRecovered(t *testing.T) {
+	now := time.Now()
+	status := func(state string) dbus.UnitStatus {
+		return dbus.UnitStatus{Name: "foo.service", ActiveState: state}
+	}
+
+	c := newChange(nil, status("active"), now)
+	if c.Kind != Added {
+		t.Fatalf("kind = %s, want %s", c.Kind, Added)
+	}
+
+	c = newChange(&c.Unit, status("failed"), now)
+	if c.Kind != Modified || !c.Unit.FailedAt.Equal(now) {
+		t.Fatalf("kind = %s, failed at = %s, want %s and %s", c.Kind, c.Unit.FailedAt, Modified, now)
+	}
+
+	// stopping a failed unit doesn't reset the failure time
+	c = newChange(&c.Unit, status("inactive"), now.Add(time.Minute))
+	if c.Kind != Modified || !c.Unit.FailedAt.Equal(now) {
+		t.Fatalf("kind = %s, failed at = %s, want %s and %s", c.Kind, c.Unit.FailedAt, Modified, now)
+	}
+
+	// the failure is not reported, so it's not a recovery
+	if r := newChange(&c.Unit, status("active"), now.Add(2*time.Minute)); r.Kind != Modified {
+		t.Fatalf("kind = %s of an unreported failure, want %s", r.Kind, Modified)
+	}
+
+	c.Unit.FailureNotifiedAt, c.Unit.FailureAcked = now, true
+	c = newChange(&c.Unit, status("active"), now.Add(2*time.Minute))
+	if c.Kind != Recovered {
+		t.Fatalf("kind = %s, want %s", c.Kind, Recovered)
+	}
+	if c.Downtime != 2*time.Minute {
+		t.Errorf("downtime = %s, want %s", c.Downtime, 2*time.Minute)
+	}
+	if !c.Unit.FailedAt.IsZero() || !c.Unit.FailureNotifiedAt.IsZero() || c.Unit.FailureAcked {
+		t.Errorf("failure = %s, %s, %t, want it reset",
+			c.Unit.FailedAt, c.Unit.FailureNotifiedAt, c.Unit.FailureAcked)
+	}
+}
+
+func TestSetAnnotation(t *testing.T) {
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	sd := &Systemd{
+		state:       map[string]Unit{"/foo": {}},
+		statePath:   f.Name(),
+		stateFormat: GobFormat,
+		compress:    GzipCompression,
+	}
+	if err = sd.SetAnnotation("/foo", "key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err = sd.SetAnnotation("/bar", "key", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	// reload the state from the file
+	sd.state = map[string]Unit{}
+	if err = sd.load(); err != nil {
+		t.Fatal(err)
+	}
+	if v := sd.Annotation("/foo", "key"); v != "value" {
+		t.Errorf("annotation = %q, want %q", v, "value")
+	}
+	if _, ok := sd.state["/bar"]; ok {
+		t.Errorf("untracked unit is annotated")
+	}
+}
+
+// fakeConn returns scripted ListUnits results one per call,
+// the last one is repeated when the script is exhausted.
+// When err is set it's returned instead.
+type fakeConn struct {
+	script [][]dbus.UnitStatus
+	calls  int
+	err    error
+}
+
+func (c *fakeConn) ListUnits() ([]dbus.UnitStatus, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	i := c.calls
+	if i >= len(c.script) {
+		i = len(c.script) - 1
+	}
+	c.calls++
+
+	// poll filters the returned slice in place
+	units := make([]dbus.UnitStatus, len(c.script[i]))
+	copy(units, c.script[i])
+	return units, nil
+}
+
+func (c *fakeConn) Close() {}
+
+// newFake creates a systemd instance with a fake connection
+// that replays the script and a temporary state file.
+func newFake(t *testing.T, script [][]dbus.UnitStatus, opts ...Option) *Systemd {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	sd, err := newWithConn(&fakeConn{script: script}, append([]Option{
+		WithStateFile(filepath.Join(dir, "state")),
+		WithLogger(nil),
+	}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// bypass MinInterval to keep tests fast
+	sd.interval = time.Millisecond
+	t.Cleanup(func() { sd.Close() })
+	return sd
+}
+
+// status is a shortcut for creating unit statuses in tests.
+func status(name, active, sub string) dbus.UnitStatus {
+	return dbus.UnitStatus{
+		Name:        name,
+		Path:        godbus.ObjectPath("/" + name),
+		LoadState:   "loaded",
+		ActiveState: active,
+		SubState:    sub,
+	}
+}
+
+func TestNext(t *testing.T) {
+	sd := newFake(t, [][]dbus.UnitStatus{
+		{status("a.service", "active", "running"), status("b.service", "active", "running")},
+		{status("a.service", "failed", "failed"), status("b.service", "active", "running")},
+		{status("a.service", "failed", "failed"), status("b.service", "active", "running")},
+		{status("a.service", "active", "running"), status("c.service", "activating", "start")},
+	})
+
+	for i, want := range [][]Kind{
+		{Modified},                  // a failed, the bootstrap poll is silent
+		{Recovered, Added, Removed}, // a recovered, c added, b removed
+	} {
+		changes, err := sd.Next(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(changes) != len(want) {
+			t.Fatalf("next %d: changes = %v, want %v", i, changes, want)
+		}
+		for j := range want {
+			if changes[j].Kind != want[j] {
+				t.Errorf("next %d: change %d kind = %s, want %s", i, j, changes[j].Kind, want[j])
+			}
+		}
+	}
+}
+
+func TestNextFailedOnly(t *testing.T) {
+	var suppressed []string
+	sd := newFake(t, [][]dbus.UnitStatus{
+		{status("a.service", "inactive", "dead")},
+		{status("a.service", "activating", "start")},
+		{status("a.service", "failed", "failed")},
+	}, WithFailedOnly(), WithSuppressionHook(func(c Change, reason string) {
+		suppressed = append(suppressed, c.Unit.ActiveState+" "+reason)
+	}))
+
+	changes, err := sd.Next(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || !changes[0].EnteredFailed() {
+		t.Fatalf("changes = %v, want a single failure", changes)
+	}
+	if !reflect.DeepEqual(suppressed, []string{"activating filtered"}) {
+		t.Errorf("suppressed = %q, want the activation filtered", suppressed)
+	}
+}
+
+func TestNextCancel(t *testing.T) {
+	sd := newFake(t, [][]dbus.UnitStatus{{status("a.service", "active", "running")}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := sd.Next(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestNextBootstrap(t *testing.T) {
+	sd := newFake(t, [][]dbus.UnitStatus{
+		{status("a.service", "active", "running")},
+	}, WithBootstrap(false))
+
+	changes, err := sd.Next(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Kind != Added {
+		t.Fatalf("changes = %v, want a.service added", changes)
+	}
+}
+
+func TestNextStartupReport(t *testing.T) {
+	sd := newFake(t, [][]dbus.UnitStatus{
+		{status("a.service", "failed", "failed"), status("b.service", "active", "running")},
+	}, WithStartupReport())
+
+	changes, err := sd.Next(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Kind != Startup || changes[0].Unit.Name != "a.service" {
+		t.Fatalf("changes = %v, want a.service startup report", changes)
+	}
+}
+
+func TestPoll(t *testing.T) {
+	sd := newFake(t, [][]dbus.UnitStatus{
+		{status("a.service", "active", "running")},
+		{status("a.service", "active", "running")},
+		{status("a.service", "failed", "failed")},
+	})
+
+	for i, want := range []int{0, 0, 1} {
+		changes, err := sd.Poll(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(changes) != want {
+			t.Errorf("poll %d: changes = %v, want %d", i, changes, want)
+		}
+	}
+}
+
+func TestLastPoll(t *testing.T) {
+	t.Parallel()
+
+	sd := newFake(t, [][]dbus.UnitStatus{
+		{status("a.service", "active", "running")},
+	})
+	if !sd.LastPoll().IsZero() {
+		t.Fatal("LastPoll is not zero before the first poll")
+	}
+	if _, err := sd.poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(sd.LastPoll()) > time.Minute {
+		t.Errorf("LastPoll = %s, want about now", sd.LastPoll())
+	}
+}
+
+func TestLastChange(t *testing.T) {
+	t.Parallel()
+
+	sd := newFake(t, [][]dbus.UnitStatus{
+		{status("a.service", "active", "running")},
+		{status("a.service", "active", "running")},
+	})
+	if _, err := sd.poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	first := sd.LastChange()
+	if first.IsZero() {
+		t.Fatal("LastChange is zero after the bootstrap poll")
+	}
+	if _, err := sd.poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !sd.LastChange().Equal(first) {
+		t.Errorf("LastChange = %s after a poll without changes, want %s", sd.LastChange(), first)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	t.Parallel()
+
+	sd := newFake(t, [][]dbus.UnitStatus{
+		{status("b.service", "active", "running"), status("a.service", "active", "running")},
+	})
+	if _, err := sd.poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := sd.SetAnnotation("/a.service", "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+
+	units := sd.Snapshot()
+	if len(units) != 2 || units[0].Name != "a.service" || units[1].Name != "b.service" {
+		t.Fatalf("snapshot = %v, want a.service and b.service", units)
+	}
+	units[0].Annotations["k"] = "changed"
+	if v := sd.Annotation("/a.service", "k"); v != "v" {
+		t.Errorf("annotation = %q after changing the snapshot, want %q", v, "v")
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	t.Parallel()
+
+	var script [][]dbus.UnitStatus
+	for i := 0; i < 10; i++ {
+		script = append(script,
+			[]dbus.UnitStatus{status("a.service", "active", "running")},
+			[]dbus.UnitStatus{status("a.service", "failed", "failed")},
+		)
+	}
+	sd := newFake(t, script, WithDeliveryTracking())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for ctx.Err() == nil {
+			sd.Snapshot()
+			sd.LastPoll()
+			if err := sd.SetAnnotation("/a.service", "k", "v"); err != nil {
+				t.Error(err)
+				return
+			}
+			sd.Annotation("/a.service", "k")
+		}
+	}()
+
+	for i := 0; i < 5; i++ {
+		changes, err := sd.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = sd.Ack(changes); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cancel()
+	wg.Wait()
+}
+
+func TestMinInterval(t *testing.T) {
+	t.Parallel()
+
+	for _, d := range []time.Duration{-time.Second, 0, MinInterval - 1} {
+		if _, err := configure([]Option{WithInterval(d)}); err == nil {
+			t.Errorf("interval %s: expected an error", d)
+		}
+	}
+}
+
+func TestJitter(t *testing.T) {
+	t.Parallel()
+
+	if d := jitter(time.Second, 0); d != time.Second {
+		t.Errorf("jitter = %s, want 1s", d)
+	}
+	for i := 0; i < 100; i++ {
+		if d := jitter(time.Second, 0.1); d < 900*time.Millisecond || d > 1100*time.Millisecond {
+			t.Fatalf("jitter = %s, want within 1s±100ms", d)
+		}
+	}
+}
+
+func TestIsEqual(t *testing.T) {
+	t.Parallel()
+
+	u := Unit{UnitStatus: status("a.service", "activating", "start")}
+	s := u.UnitStatus
+	s.JobId = 42
+	s.Description = "new description"
+	if !u.isEqual(s, false) {
+		t.Error("volatile fields make units different")
+	}
+	if u.isEqual(s, true) {
+		t.Error("volatile fields are ignored in the extended mode")
+	}
+	s.SubState = "start-pre"
+	if u.isEqual(s, false) {
+		t.Error("sub state change is ignored")
+	}
+}
+
+func TestReload(t *testing.T) {
+	t.Parallel()
+
+	sd := newFake(t, [][]dbus.UnitStatus{{status("a.service", "active", "running")}},
+		WithInclude("b.*"),
+	)
+	if err := sd.Reload(WithStateFile(sd.statePath), WithInclude("a.*"), WithInterval(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if !sd.isWatched("a.service") || sd.isWatched("b.service") {
+		t.Errorf("include = %v, want [a.*]", sd.include)
+	}
+	if sd.interval != time.Second {
+		t.Errorf("interval = %s, want 1s", sd.interval)
+	}
+	if err := sd.Reload(WithStateFile(sd.statePath + ".new")); err == nil {
+		t.Error("expected an error on the state file change")
+	}
+}
+
+// BenchmarkPoll measures a poll of many units that don't change,
+// the remaining allocations are the ListUnits result and its call.
+func BenchmarkPoll(b *testing.B) {
+	units := make([]dbus.UnitStatus, 2000)
+	restarts := make(map[string]uint32, len(units))
+	for i := range units {
+		units[i] = status(fmt.Sprintf("unit-%d.service", i), "active", "running")
+		restarts[units[i].Name] = 1
+	}
+	for _, bc := range []struct {
+		name string
+		conn conn
+		opts []Option
+	}{
+		{"plain", &fakeConn{script: [][]dbus.UnitStatus{units}}, nil},
+		{"restarts", &restartsConn{
+			fakeConn: &fakeConn{script: [][]dbus.UnitStatus{units}},
+			restarts: []map[string]uint32{restarts},
+		}, []Option{WithRestarts()}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			sd, err := newWithConn(bc.conn, append(bc.opts, WithInMemoryState(), WithLogger(nil))...)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer sd.Close()
+			if _, err = sd.poll(context.Background()); err != nil {
+				b.Fatal(err)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err = sd.poll(context.Background()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// lockCheckConn is a fakeConn that records dbus calls
+// made while the state lock is held.
+type lockCheckConn struct {
+	*fakeConn
+	sd     *Systemd
+	locked []string
+}
+
+func (c *lockCheckConn) check(call string) {
+	if c.sd.mu.TryLock() {
+		c.sd.mu.Unlock()
+		return
+	}
+	c.locked = append(c.locked, call)
+}
+
+func (c *lockCheckConn) GetUnitTypeProperty(unit, unitType, name string) (*dbus.Property, error) {
+	c.check(unitType + "." + name)
+	return nil, godbus.Error{Name: "org.freedesktop.DBus.Error.UnknownProperty"}
+}
+
+func (c *lockCheckConn) ListUnitFilesByPatterns(states, patterns []string) ([]dbus.UnitFile, error) {
+	c.check("ListUnitFilesByPatterns")
+	return nil, nil
+}
+
+func TestDiffUnlocked(t *testing.T) {
+	c := &lockCheckConn{fakeConn: &fakeConn{script: [][]dbus.UnitStatus{
+		{status("a.service", "active", "running"), status("b.service", "active", "running")},
+		{status("a.service", "failed", "failed")},
+	}}}
+	sd, err := newWithConn(c, WithStateFile(filepath.Join(t.TempDir(), "state")), WithLogger(nil),
+		WithRestarts(), WithResourceUsage(), WithDependencies(), WithProperties("FragmentPath"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sd.Close()
+	c.sd = sd
+
+	for i := 0; i < 2; i++ {
+		if _, err := sd.Poll(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.locked != nil {
+		t.Errorf("dbus calls made holding the state lock: %v", c.locked)
+	}
+}
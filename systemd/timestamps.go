@@ -0,0 +1,46 @@
+package systemd
+
+import "time"
+
+// fetchTimestamps sets the times the unit has entered
+// the active and inactive states, unknown ones stay zero.
+func (sd *Systemd) fetchTimestamps(u *Unit) {
+	pg, ok := sd.conn.(propertyGetter)
+	if !ok {
+		return
+	}
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{
+		{"ActiveEnterTimestamp", &u.ActiveEnterTimestamp},
+		{"InactiveEnterTimestamp", &u.InactiveEnterTimestamp},
+	} {
+		prop, err := pg.GetUnitTypeProperty(u.Name, "Unit", p.name)
+		if err != nil {
+			sd.warn("cannot read timestamp", "unit", u.Name, "property", p.name, "error", err)
+			continue
+		}
+		// microseconds since the epoch, zero means never
+		if usec, ok := prop.Value.Value().(uint64); ok && usec != 0 {
+			*p.t = time.Unix(0, int64(usec)*int64(time.Microsecond))
+		}
+	}
+}
+
+// inState returns how long the unit has been in its current state at now,
+// it's zero when it's unknown or the timestamp is in the future
+// because of the clock skew.
+func inState(u *Unit, now time.Time) time.Duration {
+	var t time.Time
+	switch u.ActiveState {
+	case "active", "reloading", "deactivating":
+		t = u.ActiveEnterTimestamp
+	case "inactive", "failed", "activating":
+		t = u.InactiveEnterTimestamp
+	}
+	if t.IsZero() || t.After(now) {
+		return 0
+	}
+	return now.Sub(t)
+}
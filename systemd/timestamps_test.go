@@ -0,0 +1,31 @@
+package systemd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInState(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	unit := func(state string, active, inactive time.Time) *Unit {
+		u := &Unit{ActiveEnterTimestamp: active, InactiveEnterTimestamp: inactive}
+		u.ActiveState = state
+		return u
+	}
+	for _, tc := range []struct {
+		name string
+		unit *Unit
+		want time.Duration
+	}{
+		{"active", unit("active", now.Add(-time.Hour), now.Add(-2*time.Hour)), time.Hour},
+		{"failed", unit("failed", now.Add(-time.Hour), now.Add(-time.Minute)), time.Minute},
+		{"zero", unit("failed", now.Add(-time.Hour), time.Time{}), 0},
+		{"skew", unit("active", now.Add(time.Minute), time.Time{}), 0},
+	} {
+		if got := inState(tc.unit, now); got != tc.want {
+			t.Errorf("%s: inState = %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
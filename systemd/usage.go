@@ -0,0 +1,82 @@
+package systemd
+
+import (
+	"math"
+	"path"
+
+	"github.com/coreos/go-systemd/dbus"
+)
+
+// usage is resource usage of a unit.
+type usage struct {
+	memory uint64
+	cpu    uint64
+}
+
+// cgroupTypes maps unit name suffixes to dbus interfaces of unit types
+// that have cgroup properties.
+var cgroupTypes = map[string]string{
+	".service": "Service",
+	".scope":   "Scope",
+	".slice":   "Slice",
+	".socket":  "Socket",
+	".mount":   "Mount",
+	".swap":    "Swap",
+}
+
+// fetchUsage returns MemoryCurrent and CPUUsageNSec of running units
+// by their paths, units whose properties cannot be read are skipped.
+func (sd *Systemd) fetchUsage(units []dbus.UnitStatus) map[string]usage {
+	pg, ok := sd.conn.(propertyGetter)
+	if !ok {
+		return nil
+	}
+	// the map is reused between polls, it's consumed by poll only
+	if sd.usageBuf == nil {
+		sd.usageBuf = make(map[string]usage, len(units))
+	}
+	m := sd.usageBuf
+	clear(m)
+	for _, u := range units {
+		if u.ActiveState != "active" && u.ActiveState != "reloading" {
+			continue
+		}
+		typ, ok := cgroupTypes[path.Ext(u.Name)]
+		if !ok {
+			continue
+		}
+
+		var us usage
+		for _, p := range []struct {
+			name string
+			v    *uint64
+		}{
+			{"MemoryCurrent", &us.memory},
+			{"CPUUsageNSec", &us.cpu},
+		} {
+			prop, err := pg.GetUnitTypeProperty(u.Name, typ, p.name)
+			if err != nil {
+				sd.warn("cannot read resource usage", "unit", u.Name, "property", p.name, "error", err)
+				continue
+			}
+			// UINT64_MAX means that accounting is disabled
+			if n, ok := prop.Value.Value().(uint64); ok && n != math.MaxUint64 {
+				*p.v = n
+			}
+		}
+		if us.memory != 0 || us.cpu != 0 {
+			m[string(u.Path)] = us
+		}
+	}
+	return m
+}
+
+// setUsage updates the last known unit resource usage.
+func (u *Unit) setUsage(us usage) {
+	if us.memory != 0 {
+		u.MemoryCurrent = us.memory
+	}
+	if us.cpu != 0 {
+		u.CPUUsageNSec = us.cpu
+	}
+}
@@ -0,0 +1,42 @@
+package systemd
+
+import (
+	"math"
+	"testing"
+
+	"github.com/coreos/go-systemd/dbus"
+	godbus "github.com/godbus/dbus"
+)
+
+// usageConn is a fakeConn that reports the same cgroup properties for all units.
+type usageConn struct {
+	*fakeConn
+	props map[string]uint64
+}
+
+func (c *usageConn) GetUnitTypeProperty(unit, unitType, name string) (*dbus.Property, error) {
+	return &dbus.Property{Name: name, Value: godbus.MakeVariant(c.props[name])}, nil
+}
+
+func TestFetchUsage(t *testing.T) {
+	t.Parallel()
+
+	sd := &Systemd{conn: &usageConn{props: map[string]uint64{
+		"MemoryCurrent": 64 << 20,
+		"CPUUsageNSec":  math.MaxUint64,
+	}}}
+	m := sd.fetchUsage([]dbus.UnitStatus{
+		status("a.service", "active", "running"),
+		status("b.service", "failed", "failed"),
+		status("c.device", "active", "plugged"),
+	})
+	if len(m) != 1 {
+		t.Fatalf("usage = %v, want only a.service", m)
+	}
+	var u Unit
+	u.CPUUsageNSec = 1
+	u.setUsage(m["/a.service"])
+	if u.MemoryCurrent != 64<<20 || u.CPUUsageNSec != 1 {
+		t.Errorf("memory = %d, cpu = %d, want %d and 1", u.MemoryCurrent, u.CPUUsageNSec, 64<<20)
+	}
+}
@@ -0,0 +1,37 @@
+package systemd
+
+import (
+	"github.com/coreos/go-systemd/daemon"
+)
+
+// notifyReady tells the service manager that the startup is finished
+// and enables watchdog keep-alive pings when WATCHDOG_USEC is set.
+// It's no-op when the process is not started by systemd.
+func (sd *Systemd) notifyReady() {
+	if _, err := daemon.SdNotify(false, "READY=1"); err != nil {
+		sd.warn("sd_notify failed", "error", err)
+	}
+
+	d, err := daemon.SdWatchdogEnabled(false)
+	if err != nil {
+		sd.warn("cannot check watchdog", "error", err)
+		return
+	}
+	if d == 0 {
+		return
+	}
+	sd.watchdog = d
+	if sd.interval > d/2 {
+		sd.warn("poll interval is too long for the watchdog timeout", "interval", sd.interval, "watchdog", d)
+	}
+}
+
+// notifyWatchdog sends a keep-alive ping to the service manager.
+func (sd *Systemd) notifyWatchdog() {
+	if sd.watchdog == 0 {
+		return
+	}
+	if _, err := daemon.SdNotify(false, "WATCHDOG=1"); err != nil {
+		sd.warn("sd_notify failed", "error", err)
+	}
+}
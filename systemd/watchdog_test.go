@@ -0,0 +1,47 @@
+package systemd
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchdog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sock := filepath.Join(dir, "notify")
+	l, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: sock, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	t.Setenv("NOTIFY_SOCKET", sock)
+	t.Setenv("WATCHDOG_USEC", "10000000")
+
+	sd := &Systemd{interval: time.Second}
+	sd.notifyReady()
+	if sd.watchdog != 10*time.Second {
+		t.Fatalf("watchdog = %s, want 10s", sd.watchdog)
+	}
+	sd.notifyWatchdog()
+
+	b := make([]byte, 64)
+	for _, want := range []string{"READY=1", "WATCHDOG=1"} {
+		l.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := l.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b[:n]); got != want {
+			t.Errorf("notification = %q, want %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+// Package teams posts unit changes to microsoft teams incoming webhooks
+// as legacy MessageCards, a card per batch with a section per change.
+package teams
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/amenzhinsky/systemd-slack/internal/httpclient"
+	"github.com/amenzhinsky/systemd-slack/notifier"
+	"github.com/amenzhinsky/systemd-slack/systemd"
+)
+
+// Option is a configuration value.
+type Option func(t *Teams)
+
+// WithLogger sets logger, nil disables logging.
+func WithLogger(l *log.Logger) Option {
+	return func(t *Teams) {
+		t.logger = l
+	}
+}
+
+// WithHTTPTimeout limits duration of every request,
+// zero disables the timeout, the default is 10s.
+func WithHTTPTimeout(d time.Duration) Option {
+	return func(t *Teams) {
+		t.timeout = d
+	}
+}
+
+// WithClientCert makes the client present the PEM-encoded certificate
+// and key to servers requesting one, they're loaded by New.
+func WithClientCert(certFile, keyFile string) Option {
+	return func(t *Teams) {
+		t.certFile, t.keyFile = certFile, keyFile
+	}
+}
+
+// WithRootCAs makes the client verify servers with
+// certificate authorities from the PEM file.
+func WithRootCAs(caFile string) Option {
+	return func(t *Teams) {
+		t.caFile = caFile
+	}
+}
+
+// WithAcknowledger makes the client acknowledge changes
+// with a once they are posted, see systemd.WithDeliveryTracking.
+func WithAcknowledger(a notifier.Acknowledger) Option {
+	return func(t *Teams) {
+		t.acknowledger = a
+	}
+}
+
+// New creates a client that posts to the incoming webhook url.
+func New(url string, opts ...Option) (*Teams, error) {
+	if url == "" {
+		return nil, errors.New("teams: url is empty")
+	}
+	t := &Teams{
+		url:     url,
+		client:  http.DefaultClient,
+		timeout: 10 * time.Second,
+		logger:  log.New(os.Stdout, "[teams] ", log.LstdFlags),
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	if t.certFile != "" || t.keyFile != "" || t.caFile != "" {
+		if err := t.setTLS(); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// setTLS replaces the client with its copy that uses
+// the client certificate and root CAs.
+func (t *Teams) setTLS() error {
+	c, err := httpclient.WithTLS(t.client, t.certFile, t.keyFile, t.caFile)
+	if err != nil {
+		return fmt.Errorf("teams: %s", err)
+	}
+	t.client = c
+	return nil
+}
+
+// Teams is a microsoft teams incoming webhook client.
+type Teams struct {
+	mu           sync.Mutex // guards url
+	url          string
+	client       *http.Client
+	timeout      time.Duration
+	logger       *log.Logger
+	acknowledger notifier.Acknowledger
+	certFile     string
+	keyFile      string
+	caFile       string
+}
+
+// card is a MessageCard, see the actionable message card reference.
+type card struct {
+	Type       string    `json:"@type"`
+	Context    string    `json:"@context"`
+	ThemeColor string    `json:"themeColor"`
+	Summary    string    `json:"summary"`
+	Title      string    `json:"title"`
+	Sections   []section `json:"sections"`
+}
+
+type section struct {
+	ActivityTitle    string `json:"activityTitle"`
+	ActivitySubtitle string `json:"activitySubtitle,omitempty"`
+	Text             string `json:"text,omitempty"`
+	Facts            []fact `json:"facts"`
+	Markdown         bool   `json:"markdown"`
+}
+
+type fact struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// theme colors
+const (
+	red    = "D00000"
+	green  = "2EB886"
+	yellow = "DAA038"
+)
+
+// newCard renders the changes, the card is red when any
+// of them is a failure and green when all are recoveries.
+func newCard(changes []systemd.Change) *card {
+	c := &card{
+		Type:       "MessageCard",
+		Context:    "https://schema.org/extensions",
+		ThemeColor: green,
+		Sections:   make([]section, 0, len(changes)),
+	}
+	for i := range changes {
+		ch := &changes[i]
+		s := section{
+			ActivityTitle:    ch.Unit.Name,
+			ActivitySubtitle: ch.Unit.Description,
+			Markdown:         true,
+			Facts: []fact{
+				{"Change", ch.Kind.String()},
+				{"Active State", ch.Unit.ActiveState},
+				{"Sub State", ch.Unit.SubState},
+				{"Load State", ch.Unit.LoadState},
+			},
+		}
+		if ch.Kind == systemd.Modified {
+			s.Facts = append(s.Facts, fact{"Previous State", ch.Old.ActiveState + " (" + ch.Old.SubState + ")"})
+		}
+		if ch.Exit != nil && ch.Exit.String() != "" {
+			s.Facts = append(s.Facts, fact{"Exit", ch.Exit.String()})
+		}
+		if ch.Downtime > 0 {
+			s.Facts = append(s.Facts, fact{"Downtime", ch.Downtime.Round(time.Second).String()})
+		}
+		if ch.RemovalReason != "" {
+			s.Facts = append(s.Facts, fact{"Removal Reason", ch.RemovalReason})
+		}
+		for _, k := range ch.ExtraKeys() {
+			s.Facts = append(s.Facts, fact{k, ch.Extra[k]})
+		}
+		for _, line := range ch.Journal {
+			s.Text += line + "  \n" // trailing spaces make a line break
+		}
+		c.Sections = append(c.Sections, s)
+
+		switch {
+		case ch.EnteredFailed(), ch.Kind == systemd.Startup, ch.Kind == systemd.Flapping:
+			c.ThemeColor = red
+		case ch.Kind != systemd.Recovered && c.ThemeColor == green:
+			c.ThemeColor = yellow
+		}
+	}
+
+	if len(changes) == 1 {
+		c.Title = fmt.Sprintf("%s is %s", changes[0].Unit.Name, changes[0].Unit.ActiveState)
+	} else {
+		c.Title = fmt.Sprintf("%d units changed", len(changes))
+	}
+	c.Summary = c.Title
+	return c
+}
+
+// SetURL replaces the incoming webhook url, e.g. when it's rotated,
+// it's safe to call it concurrently with posting.
+func (t *Teams) SetURL(url string) {
+	t.mu.Lock()
+	t.url = url
+	t.mu.Unlock()
+}
+
+// Notify posts the changes as a single card.
+func (t *Teams) Notify(ctx context.Context, changes []systemd.Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	if err := t.post(ctx, newCard(changes)); err != nil {
+		return err
+	}
+	if t.acknowledger != nil {
+		return t.acknowledger.Ack(changes)
+	}
+	return nil
+}
+
+// Message posts the text as a card without sections.
+func (t *Teams) Message(ctx context.Context, text string) error {
+	return t.post(ctx, &card{
+		Type:       "MessageCard",
+		Context:    "https://schema.org/extensions",
+		ThemeColor: yellow,
+		Summary:    text,
+		Title:      text,
+		Sections:   []section{},
+	})
+}
+
+// post sends the card, legacy connectors respond with 200
+// and an error message in the body instead of "1" on failures.
+func (t *Teams) post(ctx context.Context, c *card) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	t.infof("payload: %s", b)
+
+	t.mu.Lock()
+	url := t.url
+	t.mu.Unlock()
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if t.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.timeout)
+		defer cancel()
+	}
+	r, err := t.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	t.infof("response: %s", r.Status)
+
+	body, _ := ioutil.ReadAll(io.LimitReader(r.Body, 1024))
+	body = bytes.TrimSpace(body)
+	switch {
+	case r.StatusCode >= 300:
+		return fmt.Errorf("teams: %s: %s", http.StatusText(r.StatusCode), body)
+	case len(body) != 0 && string(body) != "1":
+		return fmt.Errorf("teams: %s", body)
+	}
+	return nil
+}
+
+// infof prints a debug message.
+func (t *Teams) infof(format string, v ...interface{}) {
+	if t.logger != nil {
+		t.logger.Printf(format, v...)
+	}
+}
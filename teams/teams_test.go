@@ -0,0 +1,77 @@
+package teams
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/amenzhinsky/systemd-slack/systemd"
+	"github.com/coreos/go-systemd/dbus"
+)
+
+func change(kind systemd.Kind, name, active, sub string) systemd.Change {
+	return systemd.Change{
+		Kind: kind,
+		Unit: systemd.Unit{UnitStatus: dbus.UnitStatus{Name: name, ActiveState: active, SubState: sub}},
+	}
+}
+
+func TestNewCard(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		changes []systemd.Change
+		color   string
+		title   string
+	}{
+		{[]systemd.Change{change(systemd.Recovered, "a.service", "active", "running")}, green, "a.service is active"},
+		{[]systemd.Change{change(systemd.Added, "a.service", "active", "running")}, yellow, "a.service is active"},
+		{[]systemd.Change{
+			change(systemd.Recovered, "a.service", "active", "running"),
+			change(systemd.Added, "b.service", "failed", "failed"),
+		}, red, "2 units changed"},
+	} {
+		c := newCard(tc.changes)
+		if c.ThemeColor != tc.color || c.Title != tc.title || len(c.Sections) != len(tc.changes) {
+			t.Errorf("card = %+v, want %s %q", c, tc.color, tc.title)
+		}
+	}
+}
+
+func TestNotify(t *testing.T) {
+	t.Parallel()
+
+	var c card
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+			t.Error(err)
+		}
+		if r.URL.Query().Get("fail") != "" {
+			w.Write([]byte("Summary or Text is required."))
+			return
+		}
+		w.Write([]byte("1"))
+	}))
+	defer ts.Close()
+
+	tm, err := New(ts.URL, WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := []systemd.Change{change(systemd.Added, "a.service", "failed", "failed")}
+	if err = tm.Notify(context.Background(), changes); err != nil {
+		t.Fatal(err)
+	}
+	if c.Type != "MessageCard" || c.Sections[0].ActivityTitle != "a.service" {
+		t.Errorf("card = %+v", c)
+	}
+
+	if tm, err = New(ts.URL+"?fail=1", WithLogger(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err = tm.Notify(context.Background(), changes); err == nil {
+		t.Fatal("expected an error on a connector error message")
+	}
+}
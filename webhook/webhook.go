@@ -0,0 +1,279 @@
+// Package webhook posts unit changes as json to an arbitrary http endpoint.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amenzhinsky/systemd-slack/internal/httpclient"
+	"github.com/amenzhinsky/systemd-slack/notifier"
+	"github.com/amenzhinsky/systemd-slack/systemd"
+)
+
+// Option is a configuration value.
+type Option func(w *Webhook)
+
+// WithLogger sets logger, nil disables logging.
+func WithLogger(l *log.Logger) Option {
+	return func(w *Webhook) {
+		w.logger = l
+	}
+}
+
+// WithHTTPClient sets the http client used for posting changes.
+func WithHTTPClient(c *http.Client) Option {
+	return func(w *Webhook) {
+		w.client = c
+	}
+}
+
+// WithHTTPTimeout limits duration of every request,
+// zero disables the timeout, the default is 10s.
+func WithHTTPTimeout(d time.Duration) Option {
+	return func(w *Webhook) {
+		w.timeout = d
+	}
+}
+
+// WithHeader adds the header to every request, e.g. for authentication.
+func WithHeader(key, value string) Option {
+	return func(w *Webhook) {
+		w.header.Add(key, value)
+	}
+}
+
+// WithClientCert makes the client present the PEM-encoded certificate
+// and key to endpoints enforcing mutual TLS, they're loaded by New.
+func WithClientCert(certFile, keyFile string) Option {
+	return func(w *Webhook) {
+		w.certFile, w.keyFile = certFile, keyFile
+	}
+}
+
+// WithRootCAs makes the client verify internal endpoints
+// with certificate authorities from the PEM file.
+func WithRootCAs(caFile string) Option {
+	return func(w *Webhook) {
+		w.caFile = caFile
+	}
+}
+
+// WithAcknowledger makes the client acknowledge changes
+// with a once they are posted, see systemd.WithDeliveryTracking.
+func WithAcknowledger(a notifier.Acknowledger) Option {
+	return func(w *Webhook) {
+		w.acknowledger = a
+	}
+}
+
+// New creates a client that posts changes to the url, every batch
+// is a single request with the json encoded Payload in its body.
+func New(url string, opts ...Option) (*Webhook, error) {
+	if url == "" {
+		return nil, errors.New("webhook: url is empty")
+	}
+	w := &Webhook{
+		url:     url,
+		client:  http.DefaultClient,
+		timeout: 10 * time.Second,
+		header:  http.Header{},
+		logger:  log.New(os.Stdout, "[webhook] ", log.LstdFlags),
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	if w.certFile != "" || w.keyFile != "" || w.caFile != "" {
+		if err := w.setTLS(); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// setTLS replaces the client with its copy that uses
+// the client certificate and root CAs.
+func (w *Webhook) setTLS() error {
+	c, err := httpclient.WithTLS(w.client, w.certFile, w.keyFile, w.caFile)
+	if err != nil {
+		return fmt.Errorf("webhook: %s", err)
+	}
+	w.client = c
+	return nil
+}
+
+// Webhook is a generic json webhook client.
+type Webhook struct {
+	mu           sync.Mutex // guards url
+	url          string
+	client       *http.Client
+	timeout      time.Duration
+	header       http.Header
+	logger       *log.Logger
+	acknowledger notifier.Acknowledger
+	certFile     string
+	keyFile      string
+	caFile       string
+}
+
+// Payload is the request body.
+//
+// Text is a plain summary of the changes, so endpoints
+// compatible with slack incoming webhooks such as mattermost
+// render something useful without any mapping.
+type Payload struct {
+	Text    string  `json:"text"`
+	Changes []Event `json:"changes"`
+}
+
+// Event is a single unit change.
+type Event struct {
+	Kind              string            `json:"kind"`
+	Unit              string            `json:"unit"`
+	Description       string            `json:"description"`
+	LoadState         string            `json:"load_state"`
+	ActiveState       string            `json:"active_state"`
+	SubState          string            `json:"sub_state"`
+	OldActiveState    string            `json:"old_active_state,omitempty"`
+	OldSubState       string            `json:"old_sub_state,omitempty"`
+	Time              time.Time         `json:"time"`
+	Downtime          float64           `json:"downtime_seconds,omitempty"`
+	Exit              string            `json:"exit,omitempty"`
+	CausedBy          []string          `json:"caused_by,omitempty"`
+	RemovalReason     string            `json:"removal_reason,omitempty"`
+	ChangedProperties []string          `json:"changed_properties,omitempty"`
+	Extra             map[string]string `json:"extra,omitempty"`
+	Journal           []string          `json:"journal,omitempty"`
+}
+
+// newPayload converts changes into the request body.
+func newPayload(changes []systemd.Change) *Payload {
+	p := &Payload{Changes: make([]Event, 0, len(changes))}
+	lines := make([]string, 0, len(changes))
+	for i := range changes {
+		c := &changes[i]
+		e := Event{
+			Kind:              c.Kind.String(),
+			Unit:              c.Unit.Name,
+			Description:       c.Unit.Description,
+			LoadState:         c.Unit.LoadState,
+			ActiveState:       c.Unit.ActiveState,
+			SubState:          c.Unit.SubState,
+			OldActiveState:    c.Old.ActiveState,
+			OldSubState:       c.Old.SubState,
+			Time:              c.Time,
+			Downtime:          c.Downtime.Seconds(),
+			CausedBy:          c.CausedBy,
+			RemovalReason:     c.RemovalReason,
+			ChangedProperties: c.ChangedProperties,
+			Extra:             c.Extra,
+			Journal:           c.Journal,
+		}
+		if c.Exit != nil {
+			e.Exit = c.Exit.String()
+		}
+		p.Changes = append(p.Changes, e)
+		lines = append(lines, fmt.Sprintf("%s %s: %s (%s)", c.Unit.Name, e.Kind, e.ActiveState, e.SubState))
+	}
+	p.Text = strings.Join(lines, "\n")
+	return p
+}
+
+// SetURL replaces the webhook url, e.g. when it's rotated,
+// it's safe to call it concurrently with posting.
+func (w *Webhook) SetURL(url string) {
+	w.mu.Lock()
+	w.url = url
+	w.mu.Unlock()
+}
+
+// Notify posts the changes in a single request.
+func (w *Webhook) Notify(ctx context.Context, changes []systemd.Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(newPayload(changes))
+	if err != nil {
+		return err
+	}
+	w.infof("payload: %s", b)
+	if err = w.post(ctx, b); err != nil {
+		return err
+	}
+	if w.acknowledger != nil {
+		return w.acknowledger.Ack(changes)
+	}
+	return nil
+}
+
+// Message posts the text without changes.
+func (w *Webhook) Message(ctx context.Context, text string) error {
+	b, err := json.Marshal(&Payload{Text: text, Changes: []Event{}})
+	if err != nil {
+		return err
+	}
+	w.infof("payload: %s", b)
+	return w.post(ctx, b)
+}
+
+func (w *Webhook) post(ctx context.Context, b []byte) error {
+	w.mu.Lock()
+	url := w.url
+	w.mu.Unlock()
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	for k, v := range w.header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+
+	if w.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.timeout)
+		defer cancel()
+	}
+	r, err := w.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	w.infof("response: %s", r.Status)
+
+	if r.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(io.LimitReader(r.Body, 1024))
+		return &ResponseError{StatusCode: r.StatusCode, Body: body}
+	}
+	return nil
+}
+
+// infof prints a debug message.
+func (w *Webhook) infof(format string, v ...interface{}) {
+	if w.logger != nil {
+		w.logger.Printf(format, v...)
+	}
+}
+
+// ResponseError is returned when the endpoint responds with a non-2xx code.
+type ResponseError struct {
+	StatusCode int
+	Body       []byte
+}
+
+func (e *ResponseError) Error() string {
+	if len(e.Body) == 0 {
+		return fmt.Sprintf("webhook: %s", http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("webhook: %s: %s", http.StatusText(e.StatusCode), bytes.TrimSpace(e.Body))
+}
@@ -0,0 +1,98 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/amenzhinsky/systemd-slack/systemd"
+	"github.com/coreos/go-systemd/dbus"
+)
+
+// acknowledger counts acknowledged changes.
+type acknowledger int
+
+func (a *acknowledger) Ack(changes []systemd.Change) error {
+	*a += acknowledger(len(changes))
+	return nil
+}
+
+func TestNotify(t *testing.T) {
+	t.Parallel()
+
+	var p Payload
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Authorization"); auth != "Bearer secret" {
+			t.Errorf("Authorization = %q, want %q", auth, "Bearer secret")
+		}
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer ts.Close()
+
+	var a acknowledger
+	w, err := New(ts.URL,
+		WithLogger(nil),
+		WithHeader("Authorization", "Bearer secret"),
+		WithAcknowledger(&a),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes := []systemd.Change{{
+		Kind: systemd.Modified,
+		Unit: systemd.Unit{UnitStatus: dbus.UnitStatus{
+			Name: "a.service", ActiveState: "failed", SubState: "failed",
+		}},
+		Old: systemd.Unit{UnitStatus: dbus.UnitStatus{
+			Name: "a.service", ActiveState: "active", SubState: "running",
+		}},
+		Exit:     &systemd.Exit{Result: "timeout"},
+		CausedBy: []string{"db.service"},
+	}}
+	if err = w.Notify(context.Background(), changes); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Changes) != 1 {
+		t.Fatalf("changes = %v, want one", p.Changes)
+	}
+	e := p.Changes[0]
+	if e.Unit != "a.service" || e.Kind != "modified" || e.OldActiveState != "active" ||
+		e.Exit != "timeout" || len(e.CausedBy) != 1 {
+		t.Errorf("event = %+v", e)
+	}
+	if !strings.Contains(p.Text, "a.service") {
+		t.Errorf("text = %q, want it to mention the unit", p.Text)
+	}
+	if a != 1 {
+		t.Errorf("acknowledged = %d, want 1", a)
+	}
+}
+
+func TestNotifyError(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("bad token\n"))
+	}))
+	defer ts.Close()
+
+	var a acknowledger
+	w, err := New(ts.URL, WithLogger(nil), WithAcknowledger(&a))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Notify(context.Background(), make([]systemd.Change, 1))
+	if err == nil || err.Error() != "webhook: Unauthorized: bad token" {
+		t.Fatalf("err = %v, want the response body", err)
+	}
+	if a != 0 {
+		t.Errorf("acknowledged = %d after an error, want 0", a)
+	}
+}